@@ -1,13 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/admin"
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain/bitcoin"
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain/ethereum"
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain/solana"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/checkpoint"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/deadletter"
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/kafka"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/registry"
 	"github.com/joho/godotenv"
 
 	kafkago "github.com/segmentio/kafka-go"
@@ -16,7 +30,31 @@ import (
 const (
 	kafkaBuffer = 1000
 
+	defaultCheckpointPath = "checkpoints.json"
+	defaultDeadLetterPath = "deadletters.jsonl"
+	defaultRegistryPath   = "registry.db"
+
+	defaultShutdownTimeout = 30 * time.Second
+
+	defaultTransactionalID = "backend-interview-crypto"
+	// redriveTransactionalSuffix names the producer re-driving dead letters, next to the watchers one.
+	redriveTransactionalSuffix = "-redrive"
+	defaultWatchlistTopic      = "watchlist"
+
 	EnvBlockdaemonAPIKey = "BLOCKDAEMON_API_KEY"
+	EnvCheckpointBackend = "CHECKPOINT_BACKEND"
+	EnvCheckpointPath    = "CHECKPOINT_PATH"
+	EnvDeadLetterPath    = "DEAD_LETTER_PATH"
+	EnvShutdownTimeout   = "SHUTDOWN_TIMEOUT"
+	EnvDelivery          = "KAFKA_DELIVERY"
+	EnvTransactionalID   = "KAFKA_TRANSACTIONAL_ID"
+	EnvRegistryBackend   = "REGISTRY_BACKEND"
+	EnvRegistryPath      = "REGISTRY_PATH"
+	EnvAdminAddr         = "ADMIN_ADDR"
+	EnvAdminToken        = "ADMIN_TOKEN"
+	EnvWatchlistTopic    = "WATCHLIST_TOPIC"
+	EnvEthereumWSURL     = "ETHEREUM_WS_URL"
+	EnvSolanaWSURL       = "SOLANA_WS_URL"
 )
 
 func main() {
@@ -32,23 +70,330 @@ func main() {
 	}
 	kafkaWriter := kafka.InitKafkaWriter()
 	kafkaChan := make(chan kafkago.Message, kafkaBuffer)
+	redriving := len(os.Args) > 1 && os.Args[1] == "redrive"
+
+	// in exactly-once mode, checkpoints are committed with the events in Kafka
+	var checkpointer chain.Checkpointer
+	var transactor chain.Transactor
+	switch delivery := os.Getenv(EnvDelivery); delivery {
+	case "", "at-least-once":
+		checkpointer, err = newCheckpointer()
+		if err != nil {
+			log.Fatal("failed to open checkpoints:", err)
+		}
+	case "exactly-once":
+		txnWriter, err := newTransactionalWriter(redriving)
+		if err != nil {
+			log.Fatal("failed to start Kafka transactions:", err)
+		}
+		checkpointer, transactor = txnWriter, txnWriter
+	default:
+		log.Fatalf("unknown %s %q, expected at-least-once or exactly-once", EnvDelivery, delivery)
+	}
+
+	deadLetterPath := os.Getenv(EnvDeadLetterPath)
+	if deadLetterPath == "" {
+		deadLetterPath = defaultDeadLetterPath
+	}
+	deadLetters := deadletter.NewSpool(deadLetterPath)
+
+	ethFinality, err := chain.LoadFinality(chain.EthereumName, "safe", "finalized")
+	if err != nil {
+		log.Fatal(err)
+	}
+	solFinality, err := chain.LoadFinality(chain.SolanaName, "confirmed", "finalized")
+	if err != nil {
+		log.Fatal(err)
+	}
+	btcFinality, err := chain.LoadFinality(chain.BitcoinName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// without registry, watched addresses only come from the environment and are their own user
+	addressRegistry, err := newRegistry()
+	if err != nil {
+		log.Fatal("failed to load address registry:", err)
+	}
+
+	// the admin API edits the registry, which must be the bolt one
+	adminAddr := os.Getenv(EnvAdminAddr)
+	store, editable := addressRegistry.(admin.Store)
+	if adminAddr != "" && !editable {
+		log.Fatalf("%s requires %s=bolt", EnvAdminAddr, EnvRegistryBackend)
+	}
+	adminToken := os.Getenv(EnvAdminToken)
+	if adminAddr != "" && adminToken == "" {
+		log.Fatalf("%s requires %s", EnvAdminAddr, EnvAdminToken)
+	}
 
-	// start kafka writer
-	go kafka.StartKafka(kafkaChan, kafkaWriter)
+	keys, err := chain.LoadKeyStrategy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	solStrategy, err := solana.LoadStrategy()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// watch each supported blockchain
-	watchers := []chain.Watcher{
-		solana.NewSolanaWatcher(
-			solana.CreateClient(), kafkaChan),
-		ethereum.NewEthereumWatcher(
-			ethereum.CreateClient(), kafkaChan),
+	shutdownTimeout, err := loadShutdownTimeout()
+	if err != nil {
+		log.Fatal(err)
 	}
-	for _, watcher := range watchers {
-		if len(watcher.Addresses()) != 0 {
-			go watcher.Watch()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// watchers are created lazily, only the chains with dead letters are needed to re-drive
+	newWatchers := map[chain.Chain]func() chain.Watcher{
+		chain.SolanaName: func() chain.Watcher {
+			s := solana.NewSolanaWatcher(
+				solana.CreateClient(), kafkaChan, checkpointer, solFinality, deadLetters)
+			s.Transactor, s.Keys, s.Registry, s.Strategy = transactor, keys, addressRegistry, solStrategy
+			// slots are polled without a WebSocket endpoint to subscribe to
+			if url := os.Getenv(EnvSolanaWSURL); url != "" {
+				s.Slots = solana.CreateSlotsClient(url)
+			}
+			return s
+		},
+		chain.EthereumName: func() chain.Watcher {
+			e := ethereum.NewEthereumWatcher(
+				ethereum.CreateClient(), kafkaChan, checkpointer, ethFinality, deadLetters)
+			e.Transactor, e.Keys, e.Registry = transactor, keys, addressRegistry
+			// blocks are polled without a WebSocket endpoint to subscribe to
+			if url := os.Getenv(EnvEthereumWSURL); url != "" {
+				e.Heads = ethereum.CreateHeadsClient(url)
+			}
+			return e
+		},
+		chain.BitcoinName: func() chain.Watcher {
+			b := bitcoin.NewBitcoinWatcher(
+				bitcoin.CreateClient(), kafkaChan, checkpointer, btcFinality, deadLetters)
+			b.Transactor, b.Keys, b.Registry = transactor, keys, addressRegistry
+			return b
+		},
+	}
+
+	// start kafka writer, it is stopped after the watchers to flush their last messages
+	kafkaCtx, stopKafka := context.WithCancel(context.Background())
+	kafkaDone := make(chan struct{})
+	go func() {
+		kafka.StartKafka(kafkaCtx, kafkaChan, kafkaWriter, deadLetters)
+		close(kafkaDone)
+	}()
+
+	if redriving {
+		redriven, err := redrive(ctx, deadLetters, newWatchers, kafkaWriter)
+		stopKafka()
+		<-kafkaDone
+		closeAll(kafkaWriter, checkpointer, addressRegistry)
+		if err != nil {
+			log.Fatalf("re-drove %d dead letters before failing: %v", redriven, err)
+		}
+		log.Printf("Re-drove %d dead letters", redriven)
+		return
+	}
+
+	// the Kafka watchlist is followed until shutdown, addresses may then be added at any time
+	watchlist, followed := addressRegistry.(*kafka.Watchlist)
+	if followed {
+		go watchlist.Run(ctx)
+	}
+
+	// watch each supported blockchain, every one when addresses can be added while running
+	var watching sync.WaitGroup
+	watchers := map[chain.Chain]chain.Watcher{}
+	for _, name := range []chain.Chain{chain.SolanaName, chain.EthereumName, chain.BitcoinName} {
+		watcher := newWatchers[name]()
+		if len(watcher.Addresses()) != 0 || adminAddr != "" || followed {
+			watchers[name] = watcher
+			watching.Add(1)
+			go func() {
+				defer watching.Done()
+				watcher.Watch(ctx)
+			}()
 			log.Printf("Started watching chain: %s\n", watcher.Name())
 		}
 	}
 
-	select {}
+	var adminServer *admin.Server
+	var httpServer *http.Server
+	if adminAddr != "" {
+		adminServer = admin.NewServer(ctx, store, watchers, adminToken)
+		httpServer = &http.Server{Addr: adminAddr, Handler: adminServer.Handler()}
+		go func() {
+			if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("admin API failed:", err)
+			}
+		}()
+		log.Printf("Admin API listening on %s", adminAddr)
+	}
+
+	<-ctx.Done()
+	// a second signal kills the process
+	stop()
+	log.Printf("Shutting down, finishing blocks in flight within %s", shutdownTimeout)
+
+	shutdown := make(chan struct{})
+	go func() {
+		if adminServer != nil {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := httpServer.Shutdown(shutdownCtx); err != nil {
+				log.Printf("error stopping admin API: %v", err)
+			}
+			cancel()
+			adminServer.Wait()
+		}
+		// the watchers return once their retries and seen events are done, nothing is sent to Kafka afterwards
+		watching.Wait()
+		stopKafka()
+		<-kafkaDone
+		close(shutdown)
+	}()
+
+	select {
+	case <-shutdown:
+		closeAll(kafkaWriter, checkpointer, addressRegistry)
+		log.Println("Shutdown complete")
+	case <-time.After(shutdownTimeout):
+		// blocks not done are not checkpointed, they are processed again on restart
+		closeAll(kafkaWriter, checkpointer, addressRegistry)
+		log.Fatalf("shutdown timed out after %s, exiting with blocks in flight", shutdownTimeout)
+	}
+}
+
+// loadShutdownTimeout returns the SHUTDOWN_TIMEOUT duration, e.g. "30s".
+func loadShutdownTimeout() (time.Duration, error) {
+	env := os.Getenv(EnvShutdownTimeout)
+	if env == "" {
+		return defaultShutdownTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(env)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive duration such as 30s", EnvShutdownTimeout, env)
+	}
+	return timeout, nil
+}
+
+// closeAll closes the Kafka writer, and the checkpoint store and the address registry when they need to be.
+func closeAll(writer io.Closer, checkpointer chain.Checkpointer, addressRegistry chain.Registry) {
+	if err := writer.Close(); err != nil {
+		log.Printf("error closing Kafka writer: %v", err)
+	}
+	if closer, ok := checkpointer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("error closing checkpoints: %v", err)
+		}
+	}
+	if closer, ok := addressRegistry.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("error closing address registry: %v", err)
+		}
+	}
+}
+
+// redrive processes the dead letters of the spool again: blocks are reprocessed
+// and messages are written to Kafka. Dead letters still failing stay in the spool.
+func redrive(ctx context.Context, spool *deadletter.Spool, newWatchers map[chain.Chain]func() chain.Watcher,
+	writer kafka.Writer) (int, error) {
+	watchers := map[chain.Chain]chain.Watcher{}
+
+	return spool.Redrive(func(d chain.DeadLetter) error {
+		switch d.Kind {
+		case chain.DeadLetterMessage:
+			return writer.WriteMessages(ctx, d.Message())
+
+		case chain.DeadLetterBlock:
+			newWatcher, ok := newWatchers[d.Chain]
+			if !ok {
+				return fmt.Errorf("unknown chain %q", d.Chain)
+			}
+			if watchers[d.Chain] == nil {
+				watchers[d.Chain] = newWatcher()
+			}
+			// returns once Kafka acknowledged the events of the block
+			return watchers[d.Chain].Reprocess(ctx, d.Block)
+
+		default:
+			return fmt.Errorf("unknown dead letter kind %q", d.Kind)
+		}
+	})
+}
+
+// newTransactionalWriter creates the offsets topic and starts the Kafka producer
+// session of KAFKA_TRANSACTIONAL_ID, only one instance may use it at a time.
+// Re-driving uses its own session, so that it does not fence the running watchers.
+func newTransactionalWriter(redrive bool) (*kafka.TransactionalWriter, error) {
+	if err := kafka.CreateOffsetsTopic(); err != nil {
+		return nil, fmt.Errorf("creating offsets topic: %w", err)
+	}
+
+	transactionalID := os.Getenv(EnvTransactionalID)
+	if transactionalID == "" {
+		transactionalID = defaultTransactionalID
+	}
+	if redrive {
+		transactionalID += redriveTransactionalSuffix
+	}
+	return kafka.NewTransactionalWriter(context.Background(), kafka.NewClient(), transactionalID)
+}
+
+// newCheckpointer returns the checkpoint store selected by CHECKPOINT_BACKEND ("file" or "bolt").
+func newCheckpointer() (chain.Checkpointer, error) {
+	path := os.Getenv(EnvCheckpointPath)
+	if path == "" {
+		path = defaultCheckpointPath
+	}
+
+	switch backend := os.Getenv(EnvCheckpointBackend); backend {
+	case "", "file":
+		return checkpoint.NewFileCheckpointer(path)
+	case "bolt":
+		return checkpoint.NewBoltCheckpointer(path)
+	default:
+		return nil, fmt.Errorf("unknown checkpoint backend %q", backend)
+	}
+}
+
+// newRegistry returns the address registry selected by REGISTRY_BACKEND ("file",
+// "bolt" or "kafka"), nil when the file backend has no REGISTRY_PATH.
+func newRegistry() (chain.Registry, error) {
+	path := os.Getenv(EnvRegistryPath)
+
+	switch backend := os.Getenv(EnvRegistryBackend); backend {
+	case "", "file":
+		if path == "" {
+			return nil, nil
+		}
+		fileRegistry, err := registry.NewFileRegistry(path)
+		if err != nil {
+			return nil, err
+		}
+		return fileRegistry, nil
+	case "bolt":
+		if path == "" {
+			path = defaultRegistryPath
+		}
+		boltRegistry, err := registry.NewBoltRegistry(path)
+		if err != nil {
+			return nil, err
+		}
+		return boltRegistry, nil
+	case "kafka":
+		topic := os.Getenv(EnvWatchlistTopic)
+		if topic == "" {
+			topic = defaultWatchlistTopic
+		}
+		if err := kafka.CreateWatchlistTopic(topic); err != nil {
+			return nil, fmt.Errorf("creating watchlist topic: %w", err)
+		}
+		watchlist, err := kafka.NewWatchlist(context.Background(), kafka.NewClient(), topic)
+		if err != nil {
+			return nil, err
+		}
+		return watchlist, nil
+	default:
+		return nil, fmt.Errorf("unknown registry backend %q", backend)
+	}
 }
@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/registry"
+)
+
+// maxBackfills is the number of backfills running at once, others are rejected
+// until one is done since each one fetches every block of its range.
+const maxBackfills = 2
+
+// backfillLookbacks are the most blocks (or slots) a backfill goes back from
+// the next block of each chain.
+var backfillLookbacks = map[chain.Chain]uint64{
+	chain.EthereumName: chain.EthBackfillLookback,
+	chain.SolanaName:   chain.SolBackfillLookback,
+	chain.BitcoinName:  chain.BtcBackfillLookback,
+}
+
+// Store is a registry that can be edited while the watchers run, the
+// watchers pick up its changes on the next block.
+type Store interface {
+	chain.Registry
+
+	// List returns every registered account.
+	List() []chain.Account
+
+	// Add registers account with its address normalized, registry.ErrConflict
+	// when another user owns its address, chain.ErrInvalidAddress when it is invalid.
+	Add(account chain.Account) error
+
+	// Remove unregisters address on c, registry.ErrNotFound when it is not registered.
+	Remove(c chain.Chain, address string) error
+}
+
+// AddRequest is the body of POST /addresses. BackfillFrom, when set, also
+// processes the history of the address from this block (or slot), within the
+// lookback of its chain.
+type AddRequest struct {
+	Chain        chain.Chain `json:"chain"`
+	Address      string      `json:"address"`
+	User         string      `json:"user"`
+	Labels       []string    `json:"labels,omitempty"`
+	BackfillFrom *uint64     `json:"backfill_from,omitempty"`
+}
+
+// Server is the HTTP admin API managing the watched addresses:
+//
+//	GET    /addresses?user=&chain=        lists the addresses, optionally filtered
+//	POST   /addresses                     adds an address, see AddRequest
+//	DELETE /addresses/{chain}/{address}   removes an address
+//
+// Every request must carry the token as "Authorization: Bearer <token>". The
+// API is meant for operators on a private network, it must not be exposed publicly.
+type Server struct {
+	store    Store
+	watchers map[chain.Chain]chain.Watcher
+	token    string
+
+	// ctx stops the backfills, which outlive the requests starting them.
+	ctx       context.Context
+	backfills sync.WaitGroup
+	// running holds a slot per running backfill.
+	running chan struct{}
+}
+
+// NewServer returns an admin API editing store, for the running watchers, for
+// the requests carrying token. Backfills stop when ctx is done.
+func NewServer(ctx context.Context, store Store, watchers map[chain.Chain]chain.Watcher, token string) *Server {
+	return &Server{
+		store:    store,
+		watchers: watchers,
+		token:    token,
+		ctx:      ctx,
+		running:  make(chan struct{}, maxBackfills),
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /addresses", s.list)
+	mux.HandleFunc("POST /addresses", s.add)
+	mux.HandleFunc("DELETE /addresses/{chain}/{address}", s.remove)
+	return s.authorize(mux)
+}
+
+// authorize rejects the requests without the token of the server.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + s.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wait blocks until the backfills are done.
+func (s *Server) Wait() {
+	s.backfills.Wait()
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	c := chain.Chain(r.URL.Query().Get("chain"))
+
+	accounts := []chain.Account{}
+	for _, account := range s.store.List() {
+		if (user == "" || account.User == user) && (c == "" || account.Chain == c) {
+			accounts = append(accounts, account)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, accounts)
+}
+
+func (s *Server) add(w http.ResponseWriter, r *http.Request) {
+	var req AddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+		return
+	}
+
+	watcher, ok := s.watchers[req.Chain]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown chain %q", req.Chain))
+		return
+	}
+	if req.Address == "" || req.User == "" {
+		writeError(w, http.StatusBadRequest, errors.New("address and user are required"))
+		return
+	}
+
+	address, err := chain.NormalizeAddress(req.Chain, req.Address)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the address is only added once its backfill can run
+	if req.BackfillFrom != nil {
+		if err := checkBackfill(watcher, *req.BackfillFrom); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		select {
+		case s.running <- struct{}{}:
+		default:
+			writeError(w, http.StatusTooManyRequests,
+				fmt.Errorf("%d backfills are running already, retry once one is done", maxBackfills))
+			return
+		}
+	}
+
+	account := chain.Account{
+		Chain:   req.Chain,
+		Address: address,
+		User:    req.User,
+		Labels:  req.Labels,
+	}
+	if err := s.store.Add(account); err != nil {
+		if req.BackfillFrom != nil {
+			<-s.running
+		}
+		writeError(w, statusOf(err), err)
+		return
+	}
+	log.Printf("Watching %s address %s of user %s", account.Chain, account.Address, account.User)
+
+	if req.BackfillFrom != nil {
+		s.backfills.Add(1)
+		go func() {
+			defer s.backfills.Done()
+			defer func() { <-s.running }()
+			if err := watcher.Backfill(s.ctx, account.Address, *req.BackfillFrom); err != nil {
+				log.Printf("error backfilling %s address %s: %v", account.Chain, account.Address, err)
+			}
+		}()
+	}
+
+	writeJSON(w, http.StatusCreated, account)
+}
+
+// checkBackfill rejects a backfill from a block at or after the next block of
+// watcher, or further back than the lookback of its chain.
+func checkBackfill(watcher chain.Watcher, from uint64) error {
+	next := watcher.NextBlock()
+	if from >= next {
+		return fmt.Errorf("backfill_from %d is not before the next block %d", from, next)
+	}
+	if lookback := backfillLookbacks[watcher.Name()]; next-from > lookback {
+		return fmt.Errorf("backfill_from %d is more than %d blocks before the next block %d", from, lookback, next)
+	}
+	return nil
+}
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	c := chain.Chain(r.PathValue("chain"))
+	address := r.PathValue("address")
+
+	if err := s.store.Remove(c, address); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	log.Printf("Stopped watching %s address %s", c, address)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusOf returns the HTTP status of a store error.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, registry.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, chain.ErrInvalidAddress):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing admin response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,250 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/registry"
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	solana1 = "ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49"
+	solana2 = "CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF"
+	solana3 = "bUz1BcqoGdWC32C5EfA5UVoCqTibxBSTtztjwwcQBQR"
+
+	token = "secret"
+)
+
+type backfill struct {
+	address string
+	from    uint64
+}
+
+type mockWatcher struct {
+	next      uint64
+	mu        sync.Mutex
+	backfills []backfill
+	// release, when set, holds the backfills until it is closed
+	release chan struct{}
+}
+
+func (m *mockWatcher) Name() chain.Chain                                 { return chain.SolanaName }
+func (m *mockWatcher) Addresses() []string                               { return nil }
+func (m *mockWatcher) Watch(ctx context.Context)                         {}
+func (m *mockWatcher) Reprocess(ctx context.Context, block uint64) error { return nil }
+func (m *mockWatcher) NextBlock() uint64                                 { return m.next }
+
+func (m *mockWatcher) Backfill(ctx context.Context, address string, from uint64) error {
+	if m.release != nil {
+		<-m.release
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backfills = append(m.backfills, backfill{address, from})
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	store, err := registry.NewBoltRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	defer store.Close()
+
+	watcher := &mockWatcher{next: 2_000_000}
+	server := NewServer(context.Background(), store, map[chain.Chain]chain.Watcher{chain.SolanaName: watcher}, token)
+	handler := server.Handler()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		// auth is the Authorization header, the token by default
+		auth   string
+		status int
+		want   string
+	}{
+		{
+			name:   "list without token",
+			method: http.MethodGet,
+			target: "/addresses",
+			auth:   "none",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "add with another token",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana1 + `", "user": "user-1"}`,
+			auth:   "Bearer other",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "add",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana1 + `", "user": "user-1", "labels": ["deposit"]}`,
+			status: http.StatusCreated,
+			want:   `{"chain":"solana","address":"` + solana1 + `","user":"user-1","labels":["deposit"]}`,
+		},
+		{
+			name:   "add with backfill",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana2 + `", "user": "user-2", "backfill_from": 1000000}`,
+			status: http.StatusCreated,
+			want:   `{"chain":"solana","address":"` + solana2 + `","user":"user-2"}`,
+		},
+		{
+			name:   "add with a backfill beyond the lookback",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana3 + `", "user": "user-3", "backfill_from": 0}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "add with a backfill from the next slot",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana3 + `", "user": "user-3", "backfill_from": 2000000}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "add an address of another user",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana1 + `", "user": "user-2"}`,
+			status: http.StatusConflict,
+		},
+		{
+			name:   "add on an unwatched chain",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "dogecoin", "address": "D1", "user": "user-1"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "add an invalid address",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "So1", "user": "user-1"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "add without user",
+			method: http.MethodPost,
+			target: "/addresses",
+			body:   `{"chain": "solana", "address": "` + solana1 + `"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "list",
+			method: http.MethodGet,
+			target: "/addresses",
+			status: http.StatusOK,
+			want: `[{"chain":"solana","address":"` + solana1 + `","user":"user-1","labels":["deposit"]},` +
+				`{"chain":"solana","address":"` + solana2 + `","user":"user-2"}]`,
+		},
+		{
+			name:   "list by user",
+			method: http.MethodGet,
+			target: "/addresses?user=user-2&chain=solana",
+			status: http.StatusOK,
+			want:   `[{"chain":"solana","address":"` + solana2 + `","user":"user-2"}]`,
+		},
+		{
+			name:   "remove",
+			method: http.MethodDelete,
+			target: "/addresses/solana/" + solana1,
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "remove an unregistered address",
+			method: http.MethodDelete,
+			target: "/addresses/solana/" + solana1,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			switch test.auth {
+			case "":
+				req.Header.Set("Authorization", "Bearer "+token)
+			case "none":
+			default:
+				req.Header.Set("Authorization", test.auth)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, rec.Code, rec.Body)
+			}
+			if test.want == "" {
+				return
+			}
+			if diff := cmp.Diff(test.want, strings.TrimSpace(rec.Body.String())); diff != "" {
+				t.Errorf("response mismatch. (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	server.Wait()
+	if diff := cmp.Diff([]backfill{{solana2, 1_000_000}}, watcher.backfills, cmp.AllowUnexported(backfill{})); diff != "" {
+		t.Errorf("backfills mismatch. (-want +got):\n%s", diff)
+	}
+
+	// watchers see the changes right away
+	if diff := cmp.Diff([]string{solana2}, store.Addresses(chain.SolanaName)); diff != "" {
+		t.Errorf("addresses mismatch. (-want +got):\n%s", diff)
+	}
+}
+
+func TestServerBackfillLimit(t *testing.T) {
+	store, err := registry.NewBoltRegistry(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	defer store.Close()
+
+	watcher := &mockWatcher{next: 2_000_000, release: make(chan struct{})}
+	server := NewServer(context.Background(), store, map[chain.Chain]chain.Watcher{chain.SolanaName: watcher}, token)
+	handler := server.Handler()
+
+	add := func(address string) int {
+		body := `{"chain": "solana", "address": "` + address + `", "user": "user-1", "backfill_from": 1000000}`
+		req := httptest.NewRequest(http.MethodPost, "/addresses", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the backfills beyond the limit are rejected, without adding their address
+	statuses := []int{add(solana1), add(solana2), add(solana3)}
+	if diff := cmp.Diff([]int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests}, statuses); diff != "" {
+		t.Errorf("statuses mismatch. (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{solana1, solana2}, store.Addresses(chain.SolanaName)); diff != "" {
+		t.Errorf("addresses mismatch. (-want +got):\n%s", diff)
+	}
+
+	// a backfill can run again once the others are done
+	close(watcher.release)
+	server.Wait()
+	if status := add(solana3); status != http.StatusCreated {
+		t.Errorf("expected the backfill to be accepted, got status %d", status)
+	}
+	server.Wait()
+}
@@ -0,0 +1,203 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/mr-tron/base58"
+)
+
+// ErrInvalidAddress is returned for an address that is not valid on its chain.
+var ErrInvalidAddress = errors.New("invalid address")
+
+const (
+	solanaPublicKeySize = 32
+
+	bech32Charset  = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	bech32Const    = 1
+	bech32mConst   = 0x2bc830a3
+	bech32MaxSize  = 90
+	bech32Checksum = 6
+)
+
+// bitcoinHRPs are the human readable parts of segwit addresses: mainnet, testnet and regtest.
+var bitcoinHRPs = []string{"bc", "tb", "bcrt"}
+
+// bitcoinVersions are the base58check version bytes of P2PKH and P2SH addresses, on mainnet and testnet.
+var bitcoinVersions = []byte{0x00, 0x05, 0x6f, 0xc4}
+
+// NormalizeAddress validates address on c and returns its canonical form, the
+// one the watchers compare with: lowercase hex for Ethereum, where a mixed-case
+// address must carry a valid EIP-55 checksum, a base58 32-byte public key for
+// Solana, and a lowercase bech32 or bech32m segwit address, or a base58check
+// one, for Bitcoin. Surrounding spaces are ignored.
+func NormalizeAddress(c Chain, address string) (string, error) {
+	address = strings.TrimSpace(address)
+
+	var err error
+	switch c {
+	case EthereumName:
+		address, err = normalizeEthereum(address)
+	case SolanaName:
+		err = validateSolana(address)
+	case BitcoinName:
+		address, err = normalizeBitcoin(address)
+	default:
+		err = fmt.Errorf("unknown chain")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w %q on %s: %v", ErrInvalidAddress, address, c, err)
+	}
+	return address, nil
+}
+
+func normalizeEthereum(address string) (string, error) {
+	if !strings.HasPrefix(address, "0x") || !common.IsHexAddress(address) {
+		return "", errors.New("expected 0x followed by 40 hex digits")
+	}
+
+	lower := strings.ToLower(address)
+	if address != lower && address != "0x"+strings.ToUpper(address[2:]) &&
+		common.HexToAddress(address).Hex() != address {
+		return "", errors.New("bad EIP-55 checksum")
+	}
+	return lower, nil
+}
+
+func validateSolana(address string) error {
+	key, err := base58.Decode(address)
+	if err != nil {
+		return fmt.Errorf("expected base58: %v", err)
+	}
+	if len(key) != solanaPublicKeySize {
+		return fmt.Errorf("expected a %d-byte public key, got %d bytes", solanaPublicKeySize, len(key))
+	}
+	return nil
+}
+
+func normalizeBitcoin(address string) (string, error) {
+	lower := strings.ToLower(address)
+	for _, hrp := range bitcoinHRPs {
+		if strings.HasPrefix(lower, hrp+"1") {
+			if address != lower && address != strings.ToUpper(address) {
+				return "", errors.New("mixed case bech32")
+			}
+			return lower, validateSegwit(hrp, lower)
+		}
+	}
+
+	return address, validateBase58Check(address)
+}
+
+// validateSegwit validates a lowercase segwit address (BIP-173 and BIP-350).
+func validateSegwit(hrp, address string) error {
+	if len(address) > bech32MaxSize {
+		return errors.New("bech32 address too long")
+	}
+
+	data := make([]byte, 0, len(address)-len(hrp)-1)
+	for _, r := range address[len(hrp)+1:] {
+		i := strings.IndexRune(bech32Charset, r)
+		if i < 0 {
+			return fmt.Errorf("invalid bech32 character %q", r)
+		}
+		data = append(data, byte(i))
+	}
+	if len(data) < 1+bech32Checksum {
+		return errors.New("bech32 address too short")
+	}
+
+	version := data[0]
+	checksum := bech32Polymod(append(bech32HRPExpand(hrp), data...))
+	switch {
+	case version > 16:
+		return fmt.Errorf("invalid witness version %d", version)
+	case version == 0 && checksum != bech32Const:
+		return errors.New("bad bech32 checksum")
+	case version > 0 && checksum != bech32mConst:
+		return errors.New("bad bech32m checksum")
+	}
+
+	program, err := convertBits(data[1:len(data)-bech32Checksum], 5, 8)
+	if err != nil {
+		return err
+	}
+	if len(program) < 2 || len(program) > 40 || (version == 0 && len(program) != 20 && len(program) != 32) {
+		return fmt.Errorf("invalid witness program of %d bytes for version %d", len(program), version)
+	}
+	return nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range generator {
+			if (top>>i)&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	expanded := make([]byte, 0, 2*len(hrp)+1)
+	for i := range len(hrp) {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := range len(hrp) {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// convertBits regroups 5-bit groups into bytes, rejecting non-zero padding.
+func convertBits(data []byte, from, to uint) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	maxv := uint32(1)<<to - 1
+
+	out := make([]byte, 0, len(data)*int(from)/int(to))
+	for _, v := range data {
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if bits >= from || (acc<<(to-bits))&maxv != 0 {
+		return nil, errors.New("invalid bech32 padding")
+	}
+	return out, nil
+}
+
+func validateBase58Check(address string) error {
+	decoded, err := base58.Decode(address)
+	if err != nil {
+		return fmt.Errorf("expected bech32 or base58check: %v", err)
+	}
+	if len(decoded) != 25 {
+		return fmt.Errorf("expected 25 bytes of base58check, got %d", len(decoded))
+	}
+
+	payload, checksum := decoded[:21], decoded[21:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], checksum) {
+		return errors.New("bad base58check checksum")
+	}
+	if !bytes.Contains(bitcoinVersions, payload[:1]) {
+		return fmt.Errorf("unknown address version %#x", payload[0])
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Backfill handles the blocks (or slots) of c from the given one up to next,
+// excluded, in order, for an address added to the watchlist after they were
+// scheduled: the watcher schedules next on with the address watched already.
+// Blocks that fail are dead-lettered, re-driving them processes them again for
+// every watched address, and consumers deduplicate the events by ID. The block in flight is
+// finished when ctx is done, and the error reports where the backfill stopped.
+func Backfill(ctx context.Context, c Chain, address string, from, next uint64,
+	handle func(ctx context.Context, block uint64) error, deadLetters DeadLetterQueue) error {
+	if from >= next {
+		return fmt.Errorf("backfilling %s address %s: block %d is not before the next block %d", c, address, from, next)
+	}
+	log.Printf("Backfilling %s address %s from block %d to %d", c, address, from, next-1)
+
+	inflight := context.WithoutCancel(ctx)
+
+	for block := from; block < next; block++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("backfilling %s address %s stopped at block %d: %w", c, address, block, err)
+		}
+
+		if err := handle(inflight, block); err != nil {
+			log.Printf("error backfilling %s address %s: %v", c, address, err)
+			PutDeadLetter(deadLetters, DeadLetter{
+				Kind:     DeadLetterBlock,
+				Chain:    c,
+				Block:    block,
+				Reason:   fmt.Sprintf("backfilling %s: %v", address, err),
+				Attempts: 1,
+			})
+		}
+	}
+
+	log.Printf("Backfilled %s address %s up to block %d", c, address, next-1)
+	return nil
+}
@@ -0,0 +1,573 @@
+package bitcoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/segmentio/kafka-go"
+)
+
+var satoshisPerBitcoin = big.NewRat(100_000_000, 1)
+
+type BitcoinWatcher struct {
+	Client BtcClient
+
+	CurrentBlock uint64
+	// MaxBlock is the last final block, equal to TipBlock when finality is disabled.
+	MaxBlock uint64
+	TipBlock uint64
+
+	KafkaChan chan<- kafka.Message
+
+	Finality chain.Finality
+	Progress *chain.Progress
+	Retrier  *chain.Retrier
+
+	DeadLetters chain.DeadLetterQueue
+	// Transactor, when set, publishes each block with its checkpoint exactly once.
+	Transactor chain.Transactor
+	// Keys selects the Kafka message key of events.
+	Keys chain.KeyStrategy
+	// Registry, when set, maps watched addresses to their user.
+	Registry chain.Registry
+
+	// watchlist, when set, replaces the configured addresses, to backfill a single one.
+	watchlist *chain.AddressIndex
+
+	// prevTxs keeps the transactions fetched to resolve inputs, for the retries.
+	prevTxs txCache
+}
+
+type BtcClient interface {
+	GetBlockCount(ctx context.Context) (uint64, error)
+	GetBlockHash(ctx context.Context, height uint64) (string, error)
+	GetBlock(ctx context.Context, hash string) (*Block, error)
+	GetRawTransactions(ctx context.Context, txIDs []string) ([]*Tx, error)
+}
+
+// NewBitcoinWatcher returns a watcher with the given finality. Only a depth
+// (number of confirmations minus one) is supported, Bitcoin has no finality tag.
+func NewBitcoinWatcher(client BtcClient, kafkaChan chan<- kafka.Message, checkpointer chain.Checkpointer,
+	finality chain.Finality, deadLetters chain.DeadLetterQueue) *BitcoinWatcher {
+	b := &BitcoinWatcher{
+		Client:      client,
+		KafkaChan:   kafkaChan,
+		Finality:    finality,
+		DeadLetters: deadLetters,
+	}
+
+	tipBlock, maxBlock, err := b.GetMaxBlocks(context.Background())
+	for err != nil {
+		log.Printf("error getting bitcoin max block: %v. Retrying...\n", err)
+		time.Sleep(time.Second)
+		tipBlock, maxBlock, err = b.GetMaxBlocks(context.Background())
+	}
+
+	// CurrentBlock is the last scheduled block, the first one processed is the next.
+	currentBlock := chain.ResumeFrom(chain.BitcoinName, checkpointer, maxBlock+1) - 1
+
+	atomic.StoreUint64(&b.TipBlock, tipBlock)
+	atomic.StoreUint64(&b.MaxBlock, maxBlock)
+	atomic.StoreUint64(&b.CurrentBlock, currentBlock)
+	b.Progress = chain.NewProgress(chain.BitcoinName, checkpointer, currentBlock+1)
+	b.Retrier = chain.NewRetrier(chain.BitcoinName, b.handleBlock, b.Progress.Done, deadLetters)
+
+	return b
+}
+
+func (b *BitcoinWatcher) Name() chain.Chain {
+	return chain.BitcoinName
+}
+
+func (b *BitcoinWatcher) Addresses() []string {
+	if b.watchlist != nil {
+		return b.watchlist.Addresses()
+	}
+	return chain.Watchlist(chain.BitcoinName, "BITCOIN_ADDRESSES", b.Registry)
+}
+
+// watched returns the matcher of the watched addresses, to take once per block.
+func (b *BitcoinWatcher) watched() chain.AddressMatcher {
+	if b.watchlist != nil {
+		return b.watchlist
+	}
+	return chain.Watching(chain.BitcoinName, "BITCOIN_ADDRESSES", b.Registry)
+}
+
+// GetMaxBlocks returns the tip and the last final block according to the watcher finality.
+func (b *BitcoinWatcher) GetMaxBlocks(ctx context.Context) (uint64, uint64, error) {
+	tip, err := b.Client.GetBlockCount(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return tip, tip - min(b.Finality.Depth, tip), nil
+}
+
+func (b *BitcoinWatcher) UpdateMaxBlock(ctx context.Context) {
+	ticker := time.NewTicker(chain.BtcBlockTicker)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		tipBlock, maxBlock, err := b.GetMaxBlocks(ctx)
+		if err != nil {
+			log.Printf("error getting bitcoin current block: %v", err)
+			continue
+		}
+
+		current := atomic.LoadUint64(&b.CurrentBlock)
+
+		if maxBlock >= current {
+			atomic.StoreUint64(&b.TipBlock, tipBlock)
+			atomic.StoreUint64(&b.MaxBlock, maxBlock)
+			log.Printf("Bitcoin block lag: %d", maxBlock-current)
+		}
+	}
+}
+
+// startWorkerPool handles blocks until the channel is closed. Blocks in flight
+// are not interrupted by ctx being done, so that they are finished on shutdown.
+func (b *BitcoinWatcher) startWorkerPool(ctx context.Context, blocks <-chan uint64, workers int) *sync.WaitGroup {
+	ctx = context.WithoutCancel(ctx)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range blocks {
+				if err := b.handleBlock(ctx, block); err != nil {
+					b.Retrier.Retry(block, err)
+					continue
+				}
+				b.Progress.Done(block)
+			}
+		}()
+	}
+	return &wg
+}
+
+// GetBlock fetches the block at the given height.
+func (b *BitcoinWatcher) GetBlock(ctx context.Context, height uint64) (*Block, error) {
+	hash, err := b.Client.GetBlockHash(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Client.GetBlock(ctx, hash)
+}
+
+// ResolveInputs fills the Prevout of every non-coinbase input so that the
+// source addresses and values of a transaction are known. Nodes returning the
+// block with verbosity 3 resolve them already. Otherwise outputs spent within
+// the same block are resolved locally, and the others are fetched from the
+// node in batches, once per transaction.
+func (b *BitcoinWatcher) ResolveInputs(ctx context.Context, block *Block) error {
+	txs := make(map[string]*Tx, len(block.Tx))
+	for i := range block.Tx {
+		txs[block.Tx[i].TxID] = &block.Tx[i]
+	}
+
+	missing := []string{}
+	for _, tx := range block.Tx {
+		for _, vin := range tx.Vin {
+			if _, ok := txs[vin.TxID]; ok || vin.Coinbase != "" || vin.Prevout != nil {
+				continue
+			}
+			if prev, ok := b.prevTxs.get(vin.TxID); ok {
+				txs[vin.TxID] = prev
+				continue
+			}
+			// fetched once, whatever the number of inputs spending it
+			txs[vin.TxID] = nil
+			missing = append(missing, vin.TxID)
+		}
+	}
+
+	for batch := range slices.Chunk(missing, chain.BtcRawTransactionsBatch) {
+		prevs, err := b.Client.GetRawTransactions(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("resolving inputs of %d transactions: %w", len(batch), err)
+		}
+		for i, prev := range prevs {
+			txs[batch[i]] = prev
+			b.prevTxs.put(batch[i], prev)
+		}
+	}
+
+	for i := range block.Tx {
+		for j := range block.Tx[i].Vin {
+			vin := &block.Tx[i].Vin[j]
+			if vin.Coinbase != "" || vin.Prevout != nil {
+				continue
+			}
+
+			prev := txs[vin.TxID]
+			if prev == nil || int(vin.Vout) >= len(prev.Vout) {
+				return fmt.Errorf("input %s:%d references a missing output", vin.TxID, vin.Vout)
+			}
+			vin.Prevout = &prev.Vout[vin.Vout]
+		}
+	}
+
+	return nil
+}
+
+// txCache keeps the last chain.BtcPrevTxsCache transactions by ID. The zero value is ready to use.
+type txCache struct {
+	mu  sync.Mutex
+	txs map[string]*Tx
+	// order is the IDs of txs, the oldest first
+	order []string
+}
+
+func (c *txCache) get(txID string) (*Tx, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, ok := c.txs[txID]
+	return tx, ok
+}
+
+func (c *txCache) put(txID string, tx *Tx) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.txs == nil {
+		c.txs = map[string]*Tx{}
+	}
+	if _, ok := c.txs[txID]; ok {
+		return
+	}
+	if len(c.order) >= chain.BtcPrevTxsCache {
+		delete(c.txs, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.txs[txID] = tx
+	c.order = append(c.order, txID)
+}
+
+func (b *BitcoinWatcher) FilterTxs(block *Block) []chain.Transaction {
+	filtered := []chain.Transaction{}
+	watched := b.watched()
+
+	for _, tx := range block.Tx {
+		if isCoinbase(tx) {
+			continue
+		}
+
+		inputs, outputs, err := flows(tx)
+		if err != nil {
+			log.Printf("error decoding bitcoin transaction %s: %v", tx.TxID, err)
+			continue
+		}
+
+		fee := new(big.Int).Sub(inputs.sum(), outputs.sum())
+
+		for _, addr := range parties(inputs, outputs) {
+			if !watched.Contains(addr) {
+				continue
+			}
+			isSource := inputs.contains(addr)
+			owner := chain.Owner(b.Registry, chain.BitcoinName, addr)
+
+			source, destination := inputs[0].Address, addr
+			amount := outputs.amountTo(addr)
+			direction := chain.DirectionIncoming
+			if isSource {
+				// Outputs paying back to an input address are change.
+				source = addr
+				destination = ""
+				amount = new(big.Int)
+				for _, out := range outputs {
+					if inputs.contains(out.Address) {
+						continue
+					}
+					if destination == "" {
+						destination = out.Address
+					}
+					amount.Add(amount, out.Amount)
+				}
+
+				// Every output is change when the user only moves funds between its own addresses.
+				direction = chain.DirectionOutgoing
+				if destination == "" {
+					direction = chain.DirectionSelf
+				}
+			}
+
+			filtered = append(filtered, chain.Transaction{
+				Chain:       chain.BitcoinName,
+				ID:          tx.TxID,
+				User:        owner.User,
+				Labels:      owner.Labels,
+				Address:     addr,
+				Source:      source,
+				Destination: destination,
+				Direction:   direction,
+				Amount:      amount,
+				Fee:         fee,
+				Inputs:      inputs,
+				Outputs:     outputs,
+				NetAmount:   chain.NetAmount(addr, inputs, outputs),
+			})
+		}
+	}
+
+	return filtered
+}
+
+// handleBlock processes a block and returns once its events are published.
+func (b *BitcoinWatcher) handleBlock(ctx context.Context, height uint64) error {
+	return chain.Publish(ctx, chain.BitcoinName, height, b.KafkaChan, b.Transactor, b.Progress,
+		func(send func(kafka.Message)) error {
+			return b.processBlock(ctx, height, b.Finality.Status(), send)
+		})
+}
+
+func (b *BitcoinWatcher) Reprocess(ctx context.Context, height uint64) error {
+	return b.handleBlock(ctx, height)
+}
+
+// NextBlock returns the block after the last scheduled one.
+func (b *BitcoinWatcher) NextBlock() uint64 {
+	return atomic.LoadUint64(&b.CurrentBlock) + 1
+}
+
+// Backfill processes the blocks from the given one up to the last scheduled block again
+// for address only, without checkpointing them. Later blocks see address
+// in the watchlist already.
+func (b *BitcoinWatcher) Backfill(ctx context.Context, address string, from uint64) error {
+	backfill := &BitcoinWatcher{
+		Client:      b.Client,
+		KafkaChan:   b.KafkaChan,
+		Finality:    b.Finality,
+		DeadLetters: b.DeadLetters,
+		Transactor:  b.Transactor,
+		Keys:        b.Keys,
+		Registry:    b.Registry,
+		watchlist:   chain.NewAddressIndex(false, address),
+	}
+
+	return chain.Backfill(ctx, chain.BitcoinName, address, from, b.NextBlock(), backfill.handleBlock, b.DeadLetters)
+}
+
+// handleSeenBlock emits "seen" events for a block that is not final yet.
+func (b *BitcoinWatcher) handleSeenBlock(ctx context.Context, height uint64) {
+	send := func(msg kafka.Message) { b.KafkaChan <- msg }
+	if err := b.processBlock(ctx, height, chain.StatusSeen, send); err != nil {
+		log.Println(err)
+	}
+}
+
+func (b *BitcoinWatcher) processBlock(ctx context.Context, height uint64, status chain.Status,
+	send func(kafka.Message)) error {
+	block, err := b.GetBlock(ctx, height)
+	if err != nil {
+		return fmt.Errorf("getting bitcoin block %d: %w", height, err)
+	}
+
+	if err := b.ResolveInputs(ctx, block); err != nil {
+		return fmt.Errorf("resolving bitcoin inputs for block %d: %w", height, err)
+	}
+
+	filteredTxs := b.FilterTxs(block)
+	for _, filteredTx := range filteredTxs {
+		filteredTx.Status = status
+
+		msg, err := chain.NewMessage(filteredTx, b.Keys)
+		if err != nil {
+			log.Printf("error marshalling bitcoin transaction: %+v\n", filteredTx)
+			chain.PutDeadLetter(b.DeadLetters, chain.DeadLetter{
+				Kind:     chain.DeadLetterBlock,
+				Chain:    chain.BitcoinName,
+				Block:    height,
+				Reason:   fmt.Sprintf("marshalling transaction %s: %v", filteredTx.ID, err),
+				Attempts: 1,
+			})
+			continue
+		}
+		send(msg)
+	}
+
+	return nil
+}
+
+func (b *BitcoinWatcher) scheduleBlocks(ctx context.Context, blocks chan<- uint64) {
+	for {
+		currentBlock := atomic.LoadUint64(&b.CurrentBlock)
+		maxBlock := atomic.LoadUint64(&b.MaxBlock)
+
+		if currentBlock < maxBlock {
+			// getblockcount returns the height of the tip, which is already mined.
+			select {
+			case <-ctx.Done():
+				return
+			case blocks <- currentBlock + 1:
+				atomic.AddUint64(&b.CurrentBlock, 1)
+			}
+		} else if !chain.Sleep(ctx, 50*time.Millisecond) {
+			return
+		}
+	}
+}
+
+// scheduleSeenBlocks handles the blocks above the last final block, up to the tip.
+func (b *BitcoinWatcher) scheduleSeenBlocks(ctx context.Context) {
+	next := atomic.LoadUint64(&b.MaxBlock) + 1
+	for ctx.Err() == nil {
+		next = max(next, atomic.LoadUint64(&b.MaxBlock)+1)
+
+		if next <= atomic.LoadUint64(&b.TipBlock) {
+			b.handleSeenBlock(ctx, next)
+			next++
+		} else {
+			chain.Sleep(ctx, 50*time.Millisecond)
+		}
+	}
+}
+
+func (b *BitcoinWatcher) Watch(ctx context.Context) {
+	go b.UpdateMaxBlock(ctx)
+
+	// the retries and seen events are waited for too, so that nothing is sent
+	// to Kafka once Watch returns
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		b.Retrier.Run(ctx)
+		// pending retries are dropped, the blocks waiting for them cannot be committed
+		b.Progress.Stop()
+	}()
+
+	if b.Finality.Enabled() && b.Finality.EmitSeen {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			b.scheduleSeenBlocks(ctx)
+		}()
+	}
+
+	blocks := make(chan uint64, chain.BtcBlockWorkers)
+
+	wg := b.startWorkerPool(ctx, blocks, chain.BtcBlockWorkers)
+	b.scheduleBlocks(ctx, blocks)
+
+	close(blocks)
+	wg.Wait()
+	background.Wait()
+}
+
+type transfers []chain.Transfer
+
+// parties returns the distinct addresses of the inputs then the outputs.
+func parties(inputs, outputs transfers) []string {
+	addresses := make([]string, 0, len(inputs)+len(outputs))
+	seen := make(map[string]bool, len(inputs)+len(outputs))
+	for _, t := range slices.Concat(inputs, outputs) {
+		if t.Address != "" && !seen[t.Address] {
+			seen[t.Address] = true
+			addresses = append(addresses, t.Address)
+		}
+	}
+	return addresses
+}
+
+func (l transfers) contains(addr string) bool {
+	for _, t := range l {
+		if t.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (l transfers) amountTo(addr string) *big.Int {
+	amount := new(big.Int)
+	for _, t := range l {
+		if t.Address == addr {
+			amount.Add(amount, t.Amount)
+		}
+	}
+	return amount
+}
+
+func (l transfers) sum() *big.Int {
+	total := new(big.Int)
+	for _, t := range l {
+		total.Add(total, t.Amount)
+	}
+	return total
+}
+
+func isCoinbase(tx Tx) bool {
+	return len(tx.Vin) > 0 && tx.Vin[0].Coinbase != ""
+}
+
+// flows returns the resolved inputs and the outputs of a transaction in satoshis.
+func flows(tx Tx) (transfers, transfers, error) {
+	inputs := make(transfers, 0, len(tx.Vin))
+	for _, vin := range tx.Vin {
+		if vin.Prevout == nil {
+			return nil, nil, fmt.Errorf("unresolved input %s:%d", vin.TxID, vin.Vout)
+		}
+		value, err := toSatoshis(vin.Prevout.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		inputs = append(inputs, chain.Transfer{Address: vin.Prevout.ScriptPubKey.address(), Amount: value})
+	}
+	if len(inputs) == 0 {
+		return nil, nil, fmt.Errorf("transaction has no input")
+	}
+
+	outputs := make(transfers, 0, len(tx.Vout))
+	for _, vout := range tx.Vout {
+		value, err := toSatoshis(vout.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		outputs = append(outputs, chain.Transfer{Address: vout.ScriptPubKey.address(), Amount: value})
+	}
+
+	return inputs, outputs, nil
+}
+
+func (s ScriptPubKey) address() string {
+	if s.Address != "" {
+		return s.Address
+	}
+	if len(s.Addresses) == 1 {
+		return s.Addresses[0]
+	}
+	return ""
+}
+
+// toSatoshis converts a BTC decimal value to satoshis without going through a float.
+func toSatoshis(value json.Number) (*big.Int, error) {
+	r, ok := new(big.Rat).SetString(value.String())
+	if !ok {
+		return nil, fmt.Errorf("invalid bitcoin value %q", value)
+	}
+
+	r.Mul(r, satoshisPerBitcoin)
+	if !r.IsInt() {
+		return nil, fmt.Errorf("bitcoin value %q has more than 8 decimals", value)
+	}
+
+	return new(big.Int).Set(r.Num()), nil
+}
@@ -0,0 +1,442 @@
+package bitcoin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/checkpoint"
+	"github.com/google/go-cmp/cmp"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	address1 = "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+
+	// we watch this address
+	address2 = "bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh"
+
+	prevTxID = "9f4b26a0b8a1a5f3c0c5d0e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6"
+	txID     = "3b1a2c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f809"
+
+	inputValue  = "0.50000000"
+	outputValue = "0.30000000"
+	changeValue = "0.19990000"
+
+	input  = 50_000_000
+	amount = 30_000_000
+	change = 19_990_000
+	fee    = 10_000
+)
+
+type mockClient struct {
+	block uint64
+	from  string
+	to    string
+	// batches are the transactions fetched by each GetRawTransactions call
+	batches [][]string
+}
+
+func (m *mockClient) GetBlockCount(ctx context.Context) (uint64, error) {
+	m.block++
+	return m.block, nil
+}
+
+func (m *mockClient) GetBlockHash(ctx context.Context, height uint64) (string, error) {
+	return fmt.Sprintf("%064d", height), nil
+}
+
+func (m *mockClient) GetBlock(ctx context.Context, hash string) (*Block, error) {
+	return &Block{
+		Hash: hash,
+		Tx: []Tx{
+			{
+				TxID: "coinbase",
+				Vin:  []Vin{{Coinbase: "03a0bb0d"}},
+				Vout: []Vout{{Value: "3.125", ScriptPubKey: ScriptPubKey{Address: m.to}}},
+			},
+			{
+				TxID: txID,
+				Vin:  []Vin{{TxID: prevTxID, Vout: 1}},
+				Vout: []Vout{
+					{Value: outputValue, N: 0, ScriptPubKey: ScriptPubKey{Address: m.to}},
+					{Value: changeValue, N: 1, ScriptPubKey: ScriptPubKey{Address: m.from}},
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *mockClient) GetRawTransactions(ctx context.Context, txIDs []string) ([]*Tx, error) {
+	m.batches = append(m.batches, txIDs)
+
+	txs := []*Tx{}
+	for _, txID := range txIDs {
+		if txID != prevTxID {
+			return nil, fmt.Errorf("unknown transaction %s", txID)
+		}
+		txs = append(txs, &Tx{
+			TxID: prevTxID,
+			Vout: []Vout{
+				{Value: "1", N: 0, ScriptPubKey: ScriptPubKey{Address: address1}},
+				{Value: inputValue, N: 1, ScriptPubKey: ScriptPubKey{Address: m.from}},
+			},
+		})
+	}
+	return txs, nil
+}
+
+func newCheckpointer(t *testing.T) chain.Checkpointer {
+	checkpointer, err := checkpoint.NewFileCheckpointer(filepath.Join(t.TempDir(), "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("failed to create checkpointer: %v", err)
+	}
+	return checkpointer
+}
+
+func TestBitcoinWatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       string
+		to         string
+		expectedTx chain.Transaction
+	}{
+		{
+			name: "watched one transaction with user as source",
+			from: address2,
+			to:   address1,
+			expectedTx: chain.Transaction{
+				EventID:     "bitcoin:" + txID + ":" + address2,
+				Chain:       chain.BitcoinName,
+				ID:          txID,
+				User:        address2,
+				Address:     address2,
+				Source:      address2,
+				Destination: address1,
+				Direction:   chain.DirectionOutgoing,
+				Amount:      big.NewInt(amount),
+				Fee:         big.NewInt(fee),
+				Inputs:      []chain.Transfer{{Address: address2, Amount: big.NewInt(input)}},
+				Outputs: []chain.Transfer{
+					{Address: address1, Amount: big.NewInt(amount)},
+					{Address: address2, Amount: big.NewInt(change)},
+				},
+				NetAmount: big.NewInt(change - input),
+				Status:    chain.StatusSeen,
+			},
+		},
+		{
+			name: "watched one transaction with user as destination",
+			from: address1,
+			to:   address2,
+			expectedTx: chain.Transaction{
+				EventID:     "bitcoin:" + txID + ":" + address2,
+				Chain:       chain.BitcoinName,
+				ID:          txID,
+				User:        address2,
+				Address:     address2,
+				Source:      address1,
+				Destination: address2,
+				Direction:   chain.DirectionIncoming,
+				Amount:      big.NewInt(amount),
+				Fee:         big.NewInt(fee),
+				Inputs:      []chain.Transfer{{Address: address1, Amount: big.NewInt(input)}},
+				Outputs: []chain.Transfer{
+					{Address: address2, Amount: big.NewInt(amount)},
+					{Address: address1, Amount: big.NewInt(change)},
+				},
+				NetAmount: big.NewInt(amount),
+				Status:    chain.StatusSeen,
+			},
+		},
+		{
+			name:       "watched zero transaction",
+			from:       address1,
+			to:         address1,
+			expectedTx: chain.Transaction{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &mockClient{
+				from: test.from,
+				to:   test.to,
+			}
+			kafkaChan := make(chan kafka.Message, 1)
+			b := NewBitcoinWatcher(client, kafkaChan, newCheckpointer(t), chain.Finality{}, nil)
+
+			os.Setenv("BITCOIN_ADDRESSES", address2)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go b.Watch(ctx)
+
+			select {
+			case msg := <-kafkaChan:
+				var got chain.Transaction
+				if err := json.Unmarshal(msg.Value, &got); err != nil {
+					t.Errorf("failed to decode Kafka message: %v", err)
+				}
+
+				if diff := cmp.Diff(test.expectedTx, got, cmp.AllowUnexported(big.Int{})); diff != "" {
+					t.Errorf("transaction mismatch. (-want +got):\n%s", diff)
+				}
+
+			case <-time.After(chain.BtcBlockTicker + time.Second):
+				if test.expectedTx.ID != "" {
+					t.Errorf("got nothing, expected a transaction: %+v", test.expectedTx)
+				}
+			}
+		})
+	}
+}
+
+type memoryTransactor struct {
+	msgs        []kafka.Message
+	checkpoints []*uint64
+}
+
+func (m *memoryTransactor) Commit(ctx context.Context, c chain.Chain, msgs []kafka.Message, checkpoint *uint64) error {
+	m.msgs = append(m.msgs, msgs...)
+	m.checkpoints = append(m.checkpoints, checkpoint)
+	return nil
+}
+
+func TestBitcoinBackfill(t *testing.T) {
+	os.Setenv("BITCOIN_ADDRESSES", address1)
+	transactor := &memoryTransactor{}
+	b := &BitcoinWatcher{
+		Client:       &mockClient{from: address1, to: address2},
+		CurrentBlock: 12,
+		Transactor:   transactor,
+	}
+
+	if err := b.Backfill(context.Background(), address2, 11); err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+
+	// only the backfilled address gets events, without checkpoint
+	users := []string{}
+	for _, msg := range transactor.msgs {
+		var got chain.Transaction
+		if err := json.Unmarshal(msg.Value, &got); err != nil {
+			t.Fatalf("failed to decode Kafka message: %v", err)
+		}
+		users = append(users, got.User)
+	}
+	if diff := cmp.Diff([]string{address2, address2}, users); diff != "" {
+		t.Errorf("users mismatch. (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]*uint64{nil, nil}, transactor.checkpoints); diff != "" {
+		t.Errorf("checkpoints mismatch. (-want +got):\n%s", diff)
+	}
+
+	if err := b.Backfill(context.Background(), address2, 13); err == nil {
+		t.Errorf("expected an error backfilling from a block after the current one")
+	}
+}
+
+func TestToSatoshis(t *testing.T) {
+	tests := []struct {
+		value    json.Number
+		expected int64
+		wantErr  bool
+	}{
+		{value: "0.00000001", expected: 1},
+		{value: "21", expected: 2_100_000_000},
+		{value: "1e-05", expected: 1_000},
+		{value: "0.000000001", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := toSatoshis(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("toSatoshis(%s): expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("toSatoshis(%s): %v", test.value, err)
+			continue
+		}
+		if got.Int64() != test.expected {
+			t.Errorf("toSatoshis(%s) = %s, expected %d", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestBitcoinDirections(t *testing.T) {
+	const address3 = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+
+	// address2 spends an output of its own and pays address1, keeping the change
+	tx := func(outputs ...Vout) *Block {
+		return &Block{Tx: []Tx{{
+			TxID: txID,
+			Vin:  []Vin{{TxID: prevTxID, Vout: 1, Prevout: &Vout{Value: inputValue, ScriptPubKey: ScriptPubKey{Address: address2}}}},
+			Vout: outputs,
+		}}}
+	}
+
+	tests := []struct {
+		name      string
+		addresses string
+		block     *Block
+		expected  map[string]chain.Direction
+	}{
+		{
+			name:      "both parties watched",
+			addresses: address1 + "," + address2,
+			block: tx(
+				Vout{Value: outputValue, ScriptPubKey: ScriptPubKey{Address: address1}},
+				Vout{Value: changeValue, ScriptPubKey: ScriptPubKey{Address: address2}},
+			),
+			expected: map[string]chain.Direction{address1: chain.DirectionIncoming, address2: chain.DirectionOutgoing},
+		},
+		{
+			name:      "consolidation to the same address",
+			addresses: address2,
+			block:     tx(Vout{Value: changeValue, ScriptPubKey: ScriptPubKey{Address: address2}}),
+			expected:  map[string]chain.Direction{address2: chain.DirectionSelf},
+		},
+		{
+			name:      "payment to an unwatched address",
+			addresses: address2 + "," + address3,
+			block:     tx(Vout{Value: outputValue, ScriptPubKey: ScriptPubKey{Address: address1}}),
+			expected:  map[string]chain.Direction{address2: chain.DirectionOutgoing},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("BITCOIN_ADDRESSES", test.addresses)
+			b := &BitcoinWatcher{}
+
+			got := map[string]chain.Direction{}
+			for _, event := range b.FilterTxs(test.block) {
+				got[event.User] = event.Direction
+			}
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("directions mismatch. (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBitcoinResolveInputs(t *testing.T) {
+	newBlock := func() *Block {
+		return &Block{Tx: []Tx{
+			{
+				TxID: "spends-twice",
+				Vin:  []Vin{{TxID: prevTxID, Vout: 0}, {TxID: prevTxID, Vout: 1}},
+				Vout: []Vout{{Value: "1.5", ScriptPubKey: ScriptPubKey{Address: address2}}},
+			},
+			{
+				TxID: "spends-in-block",
+				Vin:  []Vin{{TxID: "spends-twice", Vout: 0}},
+				Vout: []Vout{{Value: "1.5", ScriptPubKey: ScriptPubKey{Address: address1}}},
+			},
+			{
+				TxID: "resolved-by-node",
+				Vin:  []Vin{{TxID: "unknown", Vout: 0, Prevout: &Vout{Value: "2", ScriptPubKey: ScriptPubKey{Address: address1}}}},
+				Vout: []Vout{{Value: "2", ScriptPubKey: ScriptPubKey{Address: address2}}},
+			},
+		}}
+	}
+
+	client := &mockClient{from: address1}
+	b := &BitcoinWatcher{Client: client}
+
+	block := newBlock()
+	if err := b.ResolveInputs(context.Background(), block); err != nil {
+		t.Fatalf("failed to resolve inputs: %v", err)
+	}
+	// a retry resolves the inputs from the transactions fetched already
+	if err := b.ResolveInputs(context.Background(), newBlock()); err != nil {
+		t.Fatalf("failed to resolve inputs again: %v", err)
+	}
+
+	if diff := cmp.Diff([][]string{{prevTxID}}, client.batches); diff != "" {
+		t.Errorf("fetched transactions mismatch. (-want +got):\n%s", diff)
+	}
+
+	addresses := []string{}
+	for _, tx := range block.Tx {
+		for _, vin := range tx.Vin {
+			addresses = append(addresses, vin.Prevout.ScriptPubKey.Address)
+		}
+	}
+	if diff := cmp.Diff([]string{address1, address1, address2, address1}, addresses); diff != "" {
+		t.Errorf("input addresses mismatch. (-want +got):\n%s", diff)
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		// getrawtransaction is batched, the responses are returned in reverse order
+		var batch []rpcRequest
+		if json.Unmarshal(body, &batch) == nil {
+			res := []string{}
+			for _, req := range slices.Backward(batch) {
+				res = append(res, fmt.Sprintf(`{"id":%d,"result":{"txid":%q},"error":null}`, req.ID, req.Params[0]))
+			}
+			fmt.Fprintf(w, "[%s]", strings.Join(res, ","))
+			return
+		}
+
+		// the node does not support getblock verbosity 3
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil || req.Method != "getblock" {
+			t.Errorf("unexpected request %s", body)
+			return
+		}
+		if req.Params[1] == float64(3) {
+			fmt.Fprintf(w, `{"id":%d,"result":null,"error":{"code":-8,"message":"Verbosity was 3"}}`, req.ID)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%d,"result":{"hash":%q},"error":null}`, req.ID, req.Params[0])
+	}))
+	defer server.Close()
+
+	c := &Client{HTTPClient: server.Client(), URL: server.URL}
+
+	for range 2 {
+		block, err := c.GetBlock(context.Background(), "hash")
+		if err != nil {
+			t.Fatalf("failed to get block: %v", err)
+		}
+		if block.Hash != "hash" {
+			t.Errorf("expected block hash, got %q", block.Hash)
+		}
+	}
+	if !c.noPrevouts.Load() {
+		t.Errorf("expected the node to be known not to return prevouts")
+	}
+
+	txs, err := c.GetRawTransactions(context.Background(), []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("failed to get transactions: %v", err)
+	}
+	got := []string{}
+	for _, tx := range txs {
+		got = append(got, tx.TxID)
+	}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, got); diff != "" {
+		t.Errorf("transactions mismatch. (-want +got):\n%s", diff)
+	}
+}
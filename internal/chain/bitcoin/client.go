@@ -0,0 +1,233 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+)
+
+const rpcURL = "https://svc.blockdaemon.com/bitcoin/mainnet/native"
+
+// invalidParameterCode is returned by nodes older than v23 for getblock verbosity 3.
+const invalidParameterCode = -8
+
+// Client is a minimal Bitcoin Core JSON-RPC client.
+type Client struct {
+	HTTPClient *http.Client
+	URL        string
+
+	id uint64
+	// noPrevouts is set once the node rejected getblock verbosity 3.
+	noPrevouts atomic.Bool
+}
+
+func CreateClient() *Client {
+	return &Client{
+		HTTPClient: chain.NewCustomClient(),
+		URL:        rpcURL,
+	}
+}
+
+type Block struct {
+	Hash              string `json:"hash"`
+	Height            uint64 `json:"height"`
+	PreviousBlockHash string `json:"previousblockhash"`
+	Tx                []Tx   `json:"tx"`
+}
+
+type Tx struct {
+	TxID string `json:"txid"`
+	Vin  []Vin  `json:"vin"`
+	Vout []Vout `json:"vout"`
+}
+
+type Vin struct {
+	Coinbase string `json:"coinbase,omitempty"`
+	TxID     string `json:"txid,omitempty"`
+	Vout     uint32 `json:"vout"`
+
+	// Prevout is the output spent by this input. It is only returned by nodes
+	// queried with verbosity 3, otherwise it is resolved by the watcher.
+	Prevout *Vout `json:"prevout,omitempty"`
+}
+
+type Vout struct {
+	// Value is denominated in BTC, kept as a json.Number to avoid float rounding.
+	Value        json.Number  `json:"value"`
+	N            uint32       `json:"n"`
+	ScriptPubKey ScriptPubKey `json:"scriptPubKey"`
+}
+
+type ScriptPubKey struct {
+	Address string `json:"address,omitempty"`
+
+	// Addresses is only set by nodes older than v22.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      uint64 `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("bitcoin rpc error %d: %s", e.Code, e.Message)
+}
+
+type rpcResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func (c *Client) call(ctx context.Context, method string, result any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+
+	var res rpcResponse
+	if err := c.post(ctx, method, c.request(method, params), &res); err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+
+	return json.Unmarshal(res.Result, result)
+}
+
+// batch sends one request of method per params in a single JSON-RPC batch and
+// decodes the results in the order of params.
+func (c *Client) batch(ctx context.Context, method string, results []any, params [][]any) error {
+	reqs := make([]rpcRequest, len(params))
+	index := make(map[uint64]int, len(params))
+	for i, p := range params {
+		reqs[i] = c.request(method, p)
+		index[reqs[i].ID] = i
+	}
+
+	var res []rpcResponse
+	if err := c.post(ctx, method, reqs, &res); err != nil {
+		return err
+	}
+	if len(res) != len(params) {
+		return fmt.Errorf("expected %d %s responses, got %d", len(params), method, len(res))
+	}
+
+	// responses may come in any order
+	for _, r := range res {
+		i, ok := index[r.ID]
+		if !ok {
+			return fmt.Errorf("unexpected %s response id %d", method, r.ID)
+		}
+		if r.Error != nil {
+			return r.Error
+		}
+		if err := json.Unmarshal(r.Result, results[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) request(method string, params []any) rpcRequest {
+	return rpcRequest{
+		JSONRPC: "1.0",
+		ID:      atomic.AddUint64(&c.id, 1),
+		Method:  method,
+		Params:  params,
+	}
+}
+
+// post sends the requests of method and decodes the response into res.
+func (c *Client) post(ctx context.Context, method string, requests any, res any) error {
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("decoding %s response (status %d): %w", method, resp.StatusCode, err)
+	}
+	return nil
+}
+
+func (c *Client) GetBlockCount(ctx context.Context) (uint64, error) {
+	var count uint64
+	err := c.call(ctx, "getblockcount", &count)
+	return count, err
+}
+
+func (c *Client) GetBlockHash(ctx context.Context, height uint64) (string, error) {
+	var hash string
+	err := c.call(ctx, "getblockhash", &hash, height)
+	return hash, err
+}
+
+// GetBlock returns the block with every transaction decoded, and the outputs
+// spent by their inputs (verbosity 3). Nodes older than v23 return the
+// transactions only (verbosity 2), their inputs are resolved by the watcher.
+func (c *Client) GetBlock(ctx context.Context, hash string) (*Block, error) {
+	var block Block
+	if !c.noPrevouts.Load() {
+		err := c.call(ctx, "getblock", &block, hash, 3)
+		if err == nil {
+			return &block, nil
+		}
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != invalidParameterCode {
+			return nil, err
+		}
+		log.Printf("bitcoin node does not return prevouts, resolving inputs with getrawtransaction: %v", err)
+		c.noPrevouts.Store(true)
+	}
+
+	if err := c.call(ctx, "getblock", &block, hash, 2); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// GetRawTransactions returns the decoded transactions of txIDs, fetched in one
+// batch. The node must run with txindex enabled.
+func (c *Client) GetRawTransactions(ctx context.Context, txIDs []string) ([]*Tx, error) {
+	txs := make([]*Tx, len(txIDs))
+	results := make([]any, len(txIDs))
+	params := make([][]any, len(txIDs))
+	for i, txID := range txIDs {
+		txs[i] = &Tx{}
+		results[i] = txs[i]
+		params[i] = []any{txID, true}
+	}
+
+	if err := c.batch(ctx, "getrawtransaction", results, params); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
@@ -1,36 +1,155 @@
 package chain
 
-import "math/big"
+import (
+	"context"
+	"math/big"
+	"time"
+)
 
 type Chain string
 
 const (
 	SolanaName   Chain = "solana"
 	EthereumName Chain = "ethereum"
+	BitcoinName  Chain = "bitcoin"
+)
+
+type Status string
+
+const (
+	// StatusSeen marks a transaction included in a block that may not be final yet.
+	StatusSeen Status = "seen"
+
+	// StatusConfirmed marks a transaction included in a block that reached the configured finality.
+	StatusConfirmed Status = "confirmed"
+
+	// StatusReverted marks a previously emitted transaction whose block was
+	// orphaned by a reorg and which is not part of the canonical chain.
+	StatusReverted Status = "reverted"
+)
+
+type Direction string
+
+const (
+	// DirectionIncoming marks a transfer received by the watched user.
+	DirectionIncoming Direction = "incoming"
+
+	// DirectionOutgoing marks a transfer sent by the watched user.
+	DirectionOutgoing Direction = "outgoing"
+
+	// DirectionSelf marks a transfer from the watched user to itself.
+	DirectionSelf Direction = "self"
 )
 
+// Parties returns the distinct addresses of a transfer from source to destination.
+func Parties(source, destination string) []string {
+	if source == destination {
+		return []string{source}
+	}
+	return []string{source, destination}
+}
+
+// TransferDirection returns the direction of a transfer from source to destination for the watched addr.
+func TransferDirection(addr, source, destination string) Direction {
+	switch {
+	case source == addr && destination == addr:
+		return DirectionSelf
+	case source == addr:
+		return DirectionOutgoing
+	default:
+		return DirectionIncoming
+	}
+}
+
 type Transaction struct {
+	// Deterministic idempotency ID of the event, see EventID.
+	EventID string `json:"event_id"`
+
 	// The blockchain network.
 	Chain Chain `json:"chain"`
 
 	// Unique identifier of the transaction.
 	ID string `json:"id"`
 
-	// User ID watched.
+	// User ID watched, the owner of Address in the registry.
 	User string `json:"user"`
 
+	// Labels of Address in the registry.
+	Labels []string `json:"labels,omitempty"`
+
+	// Watched address the event concerns.
+	Address string `json:"address"`
+
 	// Sender address of the transaction.
 	Source string `json:"source"`
 
 	// Receiver address of the transaction.
 	Destination string `json:"destination"`
 
+	// Direction of the transfer for the watched user. A transfer between two
+	// watched users produces one event for each of them.
+	Direction Direction `json:"direction"`
+
 	// Amount transferred in the transaction, denominated in the smallest unit of the blockchain
-	// (e.g., lamports for Solana, wei for Ethereum).
+	// (e.g., lamports for Solana, wei for Ethereum, satoshis for Bitcoin).
 	Amount *big.Int `json:"amount"`
 
 	// Transaction fee.
 	Fee *big.Int `json:"fee"`
+
+	// Status of the event: "seen" at tip, "confirmed" once final, or "reverted"
+	// when it compensates a previously emitted one.
+	Status Status `json:"status"`
+
+	// Token contract address (mint on Solana) for token transfers, empty for native transfers.
+	// Amounts are then denominated in the token smallest unit.
+	Token string `json:"token,omitempty"`
+
+	// Number of decimals of the token, when known.
+	Decimals *uint8 `json:"decimals,omitempty"`
+
+	// Index of the top-level instruction that performed the transfer, including
+	// transfers made through cross-program invocation (Solana only).
+	InstructionIndex *int `json:"instruction_index,omitempty"`
+
+	// Position of the transfer among the inner instructions of its top-level
+	// instruction, for transfers made through cross-program invocation (Solana only).
+	InnerIndex *int `json:"inner_index,omitempty"`
+
+	// Index in the block of the log that performed a token transfer (Ethereum only).
+	LogIndex *uint `json:"log_index,omitempty"`
+
+	// Every input of the transaction. Account based chains have a single input.
+	Inputs []Transfer `json:"inputs"`
+
+	// Every output of the transaction, including change. Account based chains have a single output.
+	Outputs []Transfer `json:"outputs"`
+
+	// Balance change of the watched user: received outputs minus spent inputs.
+	// It is negative when the user sends funds.
+	NetAmount *big.Int `json:"net_amount"`
+}
+
+// Transfer is a single input or output of a transaction.
+type Transfer struct {
+	Address string   `json:"address"`
+	Amount  *big.Int `json:"amount"`
+}
+
+// NetAmount returns the sum of the outputs to user minus the sum of the inputs from user.
+func NetAmount(user string, inputs, outputs []Transfer) *big.Int {
+	net := new(big.Int)
+	for _, in := range inputs {
+		if in.Address == user {
+			net.Sub(net, in.Amount)
+		}
+	}
+	for _, out := range outputs {
+		if out.Address == user {
+			net.Add(net, out.Amount)
+		}
+	}
+	return net
 }
 
 type Watcher interface {
@@ -39,6 +158,32 @@ type Watcher interface {
 	// Addresses returns the list of adress to watch.
 	Addresses() []string
 
-	// Watch monitors new blocks for transactions.
-	Watch()
+	// Watch monitors new blocks for transactions until ctx is done, then
+	// finishes the blocks in flight and returns once its retries and seen
+	// events are done too, sending nothing to Kafka afterwards.
+	Watch(ctx context.Context)
+
+	// Reprocess processes a single block (or slot) again, used to re-drive dead letters.
+	Reprocess(ctx context.Context, block uint64) error
+
+	// NextBlock returns the next block (or slot) to schedule, those before it
+	// were scheduled already.
+	NextBlock() uint64
+
+	// Backfill processes the blocks (or slots) from the given one up to
+	// NextBlock, excluded, again for address only, once it was added to the watchlist.
+	Backfill(ctx context.Context, address string, from uint64) error
+}
+
+// Sleep pauses for d and reports whether ctx is still running.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
@@ -0,0 +1,688 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestNetAmount(t *testing.T) {
+	const (
+		user  = "user"
+		other = "other"
+	)
+
+	tests := []struct {
+		name     string
+		inputs   []Transfer
+		outputs  []Transfer
+		expected int64
+	}{
+		{
+			name:     "incoming",
+			inputs:   []Transfer{{Address: other, Amount: big.NewInt(100)}},
+			outputs:  []Transfer{{Address: user, Amount: big.NewInt(100)}},
+			expected: 100,
+		},
+		{
+			name:     "outgoing",
+			inputs:   []Transfer{{Address: user, Amount: big.NewInt(100)}},
+			outputs:  []Transfer{{Address: other, Amount: big.NewInt(100)}},
+			expected: -100,
+		},
+		{
+			name: "outgoing with change",
+			inputs: []Transfer{
+				{Address: user, Amount: big.NewInt(60)},
+				{Address: user, Amount: big.NewInt(50)},
+			},
+			outputs: []Transfer{
+				{Address: other, Amount: big.NewInt(70)},
+				{Address: user, Amount: big.NewInt(30)},
+			},
+			expected: -80,
+		},
+		{
+			name:     "self transfer",
+			inputs:   []Transfer{{Address: user, Amount: big.NewInt(100)}},
+			outputs:  []Transfer{{Address: user, Amount: big.NewInt(100)}},
+			expected: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := NetAmount(user, test.inputs, test.outputs)
+			if got.Int64() != test.expected {
+				t.Errorf("got %s, expected %d", got, test.expected)
+			}
+		})
+	}
+}
+
+type memoryCheckpointer struct {
+	saved []uint64
+}
+
+func (m *memoryCheckpointer) Load(c Chain) (uint64, bool, error) {
+	if len(m.saved) == 0 {
+		return 0, false, nil
+	}
+	return m.saved[len(m.saved)-1], true, nil
+}
+
+func (m *memoryCheckpointer) Save(c Chain, block uint64) error {
+	m.saved = append(m.saved, block)
+	return nil
+}
+
+func TestProgress(t *testing.T) {
+	checkpointer := &memoryCheckpointer{}
+	p := NewProgress(EthereumName, checkpointer, 10)
+
+	// blocks complete out of order, only contiguous ranges are checkpointed
+	for _, block := range []uint64{11, 12, 10, 14, 9, 13} {
+		p.Done(block)
+	}
+
+	expected := []uint64{12, 14}
+	if len(checkpointer.saved) != len(expected) {
+		t.Fatalf("expected checkpoints %v, got %v", expected, checkpointer.saved)
+	}
+	for i := range expected {
+		if checkpointer.saved[i] != expected[i] {
+			t.Errorf("expected checkpoints %v, got %v", expected, checkpointer.saved)
+		}
+	}
+}
+
+// memoryTransactor records the checkpoint of each commit, nil ones as 0.
+type memoryTransactor struct {
+	mu          sync.Mutex
+	checkpoints []uint64
+}
+
+func (m *memoryTransactor) Commit(ctx context.Context, c Chain, msgs []kafka.Message, checkpoint *uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if checkpoint == nil {
+		m.checkpoints = append(m.checkpoints, 0)
+		return nil
+	}
+	m.checkpoints = append(m.checkpoints, *checkpoint)
+	return nil
+}
+
+func TestProgressCommit(t *testing.T) {
+	transactor := &memoryTransactor{}
+	p := NewProgress(SolanaName, &memoryCheckpointer{}, 10)
+	publish := func(block uint64) error {
+		return Publish(context.Background(), SolanaName, block, nil, transactor, p,
+			func(send func(kafka.Message)) error {
+				send(kafka.Message{Value: []byte("tx")})
+				return nil
+			})
+	}
+
+	// blocks are handled out of order but committed in order
+	var wg sync.WaitGroup
+	for _, block := range []uint64{12, 11, 10} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := publish(block); err != nil {
+				t.Errorf("publishing block %d: %v", block, err)
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	// a block already done is committed without checkpoint
+	if err := publish(5); err != nil {
+		t.Fatalf("publishing block 5: %v", err)
+	}
+
+	expected := []uint64{10, 11, 12, 0}
+	if !slices.Equal(expected, transactor.checkpoints) {
+		t.Errorf("expected checkpoints %v, got %v", expected, transactor.checkpoints)
+	}
+
+	// a block waiting for one that will not be done returns once stopped
+	errs := make(chan error)
+	go func() { errs <- publish(14) }()
+	p.Stop()
+	if err := <-errs; !errors.Is(err, ErrProgressStopped) {
+		t.Errorf("expected ErrProgressStopped, got %v", err)
+	}
+}
+
+func TestProgressCommitBehindRetry(t *testing.T) {
+	transactor := &memoryTransactor{}
+	p := NewProgress(SolanaName, &memoryCheckpointer{}, 10)
+
+	var mu sync.Mutex
+	attempts := map[uint64]int{}
+	// block 10 succeeds on its second attempt, block 12 never does
+	handle := func(ctx context.Context, block uint64) error {
+		mu.Lock()
+		attempts[block]++
+		failed := (block == 10 && attempts[block] == 1) || block == 12
+		mu.Unlock()
+		if failed {
+			return errors.New("rpc unavailable")
+		}
+		return Publish(ctx, SolanaName, block, nil, transactor, p, func(send func(kafka.Message)) error { return nil })
+	}
+
+	r := NewRetrier(SolanaName, handle, p.Done, nil)
+	r.MaxAttempts = 3
+	r.BaseDelay, r.MaxDelay = 50*time.Millisecond, 50*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	// the worker of the next block waits for the retry of the previous one
+	for _, block := range []uint64{10, 12} {
+		r.Retry(block, handle(ctx, block))
+
+		start := time.Now()
+		if err := handle(ctx, block+1); err != nil {
+			t.Fatalf("publishing block %d: %v", block+1, err)
+		}
+		if waited := time.Since(start); waited < r.BaseDelay/2 {
+			t.Errorf("expected block %d to wait for the retries of block %d, waited %s", block+1, block, waited)
+		}
+	}
+
+	// the dead-lettered block is checkpointed without events
+	expected := []uint64{10, 11, 13}
+	if !slices.Equal(expected, transactor.checkpoints) {
+		t.Errorf("expected checkpoints %v, got %v", expected, transactor.checkpoints)
+	}
+}
+
+func TestProgressCommitUnlocked(t *testing.T) {
+	checkpointer := &memoryCheckpointer{}
+	p := NewProgress(EthereumName, checkpointer, 10)
+
+	// the blocks after the committed one are done while it is committed
+	done := make(chan struct{})
+	err := p.Commit(context.Background(), 10, func(checkpoint *uint64) error {
+		go func() {
+			defer close(done)
+			p.Done(11)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("block 11 was not marked as done during the commit")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint64{11}
+	if !slices.Equal(expected, checkpointer.saved) {
+		t.Errorf("expected checkpoints %v, got %v", expected, checkpointer.saved)
+	}
+}
+
+func TestResumeFrom(t *testing.T) {
+	if got := ResumeFrom(EthereumName, &memoryCheckpointer{}, 100); got != 100 {
+		t.Errorf("without checkpoint expected tip 100, got %d", got)
+	}
+	if got := ResumeFrom(EthereumName, &memoryCheckpointer{saved: []uint64{90}}, 100); got != 91 {
+		t.Errorf("expected block after checkpoint 91, got %d", got)
+	}
+	if got := ResumeFrom(EthereumName, &memoryCheckpointer{saved: []uint64{120}}, 100); got != 100 {
+		t.Errorf("with checkpoint ahead of tip expected tip 100, got %d", got)
+	}
+}
+
+func TestLoadFinality(t *testing.T) {
+	tests := []struct {
+		name     string
+		finality string
+		emitSeen string
+		expected Finality
+		wantErr  bool
+	}{
+		{name: "unset", expected: Finality{}},
+		{name: "depth", finality: "12", emitSeen: "true", expected: Finality{Depth: 12, EmitSeen: true}},
+		{name: "tag", finality: "finalized", expected: Finality{Tag: "finalized"}},
+		{name: "unknown tag", finality: "latest", wantErr: true},
+		{name: "invalid emit seen", emitSeen: "maybe", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ETHEREUM_FINALITY", test.finality)
+			t.Setenv("ETHEREUM_EMIT_SEEN", test.emitSeen)
+
+			got, err := LoadFinality(EthereumName, "safe", "finalized")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, got)
+			}
+		})
+	}
+}
+
+type memoryDeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (m *memoryDeadLetters) Put(d DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, d)
+	return nil
+}
+
+func (m *memoryDeadLetters) get() []DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DeadLetter(nil), m.letters...)
+}
+
+func TestRetrier(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		expectedDone bool
+		expectedFail bool
+	}{
+		{name: "succeeds after retries", failures: 2, expectedDone: true},
+		{name: "gives up after max attempts", failures: 10, expectedDone: true, expectedFail: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := 0
+			handle := func(ctx context.Context, block uint64) error {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				if calls <= test.failures {
+					return errors.New("rpc unavailable")
+				}
+				return nil
+			}
+			done := make(chan uint64, 1)
+
+			deadLetters := &memoryDeadLetters{}
+			r := NewRetrier(EthereumName, handle, func(block uint64) { done <- block }, deadLetters)
+			r.MaxAttempts = 4
+			r.BaseDelay = time.Millisecond
+			r.MaxDelay = 5 * time.Millisecond
+			go r.Run(context.Background())
+
+			// The first attempt is made by the watcher worker.
+			r.Retry(42, handle(context.Background(), 42))
+
+			select {
+			case block := <-done:
+				if block != 42 {
+					t.Fatalf("expected block 42 to be done, got %d", block)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("block was never marked as done")
+			}
+
+			letters := deadLetters.get()
+			if failed := len(letters) == 1; failed != test.expectedFail {
+				t.Fatalf("expected failed to be %v, got dead letters %+v", test.expectedFail, letters)
+			}
+			if !test.expectedFail {
+				return
+			}
+			if letters[0].Kind != DeadLetterBlock || letters[0].Block != 42 ||
+				letters[0].Attempts != r.MaxAttempts || letters[0].Reason != "rpc unavailable" {
+				t.Errorf("unexpected dead letters: %+v", letters)
+			}
+		})
+	}
+}
+
+func TestRetrierShutdown(t *testing.T) {
+	handle := func(ctx context.Context, block uint64) error { return errors.New("rpc unavailable") }
+	r := NewRetrier(EthereumName, handle, func(block uint64) { t.Errorf("block %d must not be done", block) }, nil)
+	// the queue is full, a due retry blocks until Run reads it
+	r.queue = make(chan retryItem)
+
+	r.BaseDelay, r.MaxDelay = time.Millisecond, time.Millisecond
+	r.Retry(1, errors.New("rpc unavailable"))
+	r.BaseDelay, r.MaxDelay = time.Hour, time.Hour
+	r.Retry(2, errors.New("rpc unavailable"))
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(stopped)
+	}()
+
+	// Run returns once no retry is left pending
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return with retries pending")
+	}
+
+	// retries scheduled afterwards are dropped
+	r.Retry(3, errors.New("rpc unavailable"))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.timers) != 0 {
+		t.Errorf("expected no retry left scheduled, got %d", len(r.timers))
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	var blocks []uint64
+	handle := func(ctx context.Context, block uint64) error {
+		blocks = append(blocks, block)
+		return nil
+	}
+
+	// the next block is left to the watcher, which schedules it with the address watched
+	if err := Backfill(context.Background(), SolanaName, "address", 10, 13, handle, nil); err != nil {
+		t.Fatalf("failed to backfill: %v", err)
+	}
+	if expected := []uint64{10, 11, 12}; !slices.Equal(expected, blocks) {
+		t.Errorf("expected blocks %v, got %v", expected, blocks)
+	}
+
+	if err := Backfill(context.Background(), SolanaName, "address", 13, 13, handle, nil); err == nil {
+		t.Errorf("expected an error backfilling from the next block")
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	errBroker := errors.New("broker unavailable")
+
+	tests := []struct {
+		name     string
+		acks     []error
+		expected error
+	}{
+		{name: "no message"},
+		{name: "all acknowledged", acks: []error{nil, nil}},
+		{name: "one failed", acks: []error{nil, errBroker, nil}, expected: errBroker},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &Delivery{}
+
+			msgs := []kafka.Message{}
+			for range test.acks {
+				msgs = append(msgs, d.Track(kafka.Message{}))
+			}
+			for i, msg := range msgs {
+				go msg.WriterData.(Ack)(test.acks[i])
+			}
+
+			if err := d.Wait(context.Background()); !errors.Is(err, test.expected) {
+				t.Errorf("expected error %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	// a nil delivery leaves messages untracked
+	var d *Delivery
+	if msg := d.Track(kafka.Message{}); msg.WriterData != nil {
+		t.Errorf("expected an untracked message, got %+v", msg.WriterData)
+	}
+
+	pending := &Delivery{}
+	pending.Track(kafka.Message{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pending.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected to stop waiting on context, got %v", err)
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	index := 2
+	logIndex := uint(7)
+	tests := []struct {
+		name        string
+		tx          Transaction
+		keys        KeyStrategy
+		expectedID  string
+		expectedKey string
+	}{
+		{
+			name:        "native transfer keyed by user",
+			tx:          Transaction{Chain: BitcoinName, ID: "tx", User: "bc1q", Address: "bc1q", Status: StatusSeen},
+			keys:        KeyByUser,
+			expectedID:  "bitcoin:tx:bc1q",
+			expectedKey: "bitcoin:bc1q",
+		},
+		{
+			name:        "instruction keyed by address",
+			tx:          Transaction{Chain: SolanaName, ID: "sig", User: "alice", Address: "So1", InstructionIndex: &index, Status: StatusConfirmed},
+			keys:        KeyByAddress,
+			expectedID:  "solana:sig:2:alice:So1",
+			expectedKey: "solana:So1",
+		},
+		{
+			name:        "log keyed by chain",
+			tx:          Transaction{Chain: EthereumName, ID: "0xhash", User: "alice", Address: "0xabc", LogIndex: &logIndex, Status: StatusReverted},
+			keys:        KeyByChain,
+			expectedID:  "ethereum:0xhash:7:alice:0xabc",
+			expectedKey: "ethereum",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := NewMessage(test.tx, test.keys)
+			if err != nil {
+				t.Fatalf("NewMessage: %v", err)
+			}
+
+			if string(msg.Key) != test.expectedKey {
+				t.Errorf("expected key %q, got %q", test.expectedKey, msg.Key)
+			}
+			expectedHeaders := []kafka.Header{
+				{Key: HeaderEventID, Value: []byte(test.expectedID)},
+				{Key: HeaderStatus, Value: []byte(test.tx.Status)},
+			}
+			sameHeader := func(a, b kafka.Header) bool { return a.Key == b.Key && string(a.Value) == string(b.Value) }
+			if !slices.EqualFunc(expectedHeaders, msg.Headers, sameHeader) {
+				t.Errorf("expected headers %v, got %v", expectedHeaders, msg.Headers)
+			}
+
+			var got Transaction
+			if err := json.Unmarshal(msg.Value, &got); err != nil {
+				t.Fatalf("failed to decode payload: %v", err)
+			}
+			if got.EventID != test.expectedID {
+				t.Errorf("expected payload event ID %q, got %q", test.expectedID, got.EventID)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		chain    Chain
+		address  string
+		expected string
+	}{
+		{"ethereum checksummed", EthereumName, "0xdAC17F958D2ee523a2206206994597C13D831ec7", "0xdac17f958d2ee523a2206206994597c13d831ec7"},
+		{"ethereum uppercase", EthereumName, "0xDAC17F958D2EE523A2206206994597C13D831EC7", "0xdac17f958d2ee523a2206206994597c13d831ec7"},
+		{"ethereum bad checksum", EthereumName, "0xdac17F958D2ee523a2206206994597C13D831ec7", ""},
+		{"ethereum without prefix", EthereumName, "dac17f958d2ee523a2206206994597c13d831ec7", ""},
+		{"ethereum too short", EthereumName, "0xabc", ""},
+		{"solana public key", SolanaName, " CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF ", "CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF"},
+		{"solana too short", SolanaName, "So1", ""},
+		{"solana not base58", SolanaName, "0OIlgjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF", ""},
+		{"bitcoin segwit v0", BitcoinName, "BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"},
+		{"bitcoin taproot", BitcoinName, "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr", "bc1p5cyxnuxmeuwuvkwfem96lqzszd02n6xdcjrs20cac6yqjjwudpxqkedrcr"},
+		{"bitcoin v0 with bech32m checksum", BitcoinName, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", ""},
+		{"bitcoin mixed case", BitcoinName, "bc1qW508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", ""},
+		{"bitcoin p2pkh", BitcoinName, "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"},
+		{"bitcoin p2sh", BitcoinName, "34xp4vRoCGJym3xR7yCVPFHoCNxv4Twseo", "34xp4vRoCGJym3xR7yCVPFHoCNxv4Twseo"},
+		{"bitcoin bad base58check", BitcoinName, "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb", ""},
+		{"unknown chain", Chain("dogecoin"), "D1", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeAddress(test.chain, test.address)
+			if test.expected == "" {
+				if !errors.Is(err, ErrInvalidAddress) {
+					t.Errorf("expected an invalid address error, got %q, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeAddress: %v", err)
+			}
+			if got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestAddressIndex(t *testing.T) {
+	for _, bloom := range []bool{false, true} {
+		t.Run(fmt.Sprintf("bloom %t", bloom), func(t *testing.T) {
+			x := NewAddressIndex(bloom, "b", "a")
+			x.Add("c", "a")
+			x.Remove("b", "d")
+
+			if got := x.Addresses(); !slices.Equal(got, []string{"a", "c"}) {
+				t.Errorf("expected addresses [a c], got %v", got)
+			}
+			for address, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": false} {
+				if got := x.Contains(address); got != expected {
+					t.Errorf("Contains(%q) = %t, expected %t", address, got, expected)
+				}
+			}
+
+			// grow past the capacity of the filter, then remove enough to rebuild it
+			addresses := benchmarkAddresses(3 * bloomMinCapacity)
+			x.Add(addresses...)
+			x.Remove(addresses[:2*bloomMinCapacity]...)
+			if got := x.Len(); got != 2+bloomMinCapacity {
+				t.Errorf("expected %d addresses, got %d", 2+bloomMinCapacity, got)
+			}
+			for i, address := range addresses {
+				if got, expected := x.Contains(address), i >= 2*bloomMinCapacity; got != expected {
+					t.Fatalf("Contains(%q) = %t, expected %t", address, got, expected)
+				}
+			}
+		})
+	}
+
+	var x *AddressIndex
+	if x.Contains("a") || x.Len() != 0 || x.Addresses() != nil {
+		t.Errorf("expected a nil index to be empty")
+	}
+}
+
+func TestAddressIndexConcurrency(t *testing.T) {
+	x := NewAddressIndex(true)
+	addresses := benchmarkAddresses(4 * bloomMinCapacity)
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			x.Add(addresses[i*bloomMinCapacity : (i+1)*bloomMinCapacity]...)
+		}()
+		go func() {
+			defer wg.Done()
+			for _, address := range addresses {
+				x.Contains(address)
+			}
+			x.Addresses()
+		}()
+	}
+	wg.Wait()
+
+	for _, address := range addresses {
+		if !x.Contains(address) {
+			t.Fatalf("expected %q to be indexed", address)
+		}
+	}
+}
+
+// benchmarkAddresses returns n distinct addresses shaped like Ethereum ones.
+func benchmarkAddresses(n int) []string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("0x%040x", i)
+	}
+	return addresses
+}
+
+// BenchmarkAddressIndex matches addresses against 100k watched ones, most of
+// them not watched as in a block, compared with a scan of the list.
+func BenchmarkAddressIndex(b *testing.B) {
+	const watched = 100_000
+	addresses := benchmarkAddresses(2 * watched)
+	list := addresses[:watched]
+
+	run := func(b *testing.B, matcher AddressMatcher, address string) {
+		for range b.N {
+			matcher.Contains(address)
+		}
+	}
+
+	for _, bloom := range []bool{false, true} {
+		x := NewAddressIndex(bloom, list...)
+
+		b.Run(fmt.Sprintf("bloom=%t/hit", bloom), func(b *testing.B) {
+			run(b, x, list[watched/2])
+		})
+		b.Run(fmt.Sprintf("bloom=%t/miss", bloom), func(b *testing.B) {
+			run(b, x, addresses[watched+watched/2])
+		})
+		b.Run(fmt.Sprintf("bloom=%t/miss-parallel", bloom), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					x.Contains(addresses[watched+i%watched])
+				}
+			})
+		})
+	}
+
+	b.Run("scan/miss", func(b *testing.B) {
+		address := addresses[watched+watched/2]
+		for range b.N {
+			_ = slices.Contains(list, address)
+		}
+	})
+}
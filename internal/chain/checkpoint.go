@@ -0,0 +1,163 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// ErrProgressStopped is returned by Progress.Commit when the blocks before the
+// committed one will not be done, see Progress.Stop.
+var ErrProgressStopped = errors.New("progress stopped before the previous blocks were done")
+
+// Checkpointer persists, for each chain, the highest block (or slot) below
+// which every block has been processed.
+type Checkpointer interface {
+	// Load returns the last checkpointed block, ok is false when none was saved.
+	Load(c Chain) (block uint64, ok bool, err error)
+
+	// Save records block as the last contiguously processed block.
+	Save(c Chain, block uint64) error
+}
+
+// ResumeFrom returns the first block to process: the one after the checkpoint
+// if any, otherwise the tip.
+func ResumeFrom(c Chain, checkpointer Checkpointer, tip uint64) uint64 {
+	last, ok, err := checkpointer.Load(c)
+	if err != nil {
+		log.Printf("error loading %s checkpoint, starting at tip: %v", c, err)
+		return tip
+	}
+	if !ok || last >= tip {
+		return tip
+	}
+
+	log.Printf("Resuming %s from block %d, %d blocks behind tip", c, last+1, tip-last-1)
+	return last + 1
+}
+
+// Progress tracks blocks completed out of order by workers and checkpoints
+// the highest contiguously processed one.
+type Progress struct {
+	chain        Chain
+	checkpointer Checkpointer
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	next uint64
+	done map[uint64]struct{}
+	// committing is set while next is being committed, without the lock.
+	committing bool
+	stopped    bool
+}
+
+// NewProgress returns a Progress expecting next to be the first block completed.
+func NewProgress(c Chain, checkpointer Checkpointer, next uint64) *Progress {
+	p := &Progress{
+		chain:        c,
+		checkpointer: checkpointer,
+		next:         next,
+		done:         map[uint64]struct{}{},
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Done marks block as processed and saves a checkpoint if the contiguous
+// range of processed blocks advanced.
+func (p *Progress) Done(block uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if block < p.next {
+		return
+	}
+	p.done[block] = struct{}{}
+
+	p.advance()
+}
+
+// Commit calls commit for block once every block before it is done, and marks
+// it as done if commit succeeded. Blocks are committed in order, so that the
+// checkpoint passed to commit is block itself. Blocks already done, such as
+// re-driven ones, are committed right away without a checkpoint. commit is
+// called without the lock, so that the other blocks are marked as done meanwhile.
+//
+// A block after one being retried waits, holding its worker, until the retry
+// succeeds or the block is dead-lettered: at most the retry delays plus the
+// attempts. Committing it first would checkpoint past the retried block.
+func (p *Progress) Commit(ctx context.Context, block uint64, commit func(checkpoint *uint64) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+	defer stop()
+
+	for p.next < block || (p.next == block && p.committing) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p.stopped {
+			return ErrProgressStopped
+		}
+		p.cond.Wait()
+	}
+
+	if block < p.next {
+		p.mu.Unlock()
+		defer p.mu.Lock()
+		return commit(nil)
+	}
+
+	p.committing = true
+	p.mu.Unlock()
+	err := commit(&block)
+	p.mu.Lock()
+	p.committing = false
+
+	if err != nil {
+		// a commit of the same block waiting for this one may succeed
+		p.cond.Broadcast()
+		return err
+	}
+	if block >= p.next {
+		p.done[block] = struct{}{}
+	}
+	p.advance()
+	return nil
+}
+
+// Stop makes the commits waiting for previous blocks return, once the retries
+// of the blocks they wait for were dropped.
+func (p *Progress) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopped = true
+	p.cond.Broadcast()
+}
+
+// advance moves next past the contiguous done blocks and saves a checkpoint if it moved.
+func (p *Progress) advance() {
+	advanced := false
+	for {
+		if _, ok := p.done[p.next]; !ok {
+			break
+		}
+		delete(p.done, p.next)
+		p.next++
+		advanced = true
+	}
+
+	if advanced {
+		p.cond.Broadcast()
+		if err := p.checkpointer.Save(p.chain, p.next-1); err != nil {
+			log.Printf("error saving %s checkpoint %d: %v", p.chain, p.next-1, err)
+		}
+	}
+}
@@ -10,9 +10,61 @@ const (
 	EthBlockWorkers = 2
 	// Delay between block updates for ethereum
 	EthBlockTicker = 2 * time.Second
+	// Number of recent blocks kept to detect reorgs for ethereum
+	EthReorgWindow = 64
+	// Delay before subscribing again to new heads for ethereum, blocks are polled meanwhile
+	EthResubscribeDelay = 5 * time.Second
+	// Silence after which a new heads subscription is considered dropped for ethereum
+	EthHeadTimeout = time.Minute
+	// Max blocks a backfill goes back from the next block for ethereum, about a week
+	EthBackfillLookback = 50_000
 
 	// Max concurrent slots processed for solana
 	SolSlotWorkers = 1
 	// Delay between slot updates for solana
 	UpdateSlotTicker = 500 * time.Millisecond
+	// Delay before subscribing again to slots for solana, slots are polled meanwhile
+	SolResubscribeDelay = 5 * time.Second
+	// Silence after which a slot subscription is considered dropped for solana
+	SolSlotTimeout = 10 * time.Second
+	// Delay between slot polls for solana while subscribed, to resync the notified slots
+	SolSlotResync = 30 * time.Second
+	// Slots a notified, processed, slot is assumed to take to be confirmed for solana
+	SolConfirmationLag = 2
+	// Watched addresses up to which solana fetches their transactions rather than full blocks
+	SolAddressStrategyMax = 50
+	// Max slots whose signatures are fetched at once for solana
+	SolSignaturesRange = 1000
+	// Max concurrent transactions fetched by signature for a solana slot
+	SolTransactionWorkers = 4
+	// Delay after which the token accounts of a watched wallet are fetched again for solana
+	SolTokenAccountsRefresh = 5 * time.Minute
+	// Max slots a backfill goes back from the next slot for solana, about a week
+	SolBackfillLookback = 1_500_000
+
+	// Max concurrent blocks processed for bitcoin
+	BtcBlockWorkers = 1
+	// Delay between block updates for bitcoin
+	BtcBlockTicker = 5 * time.Second
+	// Max transactions fetched in one JSON-RPC batch to resolve inputs for bitcoin
+	BtcRawTransactionsBatch = 100
+	// Max transactions kept to resolve inputs again on retries for bitcoin
+	BtcPrevTxsCache = 20_000
+	// Max blocks a backfill goes back from the next block for bitcoin, about a week
+	BtcBackfillLookback = 1_000
+
+	// Attempts, including the first one, before a block is dead-lettered
+	RetryMaxAttempts = 6
+	// Delay before the first retry, doubled on each attempt
+	RetryBaseDelay = 500 * time.Millisecond
+	// Upper bound of the delay between two retries
+	RetryMaxDelay = 30 * time.Second
+	// Max blocks waiting to be retried
+	RetryQueueSize = 1000
+
+	// Whether address indexes are fronted by a Bloom filter, rejecting most
+	// unwatched addresses without locking
+	AddressBloomFilter = true
+	// Bits of the Bloom filter per indexed address, 10 gives about 1% of false positives
+	BloomBitsPerAddress = 10
 )
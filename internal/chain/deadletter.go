@@ -0,0 +1,55 @@
+package chain
+
+import (
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type DeadLetterKind string
+
+const (
+	// DeadLetterBlock is a block (or slot) that could not be processed, re-driven by processing it again.
+	DeadLetterBlock DeadLetterKind = "block"
+	// DeadLetterMessage is a Kafka message that could not be delivered, re-driven by writing it again.
+	DeadLetterMessage DeadLetterKind = "message"
+)
+
+// DeadLetter is a block or a message that could not be processed or delivered.
+type DeadLetter struct {
+	Kind     DeadLetterKind `json:"kind"`
+	Chain    Chain          `json:"chain,omitempty"`
+	Block    uint64         `json:"block,omitempty"`
+	Key      []byte         `json:"key,omitempty"`
+	Value    []byte         `json:"value,omitempty"`
+	Headers  []kafka.Header `json:"headers,omitempty"`
+	Reason   string         `json:"reason"`
+	Attempts int            `json:"attempts"`
+	At       time.Time      `json:"at"`
+}
+
+// Message returns the Kafka message of a DeadLetterMessage, with the headers
+// consumers deduplicate it on.
+func (d DeadLetter) Message() kafka.Message {
+	return kafka.Message{Key: d.Key, Value: d.Value, Headers: d.Headers}
+}
+
+// DeadLetterQueue stores dead letters until they are re-driven.
+type DeadLetterQueue interface {
+	Put(d DeadLetter) error
+}
+
+// PutDeadLetter stores d in queue, timestamping it. Errors are logged since
+// there is nowhere left to send d; a nil queue only logs.
+func PutDeadLetter(queue DeadLetterQueue, d DeadLetter) {
+	d.At = time.Now().UTC()
+
+	if queue == nil {
+		log.Printf("dropping %s dead letter (%s block %d): %s", d.Kind, d.Chain, d.Block, d.Reason)
+		return
+	}
+	if err := queue.Put(d); err != nil {
+		log.Printf("error storing %s dead letter (%s block %d, reason: %s): %v", d.Kind, d.Chain, d.Block, d.Reason, err)
+	}
+}
@@ -0,0 +1,110 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Transactor publishes the events of a block together with the checkpoint of
+// its chain in a single transaction, for exactly-once delivery.
+type Transactor interface {
+	// Commit publishes msgs and, unless it is nil, checkpoint atomically.
+	Commit(ctx context.Context, c Chain, msgs []kafka.Message, checkpoint *uint64) error
+}
+
+// Publish runs process, which sends the events of block, and returns once they
+// are published: committed together with the block checkpoint when transactor
+// is set, or acknowledged by Kafka otherwise. A nil progress commits the
+// events without checkpoint, for blocks out of the main pipeline.
+func Publish(ctx context.Context, c Chain, block uint64, kafkaChan chan<- kafka.Message, transactor Transactor,
+	progress *Progress, process func(send func(kafka.Message)) error) error {
+	if transactor != nil {
+		var msgs []kafka.Message
+		if err := process(func(msg kafka.Message) { msgs = append(msgs, msg) }); err != nil {
+			return err
+		}
+
+		var err error
+		if progress == nil {
+			err = transactor.Commit(ctx, c, msgs, nil)
+		} else {
+			err = progress.Commit(ctx, block, func(checkpoint *uint64) error {
+				return transactor.Commit(ctx, c, msgs, checkpoint)
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("committing %s block %d: %w", c, block, err)
+		}
+		return nil
+	}
+
+	delivery := &Delivery{}
+	if err := process(func(msg kafka.Message) { kafkaChan <- delivery.Track(msg) }); err != nil {
+		return err
+	}
+	if err := delivery.Wait(ctx); err != nil {
+		return fmt.Errorf("delivering %s block %d: %w", c, block, err)
+	}
+	return nil
+}
+
+// Ack is carried by a Kafka message in WriterData. The Kafka writer calls it
+// once the message is acknowledged by the broker, or with the write error.
+type Ack func(err error)
+
+// Delivery tracks the messages published for a block, so that the block is
+// only done once the broker acknowledged all of them.
+type Delivery struct {
+	wg sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// Track returns msg carrying an Ack for d. A nil Delivery does not track
+// messages, their delivery failures are dead-lettered by the Kafka writer.
+func (d *Delivery) Track(msg kafka.Message) kafka.Message {
+	if d == nil {
+		return msg
+	}
+
+	d.wg.Add(1)
+	var once sync.Once
+	msg.WriterData = Ack(func(err error) {
+		once.Do(func() {
+			if err != nil {
+				d.mu.Lock()
+				if d.err == nil {
+					d.err = err
+				}
+				d.mu.Unlock()
+			}
+			d.wg.Done()
+		})
+	})
+
+	return msg
+}
+
+// Wait blocks until every tracked message is acknowledged, and returns the
+// first delivery error.
+func (d *Delivery) Wait(ctx context.Context) error {
+	acked := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(acked)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-acked:
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
@@ -2,8 +2,13 @@ package ethereum
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"sync"
 
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
 )
@@ -16,3 +21,35 @@ func CreateClient() *ethclient.Client {
 
 	return ethclient.NewClient(rpcClient)
 }
+
+// HeadsClient subscribes to new heads over the WebSocket endpoint of a node.
+// The connection is dialed on the first subscription, and again on the next
+// one when dialing failed, so that the node may be down on start-up.
+type HeadsClient struct {
+	url string
+
+	mu     sync.Mutex
+	client *ethclient.Client
+}
+
+// CreateHeadsClient returns a client of the WebSocket endpoint at url, e.g. wss://host/path.
+func CreateHeadsClient(url string) *HeadsClient {
+	return &HeadsClient{url: url}
+}
+
+// SubscribeNewHead subscribes to the headers of the blocks added to the chain.
+// A dropped connection is dialed again by the next subscription.
+func (h *HeadsClient) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.client == nil {
+		rpcClient, err := rpc.DialOptions(ctx, h.url,
+			rpc.WithHeader("Authorization", "Bearer "+os.Getenv("BLOCKDAEMON_API_KEY")))
+		if err != nil {
+			return nil, fmt.Errorf("dialing %s: %w", h.url, err)
+		}
+		h.client = ethclient.NewClient(rpcClient)
+	}
+	return h.client.SubscribeNewHead(ctx, ch)
+}
@@ -2,49 +2,92 @@ package ethereum
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
 	"math/big"
-	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/segmentio/kafka-go"
 )
 
+// transferEventSig is the topic of the ERC-20 Transfer(address,address,uint256) event.
+var transferEventSig = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+
 type EthereumWatcher struct {
 	Client EthClient
 
 	CurrentBlock uint64
-	MaxBlock     uint64
+	// MaxBlock is the last final block, equal to TipBlock when finality is disabled.
+	MaxBlock uint64
+	TipBlock uint64
 
 	KafkaChan chan<- kafka.Message
+
+	Finality chain.Finality
+	Progress *chain.Progress
+	Retrier  *chain.Retrier
+
+	DeadLetters chain.DeadLetterQueue
+	// Transactor, when set, publishes each block with its checkpoint exactly once.
+	Transactor chain.Transactor
+	// Keys selects the Kafka message key of events.
+	Keys chain.KeyStrategy
+	// Registry, when set, maps watched addresses to their user.
+	Registry chain.Registry
+	// Heads, when set, pushes the new blocks, which are otherwise polled.
+	Heads HeadSubscriber
+
+	// watchlist, when set, replaces the configured addresses, to backfill a single one.
+	watchlist *chain.AddressIndex
+
+	window reorgWindow
 }
 
 type EthClient interface {
 	BlockNumber(ctx context.Context) (uint64, error)
 	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// HeadSubscriber subscribes to the headers of new blocks, such as eth_subscribe("newHeads").
+type HeadSubscriber interface {
+	SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error)
 }
 
-func NewEthereumWatcher(client EthClient, kafkaChan chan<- kafka.Message) *EthereumWatcher {
+func NewEthereumWatcher(client EthClient, kafkaChan chan<- kafka.Message, checkpointer chain.Checkpointer,
+	finality chain.Finality, deadLetters chain.DeadLetterQueue) *EthereumWatcher {
 	e := &EthereumWatcher{
-		Client:    client,
-		KafkaChan: kafkaChan,
+		Client:      client,
+		KafkaChan:   kafkaChan,
+		Finality:    finality,
+		DeadLetters: deadLetters,
 	}
 
-	maxBlock, err := e.Client.BlockNumber(context.Background())
+	tipBlock, maxBlock, err := e.GetMaxBlocks(context.Background())
 	for err != nil {
 		log.Printf("error getting ethereum max block: %v. Retrying...\n", err)
 		time.Sleep(time.Second)
-		maxBlock, err = e.Client.BlockNumber(context.Background())
+		tipBlock, maxBlock, err = e.GetMaxBlocks(context.Background())
 	}
 
+	currentBlock := chain.ResumeFrom(chain.EthereumName, checkpointer, maxBlock)
+
+	atomic.StoreUint64(&e.TipBlock, tipBlock)
 	atomic.StoreUint64(&e.MaxBlock, maxBlock)
-	atomic.StoreUint64(&e.CurrentBlock, maxBlock)
+	atomic.StoreUint64(&e.CurrentBlock, currentBlock)
+	e.Progress = chain.NewProgress(chain.EthereumName, checkpointer, currentBlock)
+	e.Retrier = chain.NewRetrier(chain.EthereumName, e.handleBlock, e.Progress.Done, deadLetters)
 
 	return e
 }
@@ -54,45 +97,168 @@ func (e *EthereumWatcher) Name() chain.Chain {
 }
 
 func (s *EthereumWatcher) Addresses() []string {
-	env := os.Getenv("ETHEREUM_ADDRESSES")
-	if env == "" {
-		return []string{}
+	if s.watchlist != nil {
+		return s.watchlist.Addresses()
+	}
+	return chain.Watchlist(chain.EthereumName, "ETHEREUM_ADDRESSES", s.Registry)
+}
+
+// watched returns the matcher of the watched addresses, to take once per block.
+func (s *EthereumWatcher) watched() chain.AddressMatcher {
+	if s.watchlist != nil {
+		return s.watchlist
+	}
+	return chain.Watching(chain.EthereumName, "ETHEREUM_ADDRESSES", s.Registry)
+}
+
+// GetMaxBlocks returns the tip and the last final block according to the watcher finality.
+func (e *EthereumWatcher) GetMaxBlocks(ctx context.Context) (uint64, uint64, error) {
+	tip, err := e.Client.BlockNumber(ctx)
+	if err != nil {
+		return 0, 0, err
 	}
-	return strings.Split(env, ",")
+	return e.maxBlocks(ctx, tip)
 }
 
-func (e *EthereumWatcher) UpdateMaxBlock() {
+// maxBlocks returns tip and the last final block once tip is mined.
+func (e *EthereumWatcher) maxBlocks(ctx context.Context, tip uint64) (uint64, uint64, error) {
+	switch e.Finality.Tag {
+	case "":
+		return tip, tip - min(e.Finality.Depth, tip), nil
+	case "safe", "finalized":
+		tag := rpc.SafeBlockNumber
+		if e.Finality.Tag == "finalized" {
+			tag = rpc.FinalizedBlockNumber
+		}
+		header, err := e.Client.HeaderByNumber(ctx, big.NewInt(tag.Int64()))
+		if err != nil {
+			return 0, 0, err
+		}
+		final := header.Number.Uint64()
+		return tip, final - min(e.Finality.Depth, final), nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported ethereum finality tag %q", e.Finality.Tag)
+	}
+}
+
+// UpdateMaxBlock follows the tip of the chain. With Heads, blocks are scheduled
+// as soon as their header is pushed, and polled every EthBlockTicker while the
+// subscription is down until it is subscribed again.
+func (e *EthereumWatcher) UpdateMaxBlock(ctx context.Context) {
 	ticker := time.NewTicker(chain.EthBlockTicker)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		maxBlock, err := e.Client.BlockNumber(context.Background())
-		if err != nil {
-			log.Printf("error getting ethereum current block: %v", err)
-			continue
+	var (
+		sub      ethereum.Subscription
+		subErr   <-chan error
+		lastHead time.Time
+		// resubscribe fires when a subscription is due, never without Heads
+		resubscribe <-chan time.Time
+	)
+	heads := make(chan *types.Header)
+	if e.Heads != nil {
+		resubscribe = time.After(0)
+	}
+
+	drop := func(reason string) {
+		log.Printf("ethereum new heads subscription dropped: %s. Polling until resubscribing in %s",
+			reason, chain.EthResubscribeDelay)
+		sub.Unsubscribe()
+		sub, subErr = nil, nil
+		resubscribe = time.After(chain.EthResubscribeDelay)
+	}
+	defer func() {
+		if sub != nil {
+			sub.Unsubscribe()
 		}
+	}()
 
-		current := atomic.LoadUint64(&e.CurrentBlock)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-resubscribe:
+			s, err := e.Heads.SubscribeNewHead(ctx, heads)
+			if err != nil {
+				log.Printf("error subscribing to ethereum new heads: %v. Polling until resubscribing in %s",
+					err, chain.EthResubscribeDelay)
+				resubscribe = time.After(chain.EthResubscribeDelay)
+				continue
+			}
+			sub, subErr, lastHead, resubscribe = s, s.Err(), time.Now(), nil
+			log.Printf("Subscribed to ethereum new heads")
+			// catch up with the blocks mined since the last poll
+			e.pollMaxBlock(ctx)
 
-		if maxBlock >= current {
-			atomic.StoreUint64(&e.MaxBlock, maxBlock)
-			log.Printf("Ethereum block lag: %d", maxBlock-current)
+		case err := <-subErr:
+			drop(fmt.Sprint(err))
+
+		case head := <-heads:
+			lastHead = time.Now()
+			tipBlock, maxBlock, err := e.maxBlocks(ctx, head.Number.Uint64())
+			if err != nil {
+				log.Printf("error getting ethereum final block: %v", err)
+				continue
+			}
+			e.setMaxBlock(tipBlock, maxBlock)
+
+		case <-ticker.C:
+			if sub == nil {
+				e.pollMaxBlock(ctx)
+			} else if time.Since(lastHead) > chain.EthHeadTimeout {
+				drop(fmt.Sprintf("no new head for %s", chain.EthHeadTimeout))
+				e.pollMaxBlock(ctx)
+			}
 		}
 	}
 }
 
-func (e *EthereumWatcher) startWorkerPool(blocks <-chan uint64, workers int) {
+func (e *EthereumWatcher) pollMaxBlock(ctx context.Context) {
+	tipBlock, maxBlock, err := e.GetMaxBlocks(ctx)
+	if err != nil {
+		log.Printf("error getting ethereum current block: %v", err)
+		return
+	}
+	e.setMaxBlock(tipBlock, maxBlock)
+}
+
+// setMaxBlock moves the tip and the last final block, unless the final block is behind the scheduled ones.
+func (e *EthereumWatcher) setMaxBlock(tipBlock, maxBlock uint64) {
+	current := atomic.LoadUint64(&e.CurrentBlock)
+
+	if maxBlock >= current {
+		atomic.StoreUint64(&e.TipBlock, tipBlock)
+		atomic.StoreUint64(&e.MaxBlock, maxBlock)
+		log.Printf("Ethereum block lag: %d", maxBlock-current)
+	}
+}
+
+// startWorkerPool handles blocks until the channel is closed. Blocks in flight
+// are not interrupted by ctx being done, so that they are finished on shutdown.
+func (e *EthereumWatcher) startWorkerPool(ctx context.Context, blocks <-chan uint64, workers int) *sync.WaitGroup {
+	ctx = context.WithoutCancel(ctx)
+
+	var wg sync.WaitGroup
 	for range workers {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for block := range blocks {
-				e.handleBlock(block)
+				if err := e.handleBlock(ctx, block); err != nil {
+					e.Retrier.Retry(block, err)
+					continue
+				}
+				e.Progress.Done(block)
 			}
 		}()
 	}
+	return &wg
 }
 
 func (e *EthereumWatcher) FilterTxs(data *types.Block) []chain.Transaction {
 	filtered := []chain.Transaction{}
+	watched := e.watched()
 
 	for _, tx := range data.Transactions() {
 		if tx.To() == nil || len(tx.Data()) != 0 {
@@ -114,18 +280,96 @@ func (e *EthereumWatcher) FilterTxs(data *types.Block) []chain.Transaction {
 		source := strings.ToLower(wallet.Hex())
 		destination := strings.ToLower(tx.To().Hex())
 
-		for _, addr := range e.Addresses() {
-			if source == addr || destination == addr {
+		inputs := []chain.Transfer{{Address: source, Amount: amount}}
+		outputs := []chain.Transfer{{Address: destination, Amount: amount}}
+
+		for _, addr := range chain.Parties(source, destination) {
+			if watched.Contains(addr) {
+				owner := chain.Owner(e.Registry, chain.EthereumName, addr)
 				filtered = append(filtered, chain.Transaction{
 					Chain:       chain.EthereumName,
 					ID:          tx.Hash().Hex(),
-					User:        addr,
+					User:        owner.User,
+					Labels:      owner.Labels,
+					Address:     addr,
+					Source:      source,
+					Destination: destination,
+					Direction:   chain.TransferDirection(addr, source, destination),
+					Amount:      amount,
+					Fee:         fee,
+					Inputs:      inputs,
+					Outputs:     outputs,
+					NetAmount:   chain.NetAmount(addr, inputs, outputs),
+				})
+			}
+		}
+	}
+
+	return filtered
+}
+
+// GetTransferLogs returns the ERC-20 Transfer logs of a block. They are only
+// filtered on the event, since nodes cap the addresses of a query: the
+// watched addresses are matched by FilterTokenTransfers.
+func (e *EthereumWatcher) GetTransferLogs(ctx context.Context, data *types.Block) ([]types.Log, error) {
+	if len(e.Addresses()) == 0 {
+		return nil, nil
+	}
+
+	blockHash := data.Hash()
+	return e.Client.FilterLogs(ctx, ethereum.FilterQuery{
+		BlockHash: &blockHash,
+		Topics:    [][]common.Hash{{transferEventSig}},
+	})
+}
+
+func (e *EthereumWatcher) FilterTokenTransfers(data *types.Block, logs []types.Log) []chain.Transaction {
+	filtered := []chain.Transaction{}
+	watched := e.watched()
+
+	for _, l := range logs {
+		// ERC-721 also emits Transfer but with the token ID as a fourth indexed topic.
+		if l.Removed || len(l.Topics) != 3 || l.Topics[0] != transferEventSig || len(l.Data) != 32 {
+			continue
+		}
+
+		tx := data.Transaction(l.TxHash)
+		if tx == nil {
+			log.Printf("error finding ethereum transaction %s for log %d", l.TxHash.Hex(), l.Index)
+			continue
+		}
+
+		amount := new(big.Int).SetBytes(l.Data)
+		logIndex := l.Index
+		fee := new(big.Int).Mul(tx.GasPrice(), new(big.Int).SetUint64(tx.Gas()))
+
+		source := strings.ToLower(common.BytesToAddress(l.Topics[1].Bytes()).Hex())
+		destination := strings.ToLower(common.BytesToAddress(l.Topics[2].Bytes()).Hex())
+		token := strings.ToLower(l.Address.Hex())
+
+		inputs := []chain.Transfer{{Address: source, Amount: amount}}
+		outputs := []chain.Transfer{{Address: destination, Amount: amount}}
+
+		for _, addr := range chain.Parties(source, destination) {
+			if watched.Contains(addr) {
+				owner := chain.Owner(e.Registry, chain.EthereumName, addr)
+				filtered = append(filtered, chain.Transaction{
+					Chain:       chain.EthereumName,
+					ID:          l.TxHash.Hex(),
+					User:        owner.User,
+					Labels:      owner.Labels,
+					Address:     addr,
 					Source:      source,
 					Destination: destination,
+					Direction:   chain.TransferDirection(addr, source, destination),
 					Amount:      amount,
 					Fee:         fee,
+					Token:       token,
+					LogIndex:    &logIndex,
+					Inputs:      inputs,
+					Outputs:     outputs,
+					NetAmount:   chain.NetAmount(addr, inputs, outputs),
 				})
-				break
 			}
 		}
 	}
@@ -133,43 +377,160 @@ func (e *EthereumWatcher) FilterTxs(data *types.Block) []chain.Transaction {
 	return filtered
 }
 
-func (e *EthereumWatcher) handleBlock(block uint64) {
-	data, err := e.Client.BlockByNumber(context.Background(), big.NewInt(int64(block)))
+func (e *EthereumWatcher) handleBlock(ctx context.Context, block uint64) error {
+	data, err := e.Client.BlockByNumber(ctx, big.NewInt(int64(block)))
+	if err != nil {
+		return fmt.Errorf("getting ethereum transactions for block %d: %w", block, err)
+	}
+
+	filteredTxs, err := e.filterBlock(ctx, data)
+	if err != nil {
+		return fmt.Errorf("filtering ethereum block %d: %w", block, err)
+	}
+
+	reorgTxs, err := e.reconcile(ctx, data, filteredTxs)
+	if err != nil {
+		return fmt.Errorf("handling ethereum reorg at block %d: %w", block, err)
+	}
+	if len(reorgTxs) != 0 {
+		log.Printf("Ethereum reorg detected at block %d, emitting %d compensating events", block, len(reorgTxs))
+	}
+
+	return chain.Publish(ctx, chain.EthereumName, block, e.KafkaChan, e.Transactor, e.Progress,
+		func(send func(kafka.Message)) error {
+			e.publish(block, append(reorgTxs, filteredTxs...), e.Finality.Status(), send)
+			return nil
+		})
+}
+
+func (e *EthereumWatcher) Reprocess(ctx context.Context, block uint64) error {
+	return e.handleBlock(ctx, block)
+}
+
+// NextBlock returns the next block to schedule.
+func (e *EthereumWatcher) NextBlock() uint64 {
+	return atomic.LoadUint64(&e.CurrentBlock)
+}
+
+// Backfill processes the blocks from the given one up to the next block to schedule, excluded,
+// again for address only, without checkpointing them. Later blocks see address
+// in the watchlist already.
+func (e *EthereumWatcher) Backfill(ctx context.Context, address string, from uint64) error {
+	backfill := &EthereumWatcher{
+		Client:      e.Client,
+		KafkaChan:   e.KafkaChan,
+		Finality:    e.Finality,
+		DeadLetters: e.DeadLetters,
+		Transactor:  e.Transactor,
+		Keys:        e.Keys,
+		Registry:    e.Registry,
+		watchlist:   chain.NewAddressIndex(false, address),
+	}
+
+	return chain.Backfill(ctx, chain.EthereumName, address, from, e.NextBlock(), backfill.handleBlock, e.DeadLetters)
+}
+
+// handleSeenBlock emits "seen" events for a block that is not final yet.
+func (e *EthereumWatcher) handleSeenBlock(ctx context.Context, block uint64) {
+	data, err := e.Client.BlockByNumber(ctx, big.NewInt(int64(block)))
 	if err != nil {
 		log.Printf("error getting ethereum transactions for block %d: %v", block, err)
 		return
 	}
 
-	filteredTxs := e.FilterTxs(data)
-	for _, filteredTx := range filteredTxs {
-		payload, err := json.Marshal(filteredTx)
+	filteredTxs, err := e.filterBlock(ctx, data)
+	if err != nil {
+		log.Printf("error filtering ethereum block %d: %v", block, err)
+		return
+	}
+
+	e.publish(block, filteredTxs, chain.StatusSeen, func(msg kafka.Message) { e.KafkaChan <- msg })
+}
+
+// publish sends the txs of block with send, with status unless they already carry one.
+func (e *EthereumWatcher) publish(block uint64, txs []chain.Transaction, status chain.Status, send func(kafka.Message)) {
+	for _, filteredTx := range txs {
+		if filteredTx.Status == "" {
+			filteredTx.Status = status
+		}
+
+		msg, err := chain.NewMessage(filteredTx, e.Keys)
 		if err != nil {
 			log.Printf("error marshalling ethereum transaction: %+v\n", filteredTx)
+			chain.PutDeadLetter(e.DeadLetters, chain.DeadLetter{
+				Kind:     chain.DeadLetterBlock,
+				Chain:    chain.EthereumName,
+				Block:    block,
+				Reason:   fmt.Sprintf("marshalling transaction %s: %v", filteredTx.ID, err),
+				Attempts: 1,
+			})
 			continue
 		}
-		e.KafkaChan <- kafka.Message{Value: payload}
+		send(msg)
 	}
 }
 
-func (e *EthereumWatcher) scheduleBlocks(blocks chan<- uint64) {
+func (e *EthereumWatcher) scheduleBlocks(ctx context.Context, blocks chan<- uint64) {
 	for {
 		currentBlock := atomic.LoadUint64(&e.CurrentBlock)
 		maxBlock := atomic.LoadUint64(&e.MaxBlock)
 
 		if currentBlock < maxBlock {
-			blocks <- currentBlock
-			atomic.AddUint64(&e.CurrentBlock, 1)
+			select {
+			case <-ctx.Done():
+				return
+			case blocks <- currentBlock:
+				atomic.AddUint64(&e.CurrentBlock, 1)
+			}
+		} else if !chain.Sleep(ctx, 50*time.Millisecond) {
+			return
+		}
+	}
+}
+
+// scheduleSeenBlocks handles the blocks between the last final block and the tip.
+func (e *EthereumWatcher) scheduleSeenBlocks(ctx context.Context) {
+	next := atomic.LoadUint64(&e.MaxBlock)
+	for ctx.Err() == nil {
+		next = max(next, atomic.LoadUint64(&e.MaxBlock))
+
+		if next <= atomic.LoadUint64(&e.TipBlock) {
+			e.handleSeenBlock(ctx, next)
+			next++
 		} else {
-			time.Sleep(50 * time.Millisecond)
+			chain.Sleep(ctx, 50*time.Millisecond)
 		}
 	}
 }
 
-func (e *EthereumWatcher) Watch() {
-	go e.UpdateMaxBlock()
+func (e *EthereumWatcher) Watch(ctx context.Context) {
+	go e.UpdateMaxBlock(ctx)
+
+	// the retries and seen events are waited for too, so that nothing is sent
+	// to Kafka once Watch returns
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		e.Retrier.Run(ctx)
+		// pending retries are dropped, the blocks waiting for them cannot be committed
+		e.Progress.Stop()
+	}()
+
+	if e.Finality.Enabled() && e.Finality.EmitSeen {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			e.scheduleSeenBlocks(ctx)
+		}()
+	}
 
 	blocks := make(chan uint64, chain.EthBlockWorkers)
 
-	e.startWorkerPool(blocks, chain.EthBlockWorkers)
-	e.scheduleBlocks(blocks)
+	wg := e.startWorkerPool(ctx, blocks, chain.EthBlockWorkers)
+	e.scheduleBlocks(ctx, blocks)
+
+	close(blocks)
+	wg.Wait()
+	background.Wait()
 }
@@ -3,13 +3,18 @@ package ethereum
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/checkpoint"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -29,15 +34,23 @@ const (
 	txID1 = "0xa5b19a9260df27151fdc86fad7881d0b9a1935eb643cf8a12e160b548b484428"
 	txID2 = "0x9d4a900791bb1060cba6b0e05ae2f61114ceac289c4c822b9682066a0ad58653"
 
-	amount   = 100_000_000
-	gasLimit = 21_000
-	gasPrice = 10_0000_000
+	tokenAddress = "0xdAC17F958D2ee523a2206206994597C13D831ec7"
+
+	amount      = 100_000_000
+	tokenAmount = 250_000_000
+	gasLimit    = 21_000
+	gasPrice    = 10_0000_000
+
+	blockTime = 1_700_000_000
 )
 
 type mockClient struct {
 	block       uint64
 	fromPrivate string
 	to          string
+
+	logs    []types.Log
+	queries []ethereum.FilterQuery
 }
 
 func (m *mockClient) BlockNumber(ctx context.Context) (uint64, error) {
@@ -50,20 +63,14 @@ func (m *mockClient) BlockByNumber(ctx context.Context, number *big.Int) (*types
 		0, common.HexToAddress(m.to), big.NewInt(amount), gasLimit, big.NewInt(gasPrice), nil,
 	)
 
-	blockNumber := big.NewInt(int64(m.block))
-	blockTime := uint64(time.Now().Unix())
+	header := mockHeader(number.Uint64())
 
-	signer := types.MakeSigner(params.MainnetChainConfig, blockNumber, blockTime)
+	signer := types.MakeSigner(params.MainnetChainConfig, header.Number, header.Time)
 
 	pk, _ := crypto.HexToECDSA(m.fromPrivate)
 	signedTx, _ := types.SignTx(tx, signer, pk)
 
-	block := types.NewBlockWithHeader(
-		&types.Header{
-			Number: blockNumber,
-			Time:   blockTime,
-		},
-	)
+	block := types.NewBlockWithHeader(header)
 
 	block = block.WithBody(types.Body{
 		Transactions: []*types.Transaction{signedTx}},
@@ -72,6 +79,172 @@ func (m *mockClient) BlockByNumber(ctx context.Context, number *big.Int) (*types
 	return block, nil
 }
 
+// mockHeader returns the header at number of a deterministic chain without reorgs.
+func mockHeader(number uint64) *types.Header {
+	header := &types.Header{Number: new(big.Int), Time: blockTime}
+	for n := uint64(1); n <= number; n++ {
+		header = &types.Header{
+			Number:     new(big.Int).SetUint64(n),
+			Time:       blockTime + n*12,
+			ParentHash: header.Hash(),
+		}
+	}
+	return header
+}
+
+// HeaderByNumber returns the safe or finalized header two blocks behind the tip.
+func (m *mockClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: new(big.Int).SetUint64(m.block - 2)}, nil
+}
+
+func (m *mockClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	m.queries = append(m.queries, q)
+	return m.logs, nil
+}
+
+func transferLog(txHash common.Hash, from, to string, value int64) types.Log {
+	return types.Log{
+		Address: common.HexToAddress(tokenAddress),
+		Topics: []common.Hash{
+			transferEventSig,
+			common.BytesToHash(common.HexToAddress(from).Bytes()),
+			common.BytesToHash(common.HexToAddress(to).Bytes()),
+		},
+		Data:   common.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+		TxHash: txHash,
+	}
+}
+
+func newCheckpointer(t *testing.T) chain.Checkpointer {
+	checkpointer, err := checkpoint.NewFileCheckpointer(filepath.Join(t.TempDir(), "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("failed to create checkpointer: %v", err)
+	}
+	return checkpointer
+}
+
+func TestEthereumTokenTransfers(t *testing.T) {
+	client := &mockClient{
+		fromPrivate: privateKey1,
+		to:          tokenAddress,
+	}
+	block, _ := client.BlockByNumber(context.Background(), big.NewInt(1))
+	txHash := block.Transactions()[0].Hash()
+
+	// the node returns every transfer of the block, watched or not
+	client.logs = []types.Log{
+		transferLog(txHash, publicKey1, publicKey2, tokenAmount),
+		transferLog(txHash, publicKey1, tokenAddress, tokenAmount),
+	}
+
+	e := &EthereumWatcher{Client: client}
+	os.Setenv("ETHEREUM_ADDRESSES", strings.ToLower(publicKey2))
+
+	logs, err := e.GetTransferLogs(context.Background(), block)
+	if err != nil {
+		t.Fatalf("failed to get transfer logs: %v", err)
+	}
+	if len(client.queries) != 1 {
+		t.Fatalf("expected one query for the transfers of the block, got %d", len(client.queries))
+	}
+	if diff := cmp.Diff([][]common.Hash{{transferEventSig}}, client.queries[0].Topics); diff != "" {
+		t.Errorf("query topics mismatch. (-want +got):\n%s", diff)
+	}
+
+	expected := []chain.Transaction{
+		{
+			Chain:       chain.EthereumName,
+			ID:          txHash.Hex(),
+			User:        strings.ToLower(publicKey2),
+			Address:     strings.ToLower(publicKey2),
+			Source:      strings.ToLower(publicKey1),
+			Destination: strings.ToLower(publicKey2),
+			Direction:   chain.DirectionIncoming,
+			Amount:      big.NewInt(tokenAmount),
+			Fee:         big.NewInt(gasLimit * gasPrice),
+			Token:       strings.ToLower(tokenAddress),
+			LogIndex:    new(uint),
+			Inputs:      []chain.Transfer{{Address: strings.ToLower(publicKey1), Amount: big.NewInt(tokenAmount)}},
+			Outputs:     []chain.Transfer{{Address: strings.ToLower(publicKey2), Amount: big.NewInt(tokenAmount)}},
+			NetAmount:   big.NewInt(tokenAmount),
+		},
+	}
+
+	got := e.FilterTokenTransfers(block, logs)
+	if diff := cmp.Diff(expected, got, cmp.AllowUnexported(big.Int{})); diff != "" {
+		t.Errorf("transaction mismatch. (-want +got):\n%s", diff)
+	}
+}
+
+func TestEthereumTransferBetweenWatchedAddresses(t *testing.T) {
+	type event struct {
+		EventID   string
+		Address   string
+		Direction chain.Direction
+	}
+
+	tests := []struct {
+		name string
+		to   string
+		// logIndex is the part of the event IDs identifying the log, if any
+		logIndex string
+		filter   func(e *EthereumWatcher, client *mockClient, block *types.Block) []chain.Transaction
+	}{
+		{
+			name: "native transfer",
+			to:   publicKey2,
+			filter: func(e *EthereumWatcher, client *mockClient, block *types.Block) []chain.Transaction {
+				return e.FilterTxs(block)
+			},
+		},
+		{
+			name:     "ERC-20 transfer",
+			to:       tokenAddress,
+			logIndex: "0:",
+			filter: func(e *EthereumWatcher, client *mockClient, block *types.Block) []chain.Transaction {
+				client.logs = []types.Log{transferLog(block.Transactions()[0].Hash(), publicKey1, publicKey2, tokenAmount)}
+				logs, err := e.GetTransferLogs(context.Background(), block)
+				if err != nil {
+					t.Fatalf("failed to get transfer logs: %v", err)
+				}
+				return e.FilterTokenTransfers(block, logs)
+			},
+		},
+	}
+
+	os.Setenv("ETHEREUM_ADDRESSES", strings.ToLower(publicKey1)+","+strings.ToLower(publicKey2))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{fromPrivate: privateKey1, to: tt.to}
+			block, _ := client.BlockByNumber(context.Background(), big.NewInt(1))
+			e := &EthereumWatcher{Client: client}
+
+			// each side of the transfer is its own event
+			got := []event{}
+			for _, tx := range tt.filter(e, client, block) {
+				got = append(got, event{EventID: chain.EventID(tx), Address: tx.Address, Direction: tx.Direction})
+			}
+
+			prefix := "ethereum:" + block.Transactions()[0].Hash().Hex() + ":" + tt.logIndex
+			expected := []event{
+				{
+					EventID:   prefix + strings.ToLower(publicKey1),
+					Address:   strings.ToLower(publicKey1),
+					Direction: chain.DirectionOutgoing,
+				},
+				{
+					EventID:   prefix + strings.ToLower(publicKey2),
+					Address:   strings.ToLower(publicKey2),
+					Direction: chain.DirectionIncoming,
+				},
+			}
+			if diff := cmp.Diff(expected, got); diff != "" {
+				t.Errorf("events mismatch. (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestEthereumWatch(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -84,13 +257,20 @@ func TestEthereumWatch(t *testing.T) {
 			fromPrivate: privateKey2,
 			to:          publicKey1,
 			expectedTx: chain.Transaction{
+				EventID:     "ethereum:" + txID2 + ":" + strings.ToLower(publicKey2),
 				ID:          txID2,
 				Chain:       chain.EthereumName,
 				User:        strings.ToLower(publicKey2),
+				Address:     strings.ToLower(publicKey2),
 				Source:      strings.ToLower(publicKey2),
 				Destination: strings.ToLower(publicKey1),
+				Direction:   chain.DirectionOutgoing,
 				Amount:      big.NewInt(amount),
 				Fee:         big.NewInt(gasLimit * gasPrice),
+				Inputs:      []chain.Transfer{{Address: strings.ToLower(publicKey2), Amount: big.NewInt(amount)}},
+				Outputs:     []chain.Transfer{{Address: strings.ToLower(publicKey1), Amount: big.NewInt(amount)}},
+				NetAmount:   big.NewInt(-amount),
+				Status:      chain.StatusSeen,
 			},
 		},
 		{
@@ -98,13 +278,20 @@ func TestEthereumWatch(t *testing.T) {
 			fromPrivate: privateKey1,
 			to:          publicKey2,
 			expectedTx: chain.Transaction{
+				EventID:     "ethereum:" + txID1 + ":" + strings.ToLower(publicKey2),
 				ID:          txID1,
 				Chain:       chain.EthereumName,
 				User:        strings.ToLower(publicKey2),
+				Address:     strings.ToLower(publicKey2),
 				Source:      strings.ToLower(publicKey1),
 				Destination: strings.ToLower(publicKey2),
+				Direction:   chain.DirectionIncoming,
 				Amount:      big.NewInt(amount),
 				Fee:         big.NewInt(gasLimit * gasPrice),
+				Inputs:      []chain.Transfer{{Address: strings.ToLower(publicKey1), Amount: big.NewInt(amount)}},
+				Outputs:     []chain.Transfer{{Address: strings.ToLower(publicKey2), Amount: big.NewInt(amount)}},
+				NetAmount:   big.NewInt(amount),
+				Status:      chain.StatusSeen,
 			},
 		},
 		{
@@ -122,11 +309,14 @@ func TestEthereumWatch(t *testing.T) {
 				to:          test.to,
 			}
 			kafkaChan := make(chan kafka.Message, 1)
-			e := NewEthereumWatcher(client, kafkaChan)
+			e := NewEthereumWatcher(client, kafkaChan, newCheckpointer(t), chain.Finality{}, nil)
 
 			os.Setenv("ETHEREUM_ADDRESSES", publicKey2)
 
-			go e.Watch()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go e.Watch(ctx)
 
 			select {
 			case msg := <-kafkaChan:
@@ -140,10 +330,425 @@ func TestEthereumWatch(t *testing.T) {
 				}
 
 			case <-time.After(chain.EthBlockTicker + time.Second):
-				if test.expectedTx != (chain.Transaction{}) {
+				if test.expectedTx.ID != "" {
 					t.Errorf("got nothing, expected a transaction: %+v", test.expectedTx)
 				}
 			}
 		})
 	}
 }
+
+func TestEthereumResume(t *testing.T) {
+	checkpointer := newCheckpointer(t)
+	if err := checkpointer.Save(chain.EthereumName, 41); err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+
+	client := &mockClient{block: 99}
+	e := NewEthereumWatcher(client, make(chan kafka.Message), checkpointer, chain.Finality{}, nil)
+
+	if e.CurrentBlock != 42 {
+		t.Errorf("expected to resume at block 42, got %d", e.CurrentBlock)
+	}
+	if e.MaxBlock != 100 {
+		t.Errorf("expected max block 100, got %d", e.MaxBlock)
+	}
+}
+
+type forkClient struct {
+	blocks map[uint64]*types.Block
+	// fetching, when set, is called before a block is returned
+	fetching func(number uint64)
+}
+
+func (f *forkClient) BlockNumber(ctx context.Context) (uint64, error) {
+	return uint64(len(f.blocks)), nil
+}
+
+func (f *forkClient) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	if f.fetching != nil {
+		f.fetching(number.Uint64())
+	}
+	return f.blocks[number.Uint64()], nil
+}
+
+func (f *forkClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return f.blocks[number.Uint64()].Header(), nil
+}
+
+func (f *forkClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	return nil, nil
+}
+
+func forkBlock(number uint64, parent common.Hash, fork string, txs ...*types.Transaction) *types.Block {
+	block := types.NewBlockWithHeader(&types.Header{
+		Number:     new(big.Int).SetUint64(number),
+		ParentHash: parent,
+		Extra:      []byte(fork),
+	})
+	return block.WithBody(types.Body{Transactions: txs})
+}
+
+// ackMessages acknowledges the messages of in, as the Kafka writer does, and forwards them.
+func ackMessages(in <-chan kafka.Message) <-chan kafka.Message {
+	out := make(chan kafka.Message, cap(in))
+	go func() {
+		defer close(out)
+		for msg := range in {
+			if ack, ok := msg.WriterData.(chain.Ack); ok {
+				ack(nil)
+			}
+			out <- msg
+		}
+	}()
+	return out
+}
+
+func TestEthereumReorg(t *testing.T) {
+	signer := types.MakeSigner(params.MainnetChainConfig, big.NewInt(1), 0)
+	pk, _ := crypto.HexToECDSA(privateKey1)
+	orphanedTx, _ := types.SignTx(types.NewTransaction(
+		0, common.HexToAddress(publicKey2), big.NewInt(amount), gasLimit, big.NewInt(gasPrice), nil,
+	), signer, pk)
+	canonicalTx, _ := types.SignTx(types.NewTransaction(
+		1, common.HexToAddress(publicKey2), big.NewInt(amount), gasLimit, big.NewInt(gasPrice), nil,
+	), signer, pk)
+
+	// block 1 is replaced: the orphaned transaction disappears and a new one is mined
+	root := forkBlock(0, common.Hash{}, "")
+	orphaned := forkBlock(1, root.Hash(), "a", orphanedTx)
+	canonical := forkBlock(1, root.Hash(), "b", canonicalTx)
+	next := forkBlock(2, canonical.Hash(), "b")
+
+	client := &forkClient{blocks: map[uint64]*types.Block{0: root, 1: orphaned}}
+	kafkaChan := make(chan kafka.Message, 10)
+	e := &EthereumWatcher{Client: client, KafkaChan: kafkaChan}
+	acked := ackMessages(kafkaChan)
+	os.Setenv("ETHEREUM_ADDRESSES", strings.ToLower(publicKey2))
+
+	e.handleBlock(context.Background(), 0)
+	e.handleBlock(context.Background(), 1)
+
+	client.blocks[1] = canonical
+	client.blocks[2] = next
+	e.handleBlock(context.Background(), 2)
+
+	close(kafkaChan)
+	got := []chain.Transaction{}
+	for msg := range acked {
+		var tx chain.Transaction
+		if err := json.Unmarshal(msg.Value, &tx); err != nil {
+			t.Fatalf("failed to decode kafka message: %v", err)
+		}
+		got = append(got, tx)
+	}
+
+	expected := []struct {
+		id     string
+		status chain.Status
+	}{
+		{id: orphanedTx.Hash().Hex(), status: chain.StatusSeen},
+		{id: orphanedTx.Hash().Hex(), status: chain.StatusReverted},
+		{id: canonicalTx.Hash().Hex(), status: chain.StatusSeen},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if got[i].ID != expected[i].id || got[i].Status != expected[i].status {
+			t.Errorf("event %d: expected %s %q, got %s %q", i, expected[i].id, expected[i].status, got[i].ID, got[i].Status)
+		}
+	}
+}
+
+func TestEthereumReorgOutOfOrder(t *testing.T) {
+	signer := types.MakeSigner(params.MainnetChainConfig, big.NewInt(1), 0)
+	pk, _ := crypto.HexToECDSA(privateKey1)
+	orphanedTx, _ := types.SignTx(types.NewTransaction(
+		0, common.HexToAddress(publicKey2), big.NewInt(amount), gasLimit, big.NewInt(gasPrice), nil,
+	), signer, pk)
+	canonicalTx, _ := types.SignTx(types.NewTransaction(
+		1, common.HexToAddress(publicKey2), big.NewInt(amount), gasLimit, big.NewInt(gasPrice), nil,
+	), signer, pk)
+
+	root := forkBlock(0, common.Hash{}, "")
+	canonical := forkBlock(1, root.Hash(), "b", canonicalTx)
+	next := forkBlock(2, canonical.Hash(), "b")
+
+	type event struct {
+		ID     string
+		Status chain.Status
+	}
+
+	tests := []struct {
+		name     string
+		steps    func(t *testing.T, e *EthereumWatcher, client *forkClient)
+		expected []event
+	}{
+		{
+			name: "orphaned parent recorded after its canonical child",
+			steps: func(t *testing.T, e *EthereumWatcher, client *forkClient) {
+				orphaned := forkBlock(1, root.Hash(), "a", orphanedTx)
+				client.blocks[1] = canonical
+				client.blocks[2] = next
+				e.handleBlock(context.Background(), 2)
+
+				// block 1 was fetched before the reorg, and is reconciled after block 2
+				if _, err := e.reconcile(context.Background(), orphaned, e.FilterTxs(orphaned)); err == nil {
+					t.Fatal("expected an error reconciling the orphaned block")
+				}
+				e.handleBlock(context.Background(), 1)
+			},
+			expected: []event{
+				{ID: canonicalTx.Hash().Hex(), Status: chain.StatusSeen},
+			},
+		},
+		{
+			name: "orphaned child recorded before its canonical parent",
+			steps: func(t *testing.T, e *EthereumWatcher, client *forkClient) {
+				orphaned := forkBlock(1, root.Hash(), "a")
+				client.blocks[2] = forkBlock(2, orphaned.Hash(), "a", orphanedTx)
+				e.handleBlock(context.Background(), 2)
+
+				client.blocks[1] = canonical
+				client.blocks[2] = next
+				e.handleBlock(context.Background(), 1)
+			},
+			expected: []event{
+				{ID: orphanedTx.Hash().Hex(), Status: chain.StatusSeen},
+				{ID: orphanedTx.Hash().Hex(), Status: chain.StatusReverted},
+				{ID: canonicalTx.Hash().Hex(), Status: chain.StatusSeen},
+			},
+		},
+	}
+
+	os.Setenv("ETHEREUM_ADDRESSES", strings.ToLower(publicKey2))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &forkClient{blocks: map[uint64]*types.Block{0: root}}
+			kafkaChan := make(chan kafka.Message, 10)
+			e := &EthereumWatcher{Client: client, KafkaChan: kafkaChan}
+			acked := ackMessages(kafkaChan)
+
+			e.handleBlock(context.Background(), 0)
+			tt.steps(t, e, client)
+
+			close(kafkaChan)
+			got := []event{}
+			for msg := range acked {
+				var tx chain.Transaction
+				if err := json.Unmarshal(msg.Value, &tx); err != nil {
+					t.Fatalf("failed to decode kafka message: %v", err)
+				}
+				got = append(got, event{ID: tx.ID, Status: tx.Status})
+			}
+
+			if diff := cmp.Diff(tt.expected, got); diff != "" {
+				t.Errorf("events mismatch (-expected +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEthereumReorgUnlocked(t *testing.T) {
+	signer := types.MakeSigner(params.MainnetChainConfig, big.NewInt(1), 0)
+	pk, _ := crypto.HexToECDSA(privateKey1)
+	orphanedTx, _ := types.SignTx(types.NewTransaction(
+		0, common.HexToAddress(publicKey2), big.NewInt(amount), gasLimit, big.NewInt(gasPrice), nil,
+	), signer, pk)
+
+	root := forkBlock(0, common.Hash{}, "")
+	orphaned := forkBlock(1, root.Hash(), "a", orphanedTx)
+	canonical := forkBlock(1, root.Hash(), "b")
+	next := forkBlock(2, canonical.Hash(), "b")
+
+	client := &forkClient{blocks: map[uint64]*types.Block{0: root, 1: orphaned}}
+	kafkaChan := make(chan kafka.Message, 10)
+	e := &EthereumWatcher{Client: client, KafkaChan: kafkaChan}
+	acked := ackMessages(kafkaChan)
+	os.Setenv("ETHEREUM_ADDRESSES", strings.ToLower(publicKey2))
+
+	e.handleBlock(context.Background(), 0)
+	e.handleBlock(context.Background(), 1)
+
+	// the canonical block is fetched without holding the window
+	client.blocks[1] = canonical
+	client.blocks[2] = next
+	locked := false
+	client.fetching = func(number uint64) {
+		if number != 1 {
+			return
+		}
+		if !e.window.mu.TryLock() {
+			locked = true
+			return
+		}
+		e.window.mu.Unlock()
+	}
+	e.handleBlock(context.Background(), 2)
+	if locked {
+		t.Errorf("expected the window to be unlocked while fetching the canonical block")
+	}
+
+	close(kafkaChan)
+	statuses := []chain.Status{}
+	for msg := range acked {
+		var tx chain.Transaction
+		if err := json.Unmarshal(msg.Value, &tx); err != nil {
+			t.Fatalf("failed to decode kafka message: %v", err)
+		}
+		statuses = append(statuses, tx.Status)
+	}
+	if diff := cmp.Diff([]chain.Status{chain.StatusSeen, chain.StatusReverted}, statuses); diff != "" {
+		t.Errorf("statuses mismatch (-expected +got):\n%s", diff)
+	}
+	if e.window.blocks[1].hash != canonical.Hash() {
+		t.Errorf("expected the canonical block 1 to be recorded")
+	}
+}
+
+func TestEthereumDiffTxs(t *testing.T) {
+	logIndex := func(i uint) *uint { return &i }
+	transfer := chain.Transaction{Chain: chain.EthereumName, ID: txID1, User: publicKey2, Amount: big.NewInt(1)}
+	first, second := transfer, transfer
+	first.LogIndex = logIndex(0)
+	second.LogIndex = logIndex(1)
+
+	reverted, added := diffTxs([]chain.Transaction{first, second}, []chain.Transaction{first})
+	if len(reverted) != 1 || *reverted[0].LogIndex != 1 || reverted[0].Status != chain.StatusReverted {
+		t.Errorf("expected the second transfer to be reverted, got %+v", reverted)
+	}
+	if len(added) != 0 {
+		t.Errorf("expected no added transfer, got %+v", added)
+	}
+
+	// the same transaction mined after another one, its logs shifted in the block
+	movedFirst, movedSecond := first, second
+	movedFirst.LogIndex = logIndex(5)
+	movedSecond.LogIndex = logIndex(6)
+
+	reverted, added = diffTxs([]chain.Transaction{first, second}, []chain.Transaction{movedFirst, movedSecond})
+	if len(reverted) != 0 || len(added) != 0 {
+		t.Errorf("expected the moved transfers to be kept, got reverted %+v and added %+v", reverted, added)
+	}
+}
+
+func TestEthereumFinality(t *testing.T) {
+	tests := []struct {
+		name          string
+		finality      chain.Finality
+		expectedTip   uint64
+		expectedFinal uint64
+	}{
+		{name: "tip", finality: chain.Finality{}, expectedTip: 10, expectedFinal: 10},
+		{name: "depth", finality: chain.Finality{Depth: 3}, expectedTip: 10, expectedFinal: 7},
+		{name: "finalized tag", finality: chain.Finality{Tag: "finalized"}, expectedTip: 10, expectedFinal: 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &EthereumWatcher{Client: &mockClient{block: 9}, Finality: test.finality}
+
+			tip, final, err := e.GetMaxBlocks(context.Background())
+			if err != nil {
+				t.Fatalf("failed to get max blocks: %v", err)
+			}
+			if tip != test.expectedTip || final != test.expectedFinal {
+				t.Errorf("expected tip %d and final %d, got %d and %d", test.expectedTip, test.expectedFinal, tip, final)
+			}
+		})
+	}
+}
+
+// mockHeads hands each subscription to the test.
+type mockHeads chan mockSubscription
+
+type mockSubscription struct {
+	heads chan<- *types.Header
+	err   chan error
+}
+
+func (m mockHeads) SubscribeNewHead(ctx context.Context, ch chan<- *types.Header) (ethereum.Subscription, error) {
+	sub := mockSubscription{heads: ch, err: make(chan error, 1)}
+	m <- sub
+	return sub, nil
+}
+
+func (s mockSubscription) Err() <-chan error { return s.err }
+
+func (s mockSubscription) Unsubscribe() {}
+
+func TestEthereumNewHeads(t *testing.T) {
+	heads := make(mockHeads, 1)
+	e := &EthereumWatcher{Client: &mockClient{}, Heads: heads}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go e.UpdateMaxBlock(ctx)
+
+	subscribed := func() mockSubscription {
+		select {
+		case sub := <-heads:
+			return sub
+		case <-time.After(chain.EthResubscribeDelay + time.Second):
+			t.Fatalf("expected a subscription to new heads")
+			return mockSubscription{}
+		}
+	}
+	expectMaxBlock := func(expected uint64, within time.Duration) {
+		deadline := time.Now().Add(within)
+		for atomic.LoadUint64(&e.MaxBlock) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected max block %d, got %d", expected, atomic.LoadUint64(&e.MaxBlock))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// subscribing polls once to catch up, then heads are pushed
+	sub := subscribed()
+	expectMaxBlock(1, time.Second)
+	sub.heads <- &types.Header{Number: big.NewInt(100)}
+	expectMaxBlock(100, time.Second)
+
+	// blocks are polled once the socket drops, until subscribed again
+	sub.err <- errors.New("connection reset")
+	expectMaxBlock(2, chain.EthBlockTicker+time.Second)
+	sub = subscribed()
+	sub.heads <- &types.Header{Number: big.NewInt(200)}
+	expectMaxBlock(200, time.Second)
+}
+
+func TestEthereumSeenAndConfirmed(t *testing.T) {
+	client := &mockClient{
+		fromPrivate: privateKey1,
+		to:          publicKey2,
+	}
+	kafkaChan := make(chan kafka.Message, 10)
+	finality := chain.Finality{Depth: 1, EmitSeen: true}
+	e := NewEthereumWatcher(client, kafkaChan, newCheckpointer(t), finality, nil)
+
+	os.Setenv("ETHEREUM_ADDRESSES", strings.ToLower(publicKey2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go e.Watch(ctx)
+
+	statuses := map[chain.Status]bool{}
+	timeout := time.After(3*chain.EthBlockTicker + time.Second)
+	for !statuses[chain.StatusSeen] || !statuses[chain.StatusConfirmed] {
+		select {
+		case msg := <-kafkaChan:
+			var got chain.Transaction
+			if err := json.Unmarshal(msg.Value, &got); err != nil {
+				t.Fatalf("failed to decode kafka message: %v", err)
+			}
+			statuses[got.Status] = true
+
+		case <-timeout:
+			t.Fatalf("expected seen and confirmed events, got %v", statuses)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package ethereum
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+	"sync"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// blockRecord is a processed block and the events emitted for it.
+type blockRecord struct {
+	hash   common.Hash
+	parent common.Hash
+	txs    []chain.Transaction
+}
+
+// reorgWindow keeps the last chain.EthReorgWindow processed blocks by number.
+type reorgWindow struct {
+	mu     sync.Mutex
+	blocks map[uint64]blockRecord
+}
+
+// filterBlock returns the native and token transfers of a block involving a watched address.
+func (e *EthereumWatcher) filterBlock(ctx context.Context, data *types.Block) ([]chain.Transaction, error) {
+	logs, err := e.GetTransferLogs(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("getting transfer logs: %w", err)
+	}
+
+	return append(e.FilterTxs(data), e.FilterTokenTransfers(data, logs)...), nil
+}
+
+// reconcile records a processed block. When its parent is not the block
+// processed at the previous height, a reorg happened: the canonical branch is
+// walked back until the fork point and re-processed. Blocks are processed
+// concurrently, so a block may be recorded after its child: the child is then
+// checked against it, and replaced by the canonical one when it was orphaned.
+// It returns "reverted" events for transactions of orphaned blocks that are
+// not in the canonical branch, followed by the canonical transactions that
+// were never emitted.
+//
+// The canonical blocks are fetched without holding the window, from a
+// snapshot of it. The branch is walked again when a block it read was
+// recorded meanwhile, with the canonical blocks fetched already.
+func (e *EthereumWatcher) reconcile(ctx context.Context, data *types.Block, txs []chain.Transaction) ([]chain.Transaction, error) {
+	fetched := map[uint64]blockRecord{}
+	for {
+		snapshot := e.window.snapshot()
+		events, updates, read, err := e.walk(ctx, data, txs, snapshot, fetched)
+		if err != nil {
+			return nil, err
+		}
+		if e.window.apply(read, updates, data.NumberU64()) {
+			return events, nil
+		}
+	}
+}
+
+// walk reconciles data against the snapshot of the window, fetching the
+// canonical blocks missing from fetched. It returns the events, the records to
+// update, and the hashes of the records it read, zero when missing.
+func (e *EthereumWatcher) walk(ctx context.Context, data *types.Block, txs []chain.Transaction,
+	snapshot, fetched map[uint64]blockRecord) ([]chain.Transaction, map[uint64]blockRecord, map[uint64]common.Hash, error) {
+	// the window is only updated once every block is reconciled, so the events
+	// of a reorg are not lost when a canonical block cannot be fetched
+	updates := map[uint64]blockRecord{}
+	read := map[uint64]common.Hash{}
+	recorded := func(number uint64) (blockRecord, bool) {
+		if record, ok := updates[number]; ok {
+			return record, true
+		}
+		record, ok := snapshot[number]
+		read[number] = record.hash
+		return record, ok
+	}
+	canonicalBlock := func(number uint64) (blockRecord, error) {
+		if record, ok := fetched[number]; ok {
+			return record, nil
+		}
+		record, err := e.canonicalBlock(ctx, number)
+		if err != nil {
+			return blockRecord{}, err
+		}
+		fetched[number] = record
+		return record, nil
+	}
+
+	events := []chain.Transaction{}
+
+	hash := data.Hash()
+	for number := data.NumberU64() + 1; ; number++ {
+		orphan, ok := recorded(number)
+		if !ok || orphan.parent == hash {
+			break
+		}
+
+		canonical, err := canonicalBlock(number)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if canonical.parent != hash {
+			// the block was orphaned while being processed, it is processed again
+			return nil, nil, nil, fmt.Errorf("block %d is not the parent of canonical block %d", data.NumberU64(), number)
+		}
+
+		reverted, added := diffTxs(orphan.txs, canonical.txs)
+		events = append(events, reverted...)
+		events = append(events, added...)
+
+		updates[number] = canonical
+		hash = canonical.hash
+	}
+
+	parent := data.ParentHash()
+	for number := data.NumberU64(); number > 0; number-- {
+		orphan, ok := recorded(number - 1)
+		if !ok || orphan.hash == parent {
+			break
+		}
+
+		canonical, err := canonicalBlock(number - 1)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		reverted, added := diffTxs(orphan.txs, canonical.txs)
+		events = append(events, reverted...)
+		events = append(events, added...)
+
+		updates[number-1] = canonical
+		parent = canonical.parent
+	}
+
+	updates[data.NumberU64()] = blockRecord{
+		hash:   data.Hash(),
+		parent: data.ParentHash(),
+		txs:    txs,
+	}
+	return events, updates, read, nil
+}
+
+// snapshot returns a copy of the recorded blocks.
+func (w *reorgWindow) snapshot() map[uint64]blockRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return maps.Clone(w.blocks)
+}
+
+// apply records updates for the block at number, and drops the blocks out of
+// the window. It reports false without recording anything when a block of
+// read was recorded since, the reconciliation is then stale.
+func (w *reorgWindow) apply(read map[uint64]common.Hash, updates map[uint64]blockRecord, number uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for n, hash := range read {
+		if w.blocks[n].hash != hash {
+			return false
+		}
+	}
+
+	if w.blocks == nil {
+		w.blocks = map[uint64]blockRecord{}
+	}
+	for n, record := range updates {
+		w.blocks[n] = record
+	}
+	for n := range w.blocks {
+		if n+chain.EthReorgWindow <= number {
+			delete(w.blocks, n)
+		}
+	}
+	return true
+}
+
+// canonicalBlock fetches and processes the canonical block at number.
+func (e *EthereumWatcher) canonicalBlock(ctx context.Context, number uint64) (blockRecord, error) {
+	canonical, err := e.Client.BlockByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return blockRecord{}, fmt.Errorf("getting canonical block %d: %w", number, err)
+	}
+	txs, err := e.filterBlock(ctx, canonical)
+	if err != nil {
+		return blockRecord{}, fmt.Errorf("processing canonical block %d: %w", number, err)
+	}
+
+	return blockRecord{
+		hash:   canonical.Hash(),
+		parent: canonical.ParentHash(),
+		txs:    txs,
+	}, nil
+}
+
+// diffTxs returns the orphaned transactions missing from the canonical branch,
+// marked as reverted, and the canonical transactions missing from the orphaned
+// branch. Transactions are compared by reorgKey, the same transfer twice in a
+// transaction being two events.
+func diffTxs(orphaned, canonical []chain.Transaction) ([]chain.Transaction, []chain.Transaction) {
+	orphanedKeys := reorgKeys(orphaned)
+	canonicalKeys := reorgKeys(canonical)
+
+	inCanonical := map[string]bool{}
+	for _, k := range canonicalKeys {
+		inCanonical[k] = true
+	}
+	inOrphaned := map[string]bool{}
+	for _, k := range orphanedKeys {
+		inOrphaned[k] = true
+	}
+
+	reverted := []chain.Transaction{}
+	for i, tx := range orphaned {
+		if !inCanonical[orphanedKeys[i]] {
+			tx.Status = chain.StatusReverted
+			reverted = append(reverted, tx)
+		}
+	}
+
+	added := []chain.Transaction{}
+	for i, tx := range canonical {
+		if !inOrphaned[canonicalKeys[i]] {
+			added = append(added, tx)
+		}
+	}
+
+	return reverted, added
+}
+
+// reorgKeys returns the keys comparing txs across branches: their event IDs
+// with the log index in the block replaced by the position of the log among
+// the transfer logs of its transaction. A transaction mined at another position
+// of the canonical block keeps its keys.
+func reorgKeys(txs []chain.Transaction) []string {
+	logs := map[string][]uint{}
+	for _, tx := range txs {
+		if tx.LogIndex != nil && !slices.Contains(logs[tx.ID], *tx.LogIndex) {
+			logs[tx.ID] = append(logs[tx.ID], *tx.LogIndex)
+		}
+	}
+	for _, indexes := range logs {
+		slices.Sort(indexes)
+	}
+
+	keys := make([]string, len(txs))
+	for i, tx := range txs {
+		if tx.LogIndex != nil {
+			position := uint(slices.Index(logs[tx.ID], *tx.LogIndex))
+			tx.LogIndex = &position
+		}
+		keys[i] = chain.EventID(tx)
+	}
+	return keys
+}
@@ -0,0 +1,102 @@
+package chain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// HeaderEventID is the Kafka header carrying the event ID of a message.
+	HeaderEventID = "event_id"
+	// HeaderStatus is the Kafka header carrying the status of the event of a message.
+	HeaderStatus = "status"
+)
+
+// KeyStrategy selects the Kafka message key of events, and so which events
+// keep their order in a partition.
+type KeyStrategy string
+
+const (
+	// KeyByUser keys events by chain and user, the default.
+	KeyByUser KeyStrategy = "user"
+
+	// KeyByAddress keys events by chain and watched address.
+	KeyByAddress KeyStrategy = "address"
+
+	// KeyByChain keys events by chain.
+	KeyByChain KeyStrategy = "chain"
+)
+
+// LoadKeyStrategy reads KAFKA_KEY_STRATEGY, "user" when unset.
+func LoadKeyStrategy() (KeyStrategy, error) {
+	switch env := KeyStrategy(os.Getenv("KAFKA_KEY_STRATEGY")); env {
+	case "":
+		return KeyByUser, nil
+	case KeyByUser, KeyByAddress, KeyByChain:
+		return env, nil
+	default:
+		return "", fmt.Errorf("invalid KAFKA_KEY_STRATEGY %q: expected user, address or chain", env)
+	}
+}
+
+// Key returns the Kafka message key of tx.
+func (k KeyStrategy) Key(tx Transaction) []byte {
+	switch k {
+	case KeyByAddress:
+		return []byte(string(tx.Chain) + ":" + tx.Address)
+	case KeyByChain:
+		return []byte(tx.Chain)
+	default:
+		return []byte(string(tx.Chain) + ":" + tx.User)
+	}
+}
+
+// EventID returns the deterministic idempotency ID of tx: its chain, its
+// transaction, the index of the instruction (and inner instruction) or log
+// that made the transfer if any, the watched user, and the watched address
+// when it is not the user itself, since a user may own both sides of a
+// transfer. Status updates of an event share its ID, so an event is
+// deduplicated by its ID and its status.
+func EventID(tx Transaction) string {
+	parts := []string{string(tx.Chain), tx.ID}
+	if tx.InstructionIndex != nil {
+		parts = append(parts, strconv.Itoa(*tx.InstructionIndex))
+	}
+	if tx.InnerIndex != nil {
+		parts = append(parts, strconv.Itoa(*tx.InnerIndex))
+	}
+	if tx.LogIndex != nil {
+		parts = append(parts, strconv.FormatUint(uint64(*tx.LogIndex), 10))
+	}
+	parts = append(parts, tx.User)
+	if tx.Address != "" && tx.Address != tx.User {
+		parts = append(parts, tx.Address)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// NewMessage returns the Kafka message of tx, with its event ID set, keyed by
+// keys. Its event ID and status are also set in the headers.
+func NewMessage(tx Transaction, keys KeyStrategy) (kafka.Message, error) {
+	tx.EventID = EventID(tx)
+
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	return kafka.Message{
+		Key:   keys.Key(tx),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: HeaderEventID, Value: []byte(tx.EventID)},
+			{Key: HeaderStatus, Value: []byte(tx.Status)},
+		},
+	}, nil
+}
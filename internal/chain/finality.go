@@ -0,0 +1,66 @@
+package chain
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Finality controls when a block is final enough for its events to be emitted as confirmed.
+type Finality struct {
+	// Depth is the number of blocks (slots on Solana) a block must be buried under.
+	Depth uint64
+
+	// Tag is the block tag (Ethereum "safe" or "finalized") or the commitment
+	// (Solana "confirmed" or "finalized") of the last final block.
+	Tag string
+
+	// EmitSeen also emits "seen" events at tip, before blocks are final.
+	EmitSeen bool
+}
+
+// Enabled reports whether events wait for finality.
+func (f Finality) Enabled() bool {
+	return f.Depth > 0 || f.Tag != ""
+}
+
+// Status returns the status of events emitted by the main, checkpointed, pipeline.
+func (f Finality) Status() Status {
+	if f.Enabled() {
+		return StatusConfirmed
+	}
+	return StatusSeen
+}
+
+// LoadFinality reads <CHAIN>_FINALITY, either a depth or one of tags, and
+// <CHAIN>_EMIT_SEEN. An unset finality emits events at tip.
+func LoadFinality(c Chain, tags ...string) (Finality, error) {
+	prefix := strings.ToUpper(string(c))
+	f := Finality{}
+
+	if env := os.Getenv(prefix + "_EMIT_SEEN"); env != "" {
+		emitSeen, err := strconv.ParseBool(env)
+		if err != nil {
+			return Finality{}, fmt.Errorf("invalid %s_EMIT_SEEN %q: %w", prefix, env, err)
+		}
+		f.EmitSeen = emitSeen
+	}
+
+	env := os.Getenv(prefix + "_FINALITY")
+	if env == "" {
+		return f, nil
+	}
+
+	if depth, err := strconv.ParseUint(env, 10, 64); err == nil {
+		f.Depth = depth
+		return f, nil
+	}
+	if !slices.Contains(tags, env) {
+		return Finality{}, fmt.Errorf("invalid %s_FINALITY %q: expected a depth or one of %v", prefix, env, tags)
+	}
+	f.Tag = env
+
+	return f, nil
+}
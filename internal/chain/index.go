@@ -0,0 +1,197 @@
+package chain
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// bloomHashes is the number of bits set per address, optimal for BloomBitsPerAddress.
+	bloomHashes = 7
+	// bloomMinCapacity is the number of addresses the smallest filter is sized for.
+	bloomMinCapacity = 1024
+)
+
+// AddressMatcher reports whether an address is watched.
+type AddressMatcher interface {
+	Contains(address string) bool
+}
+
+// AddressIndex is a set of addresses, safe for concurrent use, matching an
+// address in constant time. When enabled, a Bloom filter read without locking
+// fronts the set, so that the addresses that are not indexed, most of the ones
+// of a block, are rejected without contending on the lock. A nil index is empty.
+type AddressIndex struct {
+	bloom atomic.Pointer[bloomFilter]
+
+	mu        sync.RWMutex
+	addresses map[string]struct{}
+	// sorted caches Addresses until the next change.
+	sorted []string
+	// removed counts the removals since the filter was built, their bits stay set.
+	removed int
+}
+
+// NewAddressIndex returns an index of addresses, fronted by a Bloom filter if bloom is set.
+func NewAddressIndex(bloom bool, addresses ...string) *AddressIndex {
+	x := &AddressIndex{addresses: make(map[string]struct{}, len(addresses))}
+	for _, address := range addresses {
+		x.addresses[address] = struct{}{}
+	}
+	if bloom {
+		x.bloom.Store(newBloomFilter(x.addresses))
+	}
+	return x
+}
+
+// Contains reports whether address is in the index.
+func (x *AddressIndex) Contains(address string) bool {
+	if x == nil {
+		return false
+	}
+	if bloom := x.bloom.Load(); bloom != nil && !bloom.mayContain(address) {
+		return false
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	_, ok := x.addresses[address]
+	return ok
+}
+
+// Add inserts addresses in the index.
+func (x *AddressIndex) Add(addresses ...string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, address := range addresses {
+		if _, ok := x.addresses[address]; ok {
+			continue
+		}
+		x.addresses[address] = struct{}{}
+		x.sorted = nil
+		// the bits are set once the address is in the set, which Contains reads under the lock
+		if bloom := x.bloom.Load(); bloom != nil {
+			bloom.add(address)
+		}
+	}
+	x.resize()
+}
+
+// Remove deletes addresses from the index.
+func (x *AddressIndex) Remove(addresses ...string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, address := range addresses {
+		if _, ok := x.addresses[address]; !ok {
+			continue
+		}
+		delete(x.addresses, address)
+		x.sorted = nil
+		x.removed++
+	}
+	x.resize()
+}
+
+// Len returns the number of addresses in the index.
+func (x *AddressIndex) Len() int {
+	if x == nil {
+		return 0
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.addresses)
+}
+
+// Addresses returns the sorted addresses of the index. The slice is shared
+// until the next change and must not be modified.
+func (x *AddressIndex) Addresses() []string {
+	if x == nil {
+		return nil
+	}
+
+	x.mu.RLock()
+	sorted := x.sorted
+	x.mu.RUnlock()
+	if sorted != nil {
+		return sorted
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.sorted == nil {
+		x.sorted = make([]string, 0, len(x.addresses))
+		for address := range x.addresses {
+			x.sorted = append(x.sorted, address)
+		}
+		slices.Sort(x.sorted)
+	}
+	return x.sorted
+}
+
+// resize rebuilds the Bloom filter once the index outgrew it, or once enough
+// addresses were removed that their stale bits raise the false positives.
+func (x *AddressIndex) resize() {
+	bloom := x.bloom.Load()
+	if bloom == nil {
+		return
+	}
+	if len(x.addresses) > bloom.capacity || x.removed > bloom.capacity/2 {
+		x.bloom.Store(newBloomFilter(x.addresses))
+		x.removed = 0
+	}
+}
+
+// bloomFilter is a Bloom filter whose bits are set and read atomically.
+type bloomFilter struct {
+	seed     maphash.Seed
+	capacity int
+	bits     []atomic.Uint64
+}
+
+// newBloomFilter returns a filter of addresses, sized for twice as many.
+func newBloomFilter(addresses map[string]struct{}) *bloomFilter {
+	capacity := max(2*len(addresses), bloomMinCapacity)
+	b := &bloomFilter{
+		seed:     maphash.MakeSeed(),
+		capacity: capacity,
+		bits:     make([]atomic.Uint64, (capacity*BloomBitsPerAddress+63)/64),
+	}
+	for address := range addresses {
+		b.add(address)
+	}
+	return b
+}
+
+func (b *bloomFilter) add(address string) {
+	h1, h2 := b.hash(address)
+	m := uint64(len(b.bits) * 64)
+	for i := range uint64(bloomHashes) {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/64].Or(1 << (bit % 64))
+	}
+}
+
+func (b *bloomFilter) mayContain(address string) bool {
+	h1, h2 := b.hash(address)
+	m := uint64(len(b.bits) * 64)
+	for i := range uint64(bloomHashes) {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/64].Load()&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hash returns the two hashes the bit positions are derived from (Kirsch-Mitzenmacher).
+func (b *bloomFilter) hash(address string) (uint64, uint64) {
+	h := maphash.String(b.seed, address)
+	return h & 0xffffffff, h>>32 | 1
+}
@@ -0,0 +1,141 @@
+package chain
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Account is a watched address and the user it belongs to.
+type Account struct {
+	Chain   Chain    `json:"chain"`
+	Address string   `json:"address"`
+	User    string   `json:"user"`
+	Labels  []string `json:"labels,omitempty"`
+}
+
+// Registry maps the watched addresses of every chain to their user. A user may
+// own many addresses, on any chain.
+type Registry interface {
+	// Lookup returns the account of address on c, ok is false when it is not registered.
+	Lookup(c Chain, address string) (account Account, ok bool)
+
+	// Addresses returns the registered addresses of c.
+	Addresses(c Chain) []string
+
+	// Index returns the registered addresses of c as an index kept up to date,
+	// nil when none was ever registered.
+	Index(c Chain) *AddressIndex
+}
+
+// ExclusiveRegistry is a Registry that may be the only source of the watched
+// addresses, such as one shared by every replica.
+type ExclusiveRegistry interface {
+	Registry
+
+	// Exclusive reports whether the addresses of the environment are ignored.
+	Exclusive() bool
+}
+
+// Watchlist returns the addresses of c listed in the env variable, comma
+// separated and normalized, followed by the ones of registry when it is not
+// nil. An exclusive registry replaces the env variable.
+func Watchlist(c Chain, env string, registry Registry) []string {
+	if exclusive, ok := registry.(ExclusiveRegistry); ok && exclusive.Exclusive() {
+		return registry.Addresses(c)
+	}
+
+	listed := envAddresses(c, env)
+	addresses := slices.Clone(listed.addresses)
+	if registry == nil {
+		return addresses
+	}
+
+	for _, addr := range registry.Addresses(c) {
+		if !listed.index.Contains(addr) {
+			addresses = append(addresses, addr)
+		}
+	}
+	return addresses
+}
+
+// Watching returns the watched addresses of c, see Watchlist, as a matcher
+// to take once per block rather than once per transaction. It sees the
+// changes of the registry as they happen.
+func Watching(c Chain, env string, registry Registry) AddressMatcher {
+	if exclusive, ok := registry.(ExclusiveRegistry); ok && exclusive.Exclusive() {
+		return registry.Index(c)
+	}
+
+	listed := envAddresses(c, env).index
+	if registry == nil {
+		return listed
+	}
+	return anyMatcher{listed, registry.Index(c)}
+}
+
+// anyMatcher matches the addresses matched by any of its matchers.
+type anyMatcher []AddressMatcher
+
+func (m anyMatcher) Contains(address string) bool {
+	for _, matcher := range m {
+		if matcher.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Owner returns the account of address on c. Addresses missing from registry,
+// such as the ones only listed in the environment, are their own user.
+func Owner(registry Registry, c Chain, address string) Account {
+	if registry != nil {
+		if account, ok := registry.Lookup(c, address); ok {
+			return account
+		}
+	}
+	return Account{Chain: c, Address: address, User: address}
+}
+
+// parsedEnv caches the addresses parsed from each value of an env variable, so
+// that they are only normalized, and invalid ones reported, once.
+var parsedEnv sync.Map
+
+// envList is the parsed value of an env variable.
+type envList struct {
+	addresses []string
+	index     *AddressIndex
+}
+
+// envAddresses returns the normalized addresses of c listed in the env
+// variable. Invalid addresses are logged and skipped.
+func envAddresses(c Chain, env string) envList {
+	list := os.Getenv(env)
+	cacheKey := env + "=" + list
+	if listed, ok := parsedEnv.Load(cacheKey); ok {
+		return listed.(envList)
+	}
+
+	addresses := []string{}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		address, err := NormalizeAddress(c, entry)
+		if err != nil {
+			log.Printf("skipping %s entry: %v", env, err)
+			continue
+		}
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	listed := envList{addresses: addresses, index: NewAddressIndex(AddressBloomFilter, addresses...)}
+	parsedEnv.Store(cacheKey, listed)
+	return listed
+}
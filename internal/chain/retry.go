@@ -0,0 +1,174 @@
+package chain
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type retryItem struct {
+	block   uint64
+	attempt int
+}
+
+// Retrier re-processes failed blocks with bounded exponential backoff and
+// jitter. Retries run in their own goroutine so they never stall the live tip.
+// Blocks still failing after MaxAttempts are sent to the dead letter queue,
+// which outlives the process and is re-driven with the redrive command.
+type Retrier struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	chain  Chain
+	handle func(ctx context.Context, block uint64) error
+	done   func(block uint64)
+	queue  chan retryItem
+
+	// timers are the scheduled retries by block, stopped once Run returns.
+	mu      sync.Mutex
+	timers  map[uint64]*time.Timer
+	pending sync.WaitGroup
+	stopped chan struct{}
+
+	deadLetters DeadLetterQueue
+}
+
+// NewRetrier returns a Retrier calling handle to re-process a block, and done
+// once it succeeded or terminally failed.
+func NewRetrier(c Chain, handle func(ctx context.Context, block uint64) error, done func(block uint64),
+	deadLetters DeadLetterQueue) *Retrier {
+	return &Retrier{
+		MaxAttempts: RetryMaxAttempts,
+		BaseDelay:   RetryBaseDelay,
+		MaxDelay:    RetryMaxDelay,
+		chain:       c,
+		handle:      handle,
+		done:        done,
+		queue:       make(chan retryItem, RetryQueueSize),
+		timers:      map[uint64]*time.Timer{},
+		stopped:     make(chan struct{}),
+		deadLetters: deadLetters,
+	}
+}
+
+// Retry schedules a block whose first processing attempt failed with err.
+func (r *Retrier) Retry(block uint64, err error) {
+	r.schedule(retryItem{block: block, attempt: 1}, err)
+}
+
+func (r *Retrier) schedule(item retryItem, err error) {
+	if item.attempt >= r.MaxAttempts {
+		r.fail(item, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.stopped:
+		log.Printf("dropping retry of %s block %d, shutting down: %v", r.chain, item.block, err)
+		return
+	default:
+	}
+
+	delay := r.backoff(item.attempt)
+	log.Printf("retrying %s block %d in %s (attempt %d/%d): %v", r.chain, item.block, delay, item.attempt+1, r.MaxAttempts, err)
+
+	next := retryItem{block: item.block, attempt: item.attempt + 1}
+	r.pending.Add(1)
+	r.timers[item.block] = time.AfterFunc(delay, func() {
+		defer r.pending.Done()
+
+		r.mu.Lock()
+		delete(r.timers, item.block)
+		r.mu.Unlock()
+
+		// the queue is bounded, it is not read anymore once Run returned
+		select {
+		case r.queue <- next:
+		case <-r.stopped:
+		}
+	})
+}
+
+// backoff returns the delay before the attempt following attempt, doubling
+// from BaseDelay up to MaxDelay, with jitter in [delay/2, delay].
+func (r *Retrier) backoff(attempt int) time.Duration {
+	delay := r.MaxDelay
+	if shift := attempt - 1; shift < 32 && r.BaseDelay<<shift < r.MaxDelay {
+		delay = r.BaseDelay << shift
+	}
+
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int64N(half+1))
+}
+
+func (r *Retrier) fail(item retryItem, err error) {
+	log.Printf("giving up on %s block %d after %d attempts: %v", r.chain, item.block, item.attempt, err)
+
+	PutDeadLetter(r.deadLetters, DeadLetter{
+		Kind:     DeadLetterBlock,
+		Chain:    r.chain,
+		Block:    item.block,
+		Reason:   err.Error(),
+		Attempts: item.attempt,
+	})
+
+	// The block is dead-lettered, do not hold back the checkpoint for it.
+	r.done(item.block)
+}
+
+// Run processes retries until ctx is done. Pending retries are then dropped:
+// their blocks are not done, so the checkpoint stays before them. Retries run
+// concurrently, a block committed in order may wait for an earlier one.
+// Run returns once the retries in flight are done, and is only called once.
+func (r *Retrier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer r.stop(&wg)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-r.queue:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := r.handle(ctx, item.block); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					r.schedule(item, err)
+					return
+				}
+				r.done(item.block)
+			}()
+		}
+	}
+}
+
+// stop drops the pending retries and waits for the ones in flight, retries
+// scheduled meanwhile are dropped too.
+func (r *Retrier) stop(inFlight *sync.WaitGroup) {
+	r.mu.Lock()
+	close(r.stopped)
+	dropped := len(r.queue)
+	for block, timer := range r.timers {
+		if timer.Stop() {
+			r.pending.Done()
+			dropped++
+		}
+		delete(r.timers, block)
+	}
+	r.mu.Unlock()
+
+	inFlight.Wait()
+	r.pending.Wait()
+	if dropped > 0 {
+		log.Printf("dropped %d pending %s retries, their blocks are processed again on restart", dropped, r.chain)
+	}
+}
@@ -1,9 +1,18 @@
 package solana
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
 	"github.com/blocto/solana-go-sdk/client"
 	"github.com/blocto/solana-go-sdk/rpc"
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -15,3 +24,101 @@ func CreateClient() *client.Client {
 
 	return client.New(rpc.WithEndpoint(rpcURL), rpc.WithHTTPClient(HTTPClient))
 }
+
+// SlotsClient subscribes to slots over the WebSocket endpoint of a node, each
+// subscription on its own connection, so that a dropped one is dialed again.
+type SlotsClient struct {
+	url string
+}
+
+// CreateSlotsClient returns a client of the WebSocket endpoint at url, e.g. wss://host/path.
+func CreateSlotsClient(url string) *SlotsClient {
+	return &SlotsClient{url: url}
+}
+
+// SubscribeSlots sends the slots processed by the node on ch, see slotSubscribe.
+func (c *SlotsClient) SubscribeSlots(ctx context.Context, ch chan<- SlotNotification) (Subscription, error) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+os.Getenv("BLOCKDAEMON_API_KEY"))
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.url, header)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", c.url, err)
+	}
+
+	if err := conn.WriteJSON(map[string]any{"jsonrpc": "2.0", "id": 1, "method": "slotSubscribe"}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("subscribing to slots: %w", err)
+	}
+	var res struct {
+		Result *uint64           `json:"result"`
+		Error  *rpc.JsonRpcError `json:"error"`
+	}
+	// the node answers with the subscription ID before notifying slots
+	conn.SetReadDeadline(time.Now().Add(chain.SolSlotTimeout))
+	err = conn.ReadJSON(&res)
+	switch {
+	case err != nil:
+	case res.Error != nil:
+		err = res.Error
+	case res.Result == nil:
+		err = errors.New("no subscription ID")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("subscribing to slots: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sub := &slotSubscription{conn: conn, err: make(chan error, 1), done: make(chan struct{})}
+	go sub.read(ch)
+	return sub, nil
+}
+
+// slotSubscription reads the slot notifications of its connection until unsubscribed.
+type slotSubscription struct {
+	conn *websocket.Conn
+	err  chan error
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (s *slotSubscription) read(ch chan<- SlotNotification) {
+	for {
+		var msg struct {
+			Method string `json:"method"`
+			Params struct {
+				Result SlotNotification `json:"result"`
+			} `json:"params"`
+		}
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			select {
+			case s.err <- err:
+			case <-s.done:
+			}
+			return
+		}
+		if msg.Method != "slotNotification" {
+			continue
+		}
+
+		select {
+		case ch <- msg.Params.Result:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *slotSubscription) Err() <-chan error {
+	return s.err
+}
+
+// Unsubscribe closes the connection, which ends the subscription on the node.
+func (s *slotSubscription) Unsubscribe() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
@@ -0,0 +1,191 @@
+package solana
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/blocto/solana-go-sdk/client"
+	"github.com/blocto/solana-go-sdk/common"
+	"github.com/blocto/solana-go-sdk/rpc"
+	"github.com/blocto/solana-go-sdk/types"
+)
+
+const (
+	// System Program instruction discriminant (u32).
+	systemTransfer = 2
+
+	// SPL Token and Token-2022 instruction discriminants (u8).
+	tokenTransfer        = 3
+	tokenTransferChecked = 12
+)
+
+// transfer is a decoded System Program or SPL Token transfer instruction.
+type transfer struct {
+	source      string
+	destination string
+	amount      *big.Int
+
+	// Only set for SPL token transfers.
+	mint     string
+	decimals *uint8
+}
+
+// tokenAccount is a token account as reported by the transaction token balances.
+type tokenAccount struct {
+	owner    string
+	mint     string
+	decimals uint8
+}
+
+// tokenAccounts maps the account index of every token account touched by a
+// transaction to its owner wallet and mint.
+func tokenAccounts(meta *client.TransactionMeta) map[uint64]tokenAccount {
+	accounts := map[uint64]tokenAccount{}
+	for _, balances := range [][]rpc.TransactionMetaTokenBalance{meta.PreTokenBalances, meta.PostTokenBalances} {
+		for _, b := range balances {
+			accounts[b.AccountIndex] = tokenAccount{
+				owner:    b.Owner,
+				mint:     b.Mint,
+				decimals: b.UITokenAmount.Decimals,
+			}
+		}
+	}
+	return accounts
+}
+
+// accountKeys returns the account list instructions index into. For v0
+// transactions, it is the static keys followed by the writable then readonly
+// addresses loaded from address lookup tables.
+func accountKeys(tx client.BlockTransaction) []common.PublicKey {
+	loaded := tx.Meta.LoadedAddresses
+	if len(tx.AccountKeys) >= len(tx.Transaction.Message.Accounts)+len(loaded.Writable)+len(loaded.Readonly) {
+		return tx.AccountKeys
+	}
+
+	keys := make([]common.PublicKey, 0, len(tx.Transaction.Message.Accounts)+len(loaded.Writable)+len(loaded.Readonly))
+	keys = append(keys, tx.Transaction.Message.Accounts...)
+	for _, addr := range loaded.Writable {
+		keys = append(keys, common.PublicKeyFromString(addr))
+	}
+	for _, addr := range loaded.Readonly {
+		keys = append(keys, common.PublicKeyFromString(addr))
+	}
+	return keys
+}
+
+// inRange reports whether every account index of inst resolves to a key.
+func inRange(keys []common.PublicKey, inst types.CompiledInstruction) bool {
+	if inst.ProgramIDIndex < 0 || inst.ProgramIDIndex >= len(keys) {
+		return false
+	}
+	for _, i := range inst.Accounts {
+		if i < 0 || i >= len(keys) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeTransfer decodes inst if it is a native SOL or SPL token transfer.
+func decodeTransfer(keys []common.PublicKey, accounts map[uint64]tokenAccount, inst types.CompiledInstruction) (transfer, bool) {
+	if !inRange(keys, inst) {
+		return transfer{}, false
+	}
+
+	switch keys[inst.ProgramIDIndex] {
+	case common.SystemProgramID:
+		return decodeSystemTransfer(keys, inst)
+	case common.TokenProgramID, common.Token2022ProgramID:
+		return decodeTokenTransfer(keys, accounts, inst)
+	default:
+		return transfer{}, false
+	}
+}
+
+// decodeSystemTransfer decodes a System Program Transfer: u32 discriminant, u64 lamports.
+// Accounts are [from, to].
+func decodeSystemTransfer(keys []common.PublicKey, inst types.CompiledInstruction) (transfer, bool) {
+	if len(inst.Data) < 12 || len(inst.Accounts) < 2 {
+		return transfer{}, false
+	}
+	if binary.LittleEndian.Uint32(inst.Data[:4]) != systemTransfer {
+		return transfer{}, false
+	}
+
+	return transfer{
+		source:      keys[inst.Accounts[0]].String(),
+		destination: keys[inst.Accounts[1]].String(),
+		amount:      new(big.Int).SetUint64(binary.LittleEndian.Uint64(inst.Data[4:12])),
+	}, true
+}
+
+// decodeTokenTransfer decodes an SPL Token Transfer or TransferChecked.
+// Transfer is u8 discriminant, u64 amount with accounts [source, destination, authority].
+// TransferChecked appends u8 decimals with accounts [source, mint, destination, authority].
+// Token accounts are mapped back to their owner wallet.
+func decodeTokenTransfer(keys []common.PublicKey, accounts map[uint64]tokenAccount, inst types.CompiledInstruction) (transfer, bool) {
+	if len(inst.Data) < 9 {
+		return transfer{}, false
+	}
+
+	var src, dst, authority int
+	var mint string
+	var decimals *uint8
+
+	switch inst.Data[0] {
+	case tokenTransfer:
+		if len(inst.Accounts) < 3 {
+			return transfer{}, false
+		}
+		src, dst, authority = inst.Accounts[0], inst.Accounts[1], inst.Accounts[2]
+	case tokenTransferChecked:
+		if len(inst.Data) < 10 || len(inst.Accounts) < 4 {
+			return transfer{}, false
+		}
+		src, dst, authority = inst.Accounts[0], inst.Accounts[2], inst.Accounts[3]
+		mint = keys[inst.Accounts[1]].String()
+		d := inst.Data[9]
+		decimals = &d
+	default:
+		return transfer{}, false
+	}
+
+	source, sourceOK := accounts[uint64(src)]
+	destination, destinationOK := accounts[uint64(dst)]
+
+	if mint == "" {
+		switch {
+		case sourceOK:
+			mint = source.mint
+		case destinationOK:
+			mint = destination.mint
+		default:
+			// Without token balances we cannot tell which token moved.
+			return transfer{}, false
+		}
+	}
+	if decimals == nil {
+		d := source.decimals
+		if !sourceOK {
+			d = destination.decimals
+		}
+		decimals = &d
+	}
+
+	t := transfer{
+		// The authority is the owner unless a delegate signed the transfer.
+		source:      keys[authority].String(),
+		destination: keys[dst].String(),
+		amount:      new(big.Int).SetUint64(binary.LittleEndian.Uint64(inst.Data[1:9])),
+		mint:        mint,
+		decimals:    decimals,
+	}
+	if sourceOK && source.owner != "" {
+		t.source = source.owner
+	}
+	if destinationOK && destination.owner != "" {
+		t.destination = destination.owner
+	}
+
+	return t, true
+}
@@ -0,0 +1,422 @@
+package solana
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/blocto/solana-go-sdk/client"
+	"github.com/blocto/solana-go-sdk/common"
+	"github.com/blocto/solana-go-sdk/rpc"
+)
+
+// signaturesPageLimit is the most signatures getSignaturesForAddress returns at once.
+const signaturesPageLimit = 1000
+
+// Strategy selects how the transactions of the watched addresses are found.
+type Strategy string
+
+const (
+	// StrategyAuto follows the addresses while there are at most SolAddressStrategyMax of them.
+	StrategyAuto Strategy = "auto"
+	// StrategyBlock fetches every block.
+	StrategyBlock Strategy = "block"
+	// StrategyAddress fetches the signatures of each address, then their transactions only.
+	StrategyAddress Strategy = "address"
+)
+
+// LoadStrategy returns the strategy of SOLANA_STRATEGY, auto by default.
+func LoadStrategy() (Strategy, error) {
+	switch strategy := Strategy(os.Getenv("SOLANA_STRATEGY")); strategy {
+	case "":
+		return StrategyAuto, nil
+	case StrategyAuto, StrategyBlock, StrategyAddress:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid SOLANA_STRATEGY %q, expected auto, block or address", strategy)
+	}
+}
+
+// tokenPrograms are the programs owning the token accounts of a wallet.
+var tokenPrograms = []common.PublicKey{common.TokenProgramID, common.Token2022ProgramID}
+
+// SignatureClient finds the transactions of an address without fetching blocks.
+type SignatureClient interface {
+	GetSignaturesForAddressWithConfig(ctx context.Context, addr string,
+		cfg client.GetSignaturesForAddressConfig) (rpc.GetSignaturesForAddress, error)
+	GetTransactionWithConfig(ctx context.Context, txhash string, cfg client.GetTransactionConfig) (*client.Transaction, error)
+	GetTokenAccountsByOwnerByProgram(ctx context.Context, owner, programId string) ([]client.TokenAccount, error)
+}
+
+// signatureIndex holds the signatures of the watched addresses per slot, until
+// their slot is handled. Slots are indexed range by range, from the newest
+// signature indexed for each address. Only one goroutine indexes slots.
+//
+// The transfers to a token account of a wallet do not list the wallet, so the
+// signatures of its token accounts are indexed too.
+type signatureIndex struct {
+	commitment rpc.Commitment
+
+	// addresses are the watched addresses the slots were indexed for.
+	addresses []string
+	// lastSeen is the newest signature indexed per address or token account.
+	lastSeen map[string]string
+	// cursors are the last signatures of the pages after the indexed slots per
+	// address or token account, the newest first. The next ranges are fetched
+	// from them rather than from the newest signature.
+	cursors map[string][]rpc.SignatureWithStatus
+	// tokenAccounts are the token accounts of each watched wallet.
+	tokenAccounts map[string]ownedAccounts
+
+	mu    sync.Mutex
+	slots map[uint64][]string
+	// next is the slot after the last indexed one.
+	next uint64
+}
+
+func newSignatureIndex(commitment rpc.Commitment) *signatureIndex {
+	return &signatureIndex{
+		commitment:    commitment,
+		lastSeen:      map[string]string{},
+		cursors:       map[string][]rpc.SignatureWithStatus{},
+		tokenAccounts: map[string]ownedAccounts{},
+		slots:         map[uint64][]string{},
+	}
+}
+
+// ownedAccounts are the token accounts of a wallet at some point.
+type ownedAccounts struct {
+	accounts []string
+	fetched  time.Time
+}
+
+// index fetches the signatures of addresses and of their token accounts in
+// the slots from to to. A transaction of several addresses is only indexed once.
+func (x *signatureIndex) index(ctx context.Context, c SignatureClient, addresses []string, from, to uint64) error {
+	found := map[uint64][]string{}
+	indexed := map[string]bool{}
+	lastSeen := map[string]string{}
+	cursors := map[string][]rpc.SignatureWithStatus{}
+	tokenAccounts := map[string]ownedAccounts{}
+
+	// add indexes the signatures of address and reports whether it has new ones
+	add := func(address string) (bool, error) {
+		fetched, err := x.signatures(ctx, c, address, from, to)
+		if err != nil {
+			return false, fmt.Errorf("getting solana signatures of %s: %w", address, err)
+		}
+
+		lastSeen[address] = x.lastSeen[address]
+		if fetched.newest != "" {
+			lastSeen[address] = fetched.newest
+		}
+		if len(fetched.cursors) != 0 {
+			cursors[address] = fetched.cursors
+		}
+
+		// signatures are the newest first, and transactions handled in the order of their slot
+		for _, signature := range slices.Backward(fetched.signatures) {
+			if !indexed[signature.Signature] {
+				indexed[signature.Signature] = true
+				found[signature.Slot] = append(found[signature.Slot], signature.Signature)
+			}
+		}
+		return fetched.newest != "", nil
+	}
+
+	for _, address := range addresses {
+		active, err := add(address)
+		if err != nil {
+			return err
+		}
+
+		// a token account is created by a transaction of its wallet, fetched again then
+		accounts, ok := x.tokenAccounts[address]
+		if !ok || active || time.Since(accounts.fetched) > chain.SolTokenAccountsRefresh {
+			if accounts, err = x.fetchTokenAccounts(ctx, c, address); err != nil {
+				return err
+			}
+		}
+		tokenAccounts[address] = accounts
+
+		for _, account := range accounts.accounts {
+			if _, err := add(account); err != nil {
+				return err
+			}
+		}
+	}
+
+	x.addresses = slices.Clone(addresses)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for slot := from; slot <= to; slot++ {
+		x.slots[slot] = found[slot]
+	}
+	x.next = to + 1
+	// the addresses no longer watched, and the closed token accounts, are forgotten
+	x.lastSeen = lastSeen
+	x.cursors = cursors
+	x.tokenAccounts = tokenAccounts
+	return nil
+}
+
+// fetchTokenAccounts returns the token accounts owned by wallet, of every token program.
+func (x *signatureIndex) fetchTokenAccounts(ctx context.Context, c SignatureClient, wallet string) (ownedAccounts, error) {
+	accounts := ownedAccounts{fetched: time.Now()}
+	for _, program := range tokenPrograms {
+		owned, err := c.GetTokenAccountsByOwnerByProgram(ctx, wallet, program.ToBase58())
+		if err != nil {
+			return ownedAccounts{}, fmt.Errorf("getting solana token accounts of %s: %w", wallet, err)
+		}
+		for _, account := range owned {
+			accounts.accounts = append(accounts.accounts, account.PublicKey.ToBase58())
+		}
+	}
+	return accounts, nil
+}
+
+// fetchedSignatures are the signatures of an address in a range of slots.
+type fetchedSignatures struct {
+	// signatures are those of the successful transactions, the newest first.
+	signatures []rpc.SignatureWithStatus
+	// newest is the newest signature of any transaction, empty when there is none.
+	newest string
+	// cursors are the page cursors left after the range, the newest first.
+	cursors []rpc.SignatureWithStatus
+}
+
+// signatures returns the signatures of address in the slots from to to. The
+// pages are fetched from the oldest cursor after to, so that catching up range
+// by range does not fetch the newer signatures again for each range. Without
+// one, they are fetched from the newest signature and the cursors recorded.
+func (x *signatureIndex) signatures(ctx context.Context, c SignatureClient, address string,
+	from, to uint64) (fetchedSignatures, error) {
+	var fetched fetchedSignatures
+	before := ""
+	for _, cursor := range x.cursors[address] {
+		if cursor.Slot <= to {
+			break
+		}
+		before = cursor.Signature
+		fetched.cursors = append(fetched.cursors, cursor)
+	}
+	fromNewest := before == ""
+
+	for {
+		page, err := c.GetSignaturesForAddressWithConfig(ctx, address, client.GetSignaturesForAddressConfig{
+			Limit:      signaturesPageLimit,
+			Before:     before,
+			Until:      x.lastSeen[address],
+			Commitment: x.commitment,
+		})
+		if err != nil {
+			return fetchedSignatures{}, err
+		}
+
+		for _, signature := range page {
+			// the slots after to are indexed with the next range
+			if signature.Slot > to {
+				continue
+			}
+			if signature.Slot < from {
+				return fetched, nil
+			}
+			if fetched.newest == "" {
+				fetched.newest = signature.Signature
+			}
+			if signature.Err == nil {
+				fetched.signatures = append(fetched.signatures, signature)
+			}
+		}
+
+		if len(page) < signaturesPageLimit {
+			return fetched, nil
+		}
+		last := page[len(page)-1]
+		before = last.Signature
+		if fromNewest && last.Slot > to {
+			fetched.cursors = append(fetched.cursors, last)
+		}
+	}
+}
+
+// covers reports whether slot was indexed. A nil index covers no slot.
+func (x *signatureIndex) covers(slot uint64) bool {
+	if x == nil {
+		return false
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return slot < x.next
+}
+
+// get returns the signatures of slot, ok is false when it is not indexed.
+func (x *signatureIndex) get(slot uint64) (signatures []string, ok bool) {
+	if x == nil {
+		return nil, false
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	signatures, ok = x.slots[slot]
+	return signatures, ok
+}
+
+// forget drops the signatures of slot, once it is handled.
+func (x *signatureIndex) forget(slot uint64) {
+	if x == nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.slots, slot)
+}
+
+// forgetFrom drops the signatures of slot and of the slots after it, which are
+// indexed again from slot, without the newest signatures seen after it.
+func (x *signatureIndex) forgetFrom(slot uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for indexed := range x.slots {
+		if indexed >= slot {
+			delete(x.slots, indexed)
+		}
+	}
+	x.next = min(x.next, slot)
+	x.lastSeen = map[string]string{}
+}
+
+// forgetBefore drops the signatures of the slots before slot, which will not be handled.
+func (x *signatureIndex) forgetBefore(slot uint64) {
+	if x == nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for indexed := range x.slots {
+		if indexed < slot {
+			delete(x.slots, indexed)
+		}
+	}
+}
+
+// byAddress reports whether the transactions are found from the signatures of
+// the watched addresses rather than from full blocks.
+func (s *SolanaWatcher) byAddress() bool {
+	if _, ok := s.Client.(SignatureClient); !ok {
+		return false
+	}
+
+	switch s.Strategy {
+	case StrategyBlock:
+		return false
+	case StrategyAddress:
+		return true
+	default:
+		return len(s.Addresses()) <= chain.SolAddressStrategyMax
+	}
+}
+
+// indexSignatures indexes the signatures from slot up to last at most, unless
+// slot is indexed already for the current watchlist or full blocks are fetched. It reports whether slot
+// can be handled, after waiting a bit when the signatures could not be fetched.
+func (s *SolanaWatcher) indexSignatures(ctx context.Context, index *signatureIndex, slot, last uint64) bool {
+	if index == nil {
+		return true
+	}
+	if index.covers(slot) {
+		// the slots indexed ahead miss the addresses added since
+		if slices.Equal(index.addresses, s.Addresses()) {
+			return true
+		}
+		index.forgetFrom(slot)
+	}
+	if !s.byAddress() {
+		return true
+	}
+
+	to := min(last, slot+chain.SolSignaturesRange-1)
+	if err := index.index(ctx, s.Client.(SignatureClient), s.Addresses(), slot, to); err != nil {
+		log.Printf("error indexing solana signatures of slots %d to %d: %v", slot, to, err)
+		chain.Sleep(ctx, chain.UpdateSlotTicker)
+		return false
+	}
+	return true
+}
+
+// GetSignedTxs returns the transactions of signatures, fetching up to
+// SolTransactionWorkers of them at once.
+func (s *SolanaWatcher) GetSignedTxs(ctx context.Context, signatures []string,
+	commitment rpc.Commitment) ([]client.BlockTransaction, error) {
+	c, ok := s.Client.(SignatureClient)
+	if !ok {
+		return nil, fmt.Errorf("solana client cannot get transactions by signature")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	txs := make([]client.BlockTransaction, len(signatures))
+	errs := make([]error, len(signatures))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(chain.SolTransactionWorkers, len(signatures)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if txs[i], errs[i] = getSignedTx(ctx, c, signatures[i], commitment); errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+
+send:
+	for i := range signatures {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+// getSignedTx returns the transaction of signature.
+func getSignedTx(ctx context.Context, c SignatureClient, signature string,
+	commitment rpc.Commitment) (client.BlockTransaction, error) {
+	tx, err := c.GetTransactionWithConfig(ctx, signature, client.GetTransactionConfig{Commitment: commitment})
+	if err != nil {
+		return client.BlockTransaction{}, fmt.Errorf("getting transaction %s: %w", signature, err)
+	}
+	if tx == nil {
+		return client.BlockTransaction{}, fmt.Errorf("transaction %s not found", signature)
+	}
+	return client.BlockTransaction{Meta: tx.Meta, Transaction: tx.Transaction, AccountKeys: tx.AccountKeys}, nil
+}
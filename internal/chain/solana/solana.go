@@ -2,51 +2,111 @@ package solana
 
 import (
 	"context"
-	"encoding/binary"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math/big"
-	"os"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
 	"github.com/blocto/solana-go-sdk/client"
 	"github.com/blocto/solana-go-sdk/common"
+	"github.com/blocto/solana-go-sdk/rpc"
+	"github.com/blocto/solana-go-sdk/types"
 	"github.com/mr-tron/base58"
 	"github.com/segmentio/kafka-go"
 )
 
+// JSON-RPC error codes returned by getBlock for slots without a block.
+const (
+	slotSkippedCode                = -32007
+	longTermStorageSlotSkippedCode = -32009
+)
+
 type SolanaWatcher struct {
 	Client SolClient
 
 	CurrentSlot uint64
-	MaxSlot     uint64
+	// MaxSlot is the last final slot, equal to TipSlot when finality is disabled.
+	MaxSlot uint64
+	TipSlot uint64
 
 	KafkaChan chan<- kafka.Message
+
+	Finality chain.Finality
+	Progress *chain.Progress
+	Retrier  *chain.Retrier
+
+	DeadLetters chain.DeadLetterQueue
+	// Transactor, when set, publishes each block with its checkpoint exactly once.
+	Transactor chain.Transactor
+	// Keys selects the Kafka message key of events.
+	Keys chain.KeyStrategy
+	// Registry, when set, maps watched addresses to their user.
+	Registry chain.Registry
+	// Slots, when set, notifies the new slots, which are otherwise polled.
+	Slots SlotSubscriber
+	// Strategy selects whether full blocks or the transactions of each address are fetched.
+	Strategy Strategy
+
+	// watchlist, when set, replaces the configured addresses, to backfill a single one.
+	watchlist *chain.AddressIndex
+	// signatures and seenSignatures, when set, index the transactions of the
+	// watched addresses for the final slots and for the ones between them and the tip.
+	signatures     *signatureIndex
+	seenSignatures *signatureIndex
 }
 
 type SolClient interface {
-	GetSlot(ctx context.Context) (uint64, error)
+	GetSlotWithConfig(ctx context.Context, cfg client.GetSlotConfig) (uint64, error)
 	GetBlockWithConfig(ctx context.Context, slot uint64, cfg client.GetBlockConfig) (*client.Block, error)
 }
 
-func NewSolanaWatcher(client SolClient, kafkaChan chan<- kafka.Message) *SolanaWatcher {
+// SlotSubscriber subscribes to the slots processed by a node, such as slotSubscribe.
+type SlotSubscriber interface {
+	SubscribeSlots(ctx context.Context, ch chan<- SlotNotification) (Subscription, error)
+}
+
+// SlotNotification is a slot processed by the node, with its parent and the last rooted slot.
+type SlotNotification struct {
+	Slot   uint64 `json:"slot"`
+	Parent uint64 `json:"parent"`
+	Root   uint64 `json:"root"`
+}
+
+// Subscription is a subscription to notifications, Err reports its failure.
+type Subscription interface {
+	Err() <-chan error
+	Unsubscribe()
+}
+
+func NewSolanaWatcher(client SolClient, kafkaChan chan<- kafka.Message, checkpointer chain.Checkpointer,
+	finality chain.Finality, deadLetters chain.DeadLetterQueue) *SolanaWatcher {
 	s := &SolanaWatcher{
-		Client:    client,
-		KafkaChan: kafkaChan,
+		Client:      client,
+		KafkaChan:   kafkaChan,
+		Finality:    finality,
+		DeadLetters: deadLetters,
 	}
 
-	maxSlot, err := s.GetMaxSlot()
+	tipSlot, maxSlot, err := s.GetMaxSlots(context.Background())
 	for err != nil {
 		log.Printf("error getting solana max slot: %v. Retrying...\n", err)
 		time.Sleep(time.Second)
-		maxSlot, err = s.GetMaxSlot()
+		tipSlot, maxSlot, err = s.GetMaxSlots(context.Background())
 	}
 
-	atomic.StoreUint64(&s.CurrentSlot, maxSlot)
+	currentSlot := chain.ResumeFrom(chain.SolanaName, checkpointer, maxSlot)
+
+	atomic.StoreUint64(&s.CurrentSlot, currentSlot)
 	atomic.StoreUint64(&s.MaxSlot, maxSlot)
+	atomic.StoreUint64(&s.TipSlot, tipSlot)
+	s.Progress = chain.NewProgress(chain.SolanaName, checkpointer, currentSlot)
+	s.Retrier = chain.NewRetrier(chain.SolanaName, s.handleSlot, s.slotDone, deadLetters)
+	s.signatures = newSignatureIndex(s.commitment())
+	s.seenSignatures = newSignatureIndex(rpc.CommitmentConfirmed)
 
 	return s
 }
@@ -56,42 +116,183 @@ func (s *SolanaWatcher) Name() chain.Chain {
 }
 
 func (s *SolanaWatcher) Addresses() []string {
-	env := os.Getenv("SOLANA_ADDRESSES")
-	if env == "" {
-		return []string{}
+	if s.watchlist != nil {
+		return s.watchlist.Addresses()
 	}
-	return strings.Split(env, ",")
+	return chain.Watchlist(chain.SolanaName, "SOLANA_ADDRESSES", s.Registry)
+}
+
+// watched returns the matcher of the watched addresses, to take once per block.
+func (s *SolanaWatcher) watched() chain.AddressMatcher {
+	if s.watchlist != nil {
+		return s.watchlist
+	}
+	return chain.Watching(chain.SolanaName, "SOLANA_ADDRESSES", s.Registry)
+}
+
+// commitment returns the commitment of the slots handled by the main pipeline.
+func (s *SolanaWatcher) commitment() rpc.Commitment {
+	return rpc.Commitment(s.Finality.Tag)
 }
 
-func (s *SolanaWatcher) GetMaxSlot() (uint64, error) {
-	slot, err := s.Client.GetSlot(context.Background())
+// GetMaxSlots returns the tip and the last final slot according to the watcher finality.
+// The tip is the last confirmed slot, since blocks cannot be fetched at the processed commitment.
+func (s *SolanaWatcher) GetMaxSlots(ctx context.Context) (uint64, uint64, error) {
+	slot, err := s.Client.GetSlotWithConfig(ctx, client.GetSlotConfig{
+		Commitment: s.commitment(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	final := slot - min(s.Finality.Depth, slot)
+
+	if !s.Finality.Enabled() {
+		return final, final, nil
+	}
+
+	tip, err := s.Client.GetSlotWithConfig(ctx, client.GetSlotConfig{
+		Commitment: rpc.CommitmentConfirmed,
+	})
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return slot, nil
+
+	return max(tip, final), final, nil
 }
 
-func (s *SolanaWatcher) UpdateMaxSlot() {
+// UpdateMaxSlot follows the slots of the chain. With Slots, max slots are
+// advanced from the notified slots, polled every SolSlotResync to resync them,
+// and polled every UpdateSlotTicker while the subscription is down until it is
+// subscribed again.
+func (s *SolanaWatcher) UpdateMaxSlot(ctx context.Context) {
 	ticker := time.NewTicker(chain.UpdateSlotTicker)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		maxSlot, err := s.GetMaxSlot()
-		if err != nil {
-			log.Printf("error getting current solana slot: %v", err)
-			continue
+	var (
+		sub          Subscription
+		subErr       <-chan error
+		lastNotified time.Time
+		lastPolled   time.Time
+		// lastSlot is the last notified slot, to detect the missed notifications
+		lastSlot uint64
+		// resubscribe fires when a subscription is due, never without Slots
+		resubscribe <-chan time.Time
+	)
+	notifications := make(chan SlotNotification)
+	if s.Slots != nil {
+		resubscribe = time.After(0)
+	}
+
+	drop := func(reason string) {
+		log.Printf("solana slot subscription dropped: %s. Polling until resubscribing in %s",
+			reason, chain.SolResubscribeDelay)
+		sub.Unsubscribe()
+		sub, subErr = nil, nil
+		resubscribe = time.After(chain.SolResubscribeDelay)
+	}
+	defer func() {
+		if sub != nil {
+			sub.Unsubscribe()
 		}
-		atomic.StoreUint64(&s.MaxSlot, maxSlot)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-resubscribe:
+			su, err := s.Slots.SubscribeSlots(ctx, notifications)
+			if err != nil {
+				log.Printf("error subscribing to solana slots: %v. Polling until resubscribing in %s",
+					err, chain.SolResubscribeDelay)
+				resubscribe = time.After(chain.SolResubscribeDelay)
+				continue
+			}
+			sub, subErr, lastNotified, lastSlot, resubscribe = su, su.Err(), time.Now(), 0, nil
+			log.Printf("Subscribed to solana slots")
+			// catch up with the slots processed since the last poll
+			s.pollMaxSlot(ctx)
+			lastPolled = time.Now()
+
+		case err := <-subErr:
+			drop(fmt.Sprint(err))
+
+		case n := <-notifications:
+			lastNotified = time.Now()
+			if lastSlot != 0 && n.Parent > lastSlot {
+				log.Printf("Missed solana slot notifications %d to %d", lastSlot+1, n.Parent)
+			}
+			lastSlot = max(lastSlot, n.Slot)
+			s.setMaxSlot(s.notifiedSlots(n))
+
+		case <-ticker.C:
+			switch {
+			case sub == nil:
+				s.pollMaxSlot(ctx)
+			case time.Since(lastNotified) > chain.SolSlotTimeout:
+				drop(fmt.Sprintf("no slot for %s", chain.SolSlotTimeout))
+				s.pollMaxSlot(ctx)
+			case time.Since(lastPolled) > chain.SolSlotResync:
+				s.pollMaxSlot(ctx)
+				lastPolled = time.Now()
+			}
+		}
+	}
+}
+
+// notifiedSlots returns the tip and the last final slot according to the
+// watcher finality once n is notified. The notified slot is only processed, so
+// it is assumed to be confirmed SolConfirmationLag slots later, and its root
+// is final.
+func (s *SolanaWatcher) notifiedSlots(n SlotNotification) (uint64, uint64) {
+	confirmed := n.Slot - min(chain.SolConfirmationLag, n.Slot)
+	slot := n.Root
+	if s.commitment() == rpc.CommitmentConfirmed {
+		slot = confirmed
+	}
+	final := slot - min(s.Finality.Depth, slot)
+
+	if !s.Finality.Enabled() {
+		return final, final
+	}
+	return max(confirmed, final), final
+}
+
+// pollMaxSlot updates the tip and the last final slot.
+func (s *SolanaWatcher) pollMaxSlot(ctx context.Context) {
+	tipSlot, maxSlot, err := s.GetMaxSlots(ctx)
+	if err != nil {
+		log.Printf("error getting current solana slot: %v", err)
+		return
+	}
+	s.setMaxSlot(tipSlot, maxSlot)
+
+	current := atomic.LoadUint64(&s.CurrentSlot)
+	log.Printf("Solana slot lag: %d", maxSlot-min(current, maxSlot))
+}
 
-		current := atomic.LoadUint64(&s.CurrentSlot)
-		log.Printf("Solana slot lag: %d", maxSlot-current)
+// setMaxSlot moves the tip and the last final slot forward, they never go back
+// since notifications and polls may be answered by different nodes.
+func (s *SolanaWatcher) setMaxSlot(tipSlot, maxSlot uint64) {
+	if maxSlot > atomic.LoadUint64(&s.MaxSlot) {
+		atomic.StoreUint64(&s.MaxSlot, maxSlot)
+	}
+	if tipSlot > atomic.LoadUint64(&s.TipSlot) {
+		atomic.StoreUint64(&s.TipSlot, tipSlot)
 	}
 }
 
-func (s *SolanaWatcher) GetTxs(slot uint64) ([]client.BlockTransaction, error) {
-	block, err := s.Client.GetBlockWithConfig(context.Background(), slot, client.GetBlockConfig{
+// GetTxs returns the transactions of a slot. The client requests blocks with
+// maxSupportedTransactionVersion 0 so that v0 transactions are returned too.
+func (s *SolanaWatcher) GetTxs(ctx context.Context, slot uint64, commitment rpc.Commitment) ([]client.BlockTransaction, error) {
+	block, err := s.Client.GetBlockWithConfig(ctx, slot, client.GetBlockConfig{
+		Commitment:         commitment,
 		TransactionDetails: "full",
 	})
+	if isSkippedSlot(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -101,42 +302,29 @@ func (s *SolanaWatcher) GetTxs(slot uint64) ([]client.BlockTransaction, error) {
 
 func (s *SolanaWatcher) FilterTxs(txs []client.BlockTransaction) []chain.Transaction {
 	filtered := []chain.Transaction{}
+	watched := s.watched()
 
 	for _, tx := range txs {
 		if tx.Meta == nil || tx.Meta.Err != nil {
 			continue
 		}
 
-		for _, inst := range tx.Transaction.Message.Instructions {
-			if tx.AccountKeys[inst.ProgramIDIndex] != common.SystemProgramID {
-				continue
-			}
-			if len(inst.Data) < 12 {
-				continue
-			}
-			if binary.LittleEndian.Uint32(inst.Data[:4]) != 2 {
-				continue
-			}
+		fee := new(big.Int).SetUint64(tx.Meta.Fee)
+		keys := accountKeys(tx)
+		accounts := tokenAccounts(tx.Meta)
 
-			amount := new(big.Int).SetUint64(binary.LittleEndian.Uint64(inst.Data[4:12]))
-			fee := new(big.Int).SetUint64(tx.Meta.Fee)
-
-			source := tx.AccountKeys[inst.Accounts[0]].String()
-			destination := tx.AccountKeys[inst.Accounts[1]].String()
-
-			for _, addr := range s.Addresses() {
-				if source == addr || destination == addr {
-					filtered = append(filtered, chain.Transaction{
-						Chain:       chain.SolanaName,
-						ID:          base58.Encode(tx.Transaction.Signatures[0]),
-						User:        addr,
-						Source:      source,
-						Destination: destination,
-						Amount:      amount,
-						Fee:         fee,
-					})
-					break
-				}
+		// Transfers performed by programs through cross-program invocation,
+		// grouped by the top-level instruction that triggered them.
+		inner := map[int][]types.CompiledInstruction{}
+		for _, ii := range tx.Meta.InnerInstructions {
+			inner[int(ii.Index)] = append(inner[int(ii.Index)], ii.Instructions...)
+		}
+
+		for i, inst := range tx.Transaction.Message.Instructions {
+			filtered = append(filtered, s.filterInstruction(watched, tx, keys, accounts, inst, i, nil, fee)...)
+
+			for j, innerInst := range inner[i] {
+				filtered = append(filtered, s.filterInstruction(watched, tx, keys, accounts, innerInst, i, &j, fee)...)
 			}
 		}
 	}
@@ -144,53 +332,247 @@ func (s *SolanaWatcher) FilterTxs(txs []client.BlockTransaction) []chain.Transac
 	return filtered
 }
 
-func (s *SolanaWatcher) startWorkerPool(slots <-chan uint64, workers int) {
+// filterInstruction returns the transaction events for inst if it is a
+// transfer involving addresses matched by watched, one for each of them. index is the top-level instruction
+// index, and innerIndex the position of inst among its inner instructions if
+// it is one.
+func (s *SolanaWatcher) filterInstruction(watched chain.AddressMatcher, tx client.BlockTransaction,
+	keys []common.PublicKey, accounts map[uint64]tokenAccount, inst types.CompiledInstruction, index int,
+	innerIndex *int, fee *big.Int) []chain.Transaction {
+	t, ok := decodeTransfer(keys, accounts, inst)
+	if !ok {
+		return nil
+	}
+
+	inputs := []chain.Transfer{{Address: t.source, Amount: t.amount}}
+	outputs := []chain.Transfer{{Address: t.destination, Amount: t.amount}}
+
+	var events []chain.Transaction
+	for _, addr := range chain.Parties(t.source, t.destination) {
+		if watched.Contains(addr) {
+			owner := chain.Owner(s.Registry, chain.SolanaName, addr)
+			events = append(events, chain.Transaction{
+				Chain:            chain.SolanaName,
+				ID:               base58.Encode(tx.Transaction.Signatures[0]),
+				User:             owner.User,
+				Labels:           owner.Labels,
+				Address:          addr,
+				Source:           t.source,
+				Destination:      t.destination,
+				Direction:        chain.TransferDirection(addr, t.source, t.destination),
+				Amount:           t.amount,
+				Fee:              fee,
+				Token:            t.mint,
+				Decimals:         t.decimals,
+				InstructionIndex: &index,
+				InnerIndex:       innerIndex,
+				Inputs:           inputs,
+				Outputs:          outputs,
+				NetAmount:        chain.NetAmount(addr, inputs, outputs),
+			})
+		}
+	}
+
+	return events
+}
+
+// startWorkerPool handles slots until the channel is closed. Slots in flight
+// are not interrupted by ctx being done, so that they are finished on shutdown.
+func (s *SolanaWatcher) startWorkerPool(ctx context.Context, slots <-chan uint64, workers int) *sync.WaitGroup {
+	ctx = context.WithoutCancel(ctx)
+
+	var wg sync.WaitGroup
 	for range workers {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for slot := range slots {
-				s.handleSlot(slot)
+				if err := s.handleSlot(ctx, slot); err != nil {
+					s.Retrier.Retry(slot, err)
+					continue
+				}
+				s.Progress.Done(slot)
 			}
 		}()
 	}
+	return &wg
 }
 
-func (s *SolanaWatcher) handleSlot(slot uint64) {
-	txs, err := s.GetTxs(slot)
+// handleSlot processes a slot and returns once its events are published.
+func (s *SolanaWatcher) handleSlot(ctx context.Context, slot uint64) error {
+	err := chain.Publish(ctx, chain.SolanaName, slot, s.KafkaChan, s.Transactor, s.Progress,
+		func(send func(kafka.Message)) error {
+			return s.processSlot(ctx, slot, s.signatures, s.commitment(), s.Finality.Status(), send)
+		})
 	if err != nil {
-		log.Printf("error getting solana transactions for slot %d: %v\n", slot, err)
-		return
+		return err
+	}
+	s.signatures.forget(slot)
+	return nil
+}
+
+// slotDone marks slot as done once retried, or dead-lettered, and drops its signatures.
+func (s *SolanaWatcher) slotDone(slot uint64) {
+	s.signatures.forget(slot)
+	s.Progress.Done(slot)
+}
+
+func (s *SolanaWatcher) Reprocess(ctx context.Context, slot uint64) error {
+	return s.handleSlot(ctx, slot)
+}
+
+// NextBlock returns the next slot to schedule.
+func (s *SolanaWatcher) NextBlock() uint64 {
+	return atomic.LoadUint64(&s.CurrentSlot)
+}
+
+// Backfill processes the slots from the given one up to the next slot to schedule, excluded,
+// again for address only, without checkpointing them. Later slots see address
+// in the watchlist already, their signatures are indexed again if they were ahead.
+func (s *SolanaWatcher) Backfill(ctx context.Context, address string, from uint64) error {
+	backfill := &SolanaWatcher{
+		Client:      s.Client,
+		KafkaChan:   s.KafkaChan,
+		Finality:    s.Finality,
+		DeadLetters: s.DeadLetters,
+		Transactor:  s.Transactor,
+		Keys:        s.Keys,
+		Registry:    s.Registry,
+		watchlist:   chain.NewAddressIndex(false, address),
+	}
+
+	return chain.Backfill(ctx, chain.SolanaName, address, from, s.NextBlock(), backfill.handleSlot, s.DeadLetters)
+}
+
+// handleSeenSlot emits "seen" events for a slot that is not final yet.
+func (s *SolanaWatcher) handleSeenSlot(ctx context.Context, slot uint64) {
+	send := func(msg kafka.Message) { s.KafkaChan <- msg }
+	if err := s.processSlot(ctx, slot, s.seenSignatures, rpc.CommitmentConfirmed, chain.StatusSeen, send); err != nil {
+		log.Println(err)
+	}
+	s.seenSignatures.forget(slot)
+}
+
+// processSlot sends the events of slot, from the transactions of the watched
+// addresses when index has their signatures, from the whole block otherwise.
+func (s *SolanaWatcher) processSlot(ctx context.Context, slot uint64, index *signatureIndex, commitment rpc.Commitment,
+	status chain.Status, send func(kafka.Message)) error {
+	var txs []client.BlockTransaction
+	var err error
+	if signatures, ok := index.get(slot); ok {
+		txs, err = s.GetSignedTxs(ctx, signatures, commitment)
+	} else {
+		txs, err = s.GetTxs(ctx, slot, commitment)
+	}
+	if err != nil {
+		return fmt.Errorf("getting solana transactions for slot %d: %w", slot, err)
 	}
 
 	filteredTxs := s.FilterTxs(txs)
 	for _, filteredTx := range filteredTxs {
-		payload, err := json.Marshal(filteredTx)
+		filteredTx.Status = status
+
+		msg, err := chain.NewMessage(filteredTx, s.Keys)
 		if err != nil {
 			log.Printf("error marshalling solana transaction: %+v\n", filteredTx)
+			chain.PutDeadLetter(s.DeadLetters, chain.DeadLetter{
+				Kind:     chain.DeadLetterBlock,
+				Chain:    chain.SolanaName,
+				Block:    slot,
+				Reason:   fmt.Sprintf("marshalling transaction %s: %v", filteredTx.ID, err),
+				Attempts: 1,
+			})
 			continue
 		}
-		s.KafkaChan <- kafka.Message{Value: payload}
+		send(msg)
 	}
+
+	return nil
 }
 
-func (s *SolanaWatcher) scheduleSlots(slots chan<- uint64) {
+func (s *SolanaWatcher) scheduleSlots(ctx context.Context, slots chan<- uint64) {
 	for {
 		currentSlot := atomic.LoadUint64(&s.CurrentSlot)
 		maxSlot := atomic.LoadUint64(&s.MaxSlot)
 
 		if currentSlot < maxSlot {
-			slots <- currentSlot
-			atomic.AddUint64(&s.CurrentSlot, 1)
+			if !s.indexSignatures(ctx, s.signatures, currentSlot, maxSlot-1) {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- currentSlot:
+				atomic.AddUint64(&s.CurrentSlot, 1)
+			}
+		} else if !chain.Sleep(ctx, 50*time.Millisecond) {
+			return
+		}
+	}
+}
+
+// isSkippedSlot reports whether err means no block was produced for the slot,
+// which is expected and must not be retried.
+func isSkippedSlot(err error) bool {
+	var rpcErr *rpc.JsonRpcError
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	return rpcErr.Code == slotSkippedCode || rpcErr.Code == longTermStorageSlotSkippedCode
+}
+
+// scheduleSeenSlots handles the slots between the last final slot and the tip.
+func (s *SolanaWatcher) scheduleSeenSlots(ctx context.Context) {
+	next := atomic.LoadUint64(&s.MaxSlot)
+	for ctx.Err() == nil {
+		if maxSlot := atomic.LoadUint64(&s.MaxSlot); maxSlot > next {
+			next = maxSlot
+			s.seenSignatures.forgetBefore(next)
+		}
+
+		if tipSlot := atomic.LoadUint64(&s.TipSlot); next <= tipSlot {
+			if s.indexSignatures(ctx, s.seenSignatures, next, tipSlot) {
+				s.handleSeenSlot(ctx, next)
+				next++
+			}
 		} else {
-			time.Sleep(50 * time.Millisecond)
+			chain.Sleep(ctx, 50*time.Millisecond)
 		}
 	}
 }
 
-func (s *SolanaWatcher) Watch() {
-	go s.UpdateMaxSlot()
+func (s *SolanaWatcher) Watch(ctx context.Context) {
+	go s.UpdateMaxSlot(ctx)
+
+	// the retries and seen events are waited for too, so that nothing is sent
+	// to Kafka once Watch returns
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		s.Retrier.Run(ctx)
+		// pending retries are dropped, the blocks waiting for them cannot be committed
+		s.Progress.Stop()
+	}()
+
+	if s.Finality.Enabled() && s.Finality.EmitSeen {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.scheduleSeenSlots(ctx)
+		}()
+	}
 
 	slots := make(chan uint64, chain.SolSlotWorkers)
 
-	s.startWorkerPool(slots, chain.SolSlotWorkers)
-	s.scheduleSlots(slots)
+	wg := s.startWorkerPool(ctx, slots, chain.SolSlotWorkers)
+	s.scheduleSlots(ctx, slots)
+
+	close(slots)
+	wg.Wait()
+	background.Wait()
 }
@@ -1,19 +1,32 @@
 package solana
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/checkpoint"
 	"github.com/blocto/solana-go-sdk/client"
 	"github.com/blocto/solana-go-sdk/common"
+	"github.com/blocto/solana-go-sdk/rpc"
 	"github.com/blocto/solana-go-sdk/types"
 	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
 	"github.com/mr-tron/base58"
 	"github.com/segmentio/kafka-go"
 )
@@ -24,8 +37,12 @@ const (
 	// we watch this public key
 	publicKey2 = "Es1cHBCrQKnQ8EHHBXMquCr2msuwV7PZ1oHz4D9WLoC5"
 
-	fee    = 5000
-	amount = 100_000
+	usdcMint = "EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v"
+
+	fee          = 5000
+	amount       = 100_000
+	tokenAmount  = 2_500_000
+	usdcDecimals = 6
 )
 
 var (
@@ -38,9 +55,8 @@ type mockClient struct {
 	to   string
 }
 
-func (m *mockClient) GetSlot(ctx context.Context) (uint64, error) {
-	m.slot++
-	return m.slot, nil
+func (m *mockClient) GetSlotWithConfig(ctx context.Context, cfg client.GetSlotConfig) (uint64, error) {
+	return atomic.AddUint64(&m.slot, 1), nil
 }
 
 func (m *mockClient) GetBlockWithConfig(ctx context.Context, slot uint64, cfg client.GetBlockConfig) (*client.Block, error) {
@@ -84,6 +100,14 @@ func (m *mockClient) GetBlockWithConfig(ctx context.Context, slot uint64, cfg cl
 	}, nil
 }
 
+func newCheckpointer(t *testing.T) chain.Checkpointer {
+	checkpointer, err := checkpoint.NewFileCheckpointer(filepath.Join(t.TempDir(), "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("failed to create checkpointer: %v", err)
+	}
+	return checkpointer
+}
+
 func TestSolanaWatch(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -96,13 +120,21 @@ func TestSolanaWatch(t *testing.T) {
 			from: publicKey2,
 			to:   publicKey1,
 			expectedTx: chain.Transaction{
-				Chain:       chain.SolanaName,
-				ID:          base58.Encode(txID),
-				User:        publicKey2,
-				Source:      publicKey2,
-				Destination: publicKey1,
-				Amount:      big.NewInt(amount),
-				Fee:         big.NewInt(fee),
+				EventID:          "solana:" + base58.Encode(txID) + ":0:" + publicKey2,
+				Chain:            chain.SolanaName,
+				ID:               base58.Encode(txID),
+				User:             publicKey2,
+				Address:          publicKey2,
+				Source:           publicKey2,
+				Destination:      publicKey1,
+				Direction:        chain.DirectionOutgoing,
+				Amount:           big.NewInt(amount),
+				Fee:              big.NewInt(fee),
+				InstructionIndex: new(int),
+				Inputs:           []chain.Transfer{{Address: publicKey2, Amount: big.NewInt(amount)}},
+				Outputs:          []chain.Transfer{{Address: publicKey1, Amount: big.NewInt(amount)}},
+				NetAmount:        big.NewInt(-amount),
+				Status:           chain.StatusSeen,
 			},
 		},
 		{
@@ -110,13 +142,21 @@ func TestSolanaWatch(t *testing.T) {
 			from: publicKey1,
 			to:   publicKey2,
 			expectedTx: chain.Transaction{
-				Chain:       chain.SolanaName,
-				ID:          base58.Encode(txID),
-				User:        publicKey2,
-				Source:      publicKey1,
-				Destination: publicKey2,
-				Amount:      big.NewInt(amount),
-				Fee:         big.NewInt(fee),
+				EventID:          "solana:" + base58.Encode(txID) + ":0:" + publicKey2,
+				Chain:            chain.SolanaName,
+				ID:               base58.Encode(txID),
+				User:             publicKey2,
+				Address:          publicKey2,
+				Source:           publicKey1,
+				Destination:      publicKey2,
+				Direction:        chain.DirectionIncoming,
+				Amount:           big.NewInt(amount),
+				Fee:              big.NewInt(fee),
+				InstructionIndex: new(int),
+				Inputs:           []chain.Transfer{{Address: publicKey1, Amount: big.NewInt(amount)}},
+				Outputs:          []chain.Transfer{{Address: publicKey2, Amount: big.NewInt(amount)}},
+				NetAmount:        big.NewInt(amount),
+				Status:           chain.StatusSeen,
 			},
 		},
 		{
@@ -135,11 +175,14 @@ func TestSolanaWatch(t *testing.T) {
 			}
 
 			kafkaChan := make(chan kafka.Message, 1)
-			s := NewSolanaWatcher(client, kafkaChan)
+			s := NewSolanaWatcher(client, kafkaChan, newCheckpointer(t), chain.Finality{}, nil)
 
 			os.Setenv("SOLANA_ADDRESSES", publicKey2)
 
-			go s.Watch()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go s.Watch(ctx)
 
 			select {
 			case msg := <-kafkaChan:
@@ -153,10 +196,1134 @@ func TestSolanaWatch(t *testing.T) {
 				}
 
 			case <-time.After(chain.UpdateSlotTicker + time.Second):
-				if test.expectedTx != (chain.Transaction{}) {
+				if test.expectedTx.ID != "" {
 					t.Errorf("got nothing, expected a transaction: %+v", test.expectedTx)
 				}
 			}
 		})
 	}
 }
+
+// ackMessages acknowledges the messages of in, as the Kafka writer does, and forwards them.
+func ackMessages(in <-chan kafka.Message) <-chan kafka.Message {
+	out := make(chan kafka.Message, cap(in))
+	go func() {
+		defer close(out)
+		for msg := range in {
+			if ack, ok := msg.WriterData.(chain.Ack); ok {
+				ack(nil)
+			}
+			out <- msg
+		}
+	}()
+	return out
+}
+
+func TestSolanaWatchShutdown(t *testing.T) {
+	client := &mockClient{
+		from: publicKey1,
+		to:   publicKey2,
+	}
+	kafkaChan := make(chan kafka.Message, 1)
+	checkpointer := newCheckpointer(t)
+	s := NewSolanaWatcher(client, kafkaChan, checkpointer, chain.Finality{}, nil)
+
+	os.Setenv("SOLANA_ADDRESSES", publicKey2)
+
+	acked := ackMessages(kafkaChan)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Watch(ctx)
+		close(stopped)
+	}()
+
+	select {
+	case <-acked:
+	case <-time.After(chain.UpdateSlotTicker + time.Second):
+		t.Fatal("got nothing, expected a transaction")
+	}
+	cancel()
+
+	// slots in flight are finished, so their messages must still be consumed
+	for {
+		select {
+		case <-acked:
+			continue
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("watcher did not stop after the context was cancelled")
+		}
+		break
+	}
+
+	last, ok, err := checkpointer.Load(chain.SolanaName)
+	if err != nil || !ok {
+		t.Fatalf("expected a checkpoint after shutdown, got ok %v, err %v", ok, err)
+	}
+	if next := atomic.LoadUint64(&s.CurrentSlot); last+1 != next {
+		t.Errorf("expected every scheduled slot to be checkpointed, got %d, next slot %d", last, next)
+	}
+}
+
+func tokenTransferTx(programID common.PublicKey, data []byte, accounts []int) client.BlockTransaction {
+	sourceAccount := common.PublicKeyFromBytes(bytes.Repeat([]byte{1}, 32))
+	destinationAccount := common.PublicKeyFromBytes(bytes.Repeat([]byte{2}, 32))
+
+	balance := rpc.TokenAccountBalance{Decimals: usdcDecimals}
+
+	return client.BlockTransaction{
+		Transaction: types.Transaction{
+			Message: types.Message{
+				Instructions: []types.CompiledInstruction{
+					{
+						ProgramIDIndex: 4,
+						Accounts:       accounts,
+						Data:           data,
+					},
+				},
+			},
+			Signatures: []types.Signature{txID},
+		},
+		Meta: &client.TransactionMeta{
+			Fee: fee,
+			PreTokenBalances: []rpc.TransactionMetaTokenBalance{
+				{AccountIndex: 1, Mint: usdcMint, Owner: publicKey1, UITokenAmount: balance},
+			},
+			PostTokenBalances: []rpc.TransactionMetaTokenBalance{
+				{AccountIndex: 1, Mint: usdcMint, Owner: publicKey1, UITokenAmount: balance},
+				{AccountIndex: 2, Mint: usdcMint, Owner: publicKey2, UITokenAmount: balance},
+			},
+		},
+		AccountKeys: []common.PublicKey{
+			common.PublicKeyFromString(publicKey1),
+			sourceAccount,
+			destinationAccount,
+			common.PublicKeyFromString(usdcMint),
+			programID,
+		},
+	}
+}
+
+func TestSolanaTokenTransfers(t *testing.T) {
+	transferData := make([]byte, 9)
+	transferData[0] = tokenTransfer
+	binary.LittleEndian.PutUint64(transferData[1:9], tokenAmount)
+
+	transferCheckedData := make([]byte, 10)
+	transferCheckedData[0] = tokenTransferChecked
+	binary.LittleEndian.PutUint64(transferCheckedData[1:9], tokenAmount)
+	transferCheckedData[9] = usdcDecimals
+
+	decimals := uint8(usdcDecimals)
+	expectedTx := chain.Transaction{
+		Chain:            chain.SolanaName,
+		ID:               base58.Encode(txID),
+		User:             publicKey2,
+		Address:          publicKey2,
+		Source:           publicKey1,
+		Destination:      publicKey2,
+		Direction:        chain.DirectionIncoming,
+		Amount:           big.NewInt(tokenAmount),
+		Fee:              big.NewInt(fee),
+		Token:            usdcMint,
+		Decimals:         &decimals,
+		InstructionIndex: new(int),
+		Inputs:           []chain.Transfer{{Address: publicKey1, Amount: big.NewInt(tokenAmount)}},
+		Outputs:          []chain.Transfer{{Address: publicKey2, Amount: big.NewInt(tokenAmount)}},
+		NetAmount:        big.NewInt(tokenAmount),
+	}
+
+	tests := []struct {
+		name string
+		tx   client.BlockTransaction
+	}{
+		{
+			name: "token program transfer",
+			tx:   tokenTransferTx(common.TokenProgramID, transferData, []int{1, 2, 0}),
+		},
+		{
+			name: "token program transfer checked",
+			tx:   tokenTransferTx(common.TokenProgramID, transferCheckedData, []int{1, 3, 2, 0}),
+		},
+		{
+			name: "token-2022 program transfer checked",
+			tx:   tokenTransferTx(common.Token2022ProgramID, transferCheckedData, []int{1, 3, 2, 0}),
+		},
+	}
+
+	os.Setenv("SOLANA_ADDRESSES", publicKey2)
+	s := &SolanaWatcher{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := s.FilterTxs([]client.BlockTransaction{test.tx})
+			if diff := cmp.Diff([]chain.Transaction{expectedTx}, got, cmp.AllowUnexported(big.Int{})); diff != "" {
+				t.Errorf("transaction mismatch. (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSolanaInnerInstructionTransfers(t *testing.T) {
+	systemData := make([]byte, 12)
+	binary.LittleEndian.PutUint32(systemData[0:4], systemTransfer)
+	binary.LittleEndian.PutUint64(systemData[4:12], amount)
+
+	tokenData := make([]byte, 9)
+	tokenData[0] = tokenTransfer
+	binary.LittleEndian.PutUint64(tokenData[1:9], tokenAmount)
+
+	// An exchange program pays out SOL and USDC to the watched user from its second instruction.
+	exchangeProgram := common.PublicKeyFromBytes(bytes.Repeat([]byte{3}, 32))
+	tx := tokenTransferTx(common.TokenProgramID, nil, nil)
+	tx.AccountKeys = append(tx.AccountKeys, common.PublicKeyFromString(publicKey2), common.SystemProgramID, exchangeProgram)
+	tx.Transaction.Message.Instructions = []types.CompiledInstruction{
+		{ProgramIDIndex: 7, Data: []byte{0}},
+		{ProgramIDIndex: 7, Data: []byte{1}},
+	}
+	tx.Meta.InnerInstructions = []client.InnerInstruction{
+		{
+			Index: 1,
+			Instructions: []types.CompiledInstruction{
+				{ProgramIDIndex: 6, Accounts: []int{0, 5}, Data: systemData},
+				{ProgramIDIndex: 4, Accounts: []int{1, 2, 0}, Data: tokenData},
+			},
+		},
+	}
+
+	os.Setenv("SOLANA_ADDRESSES", publicKey2)
+	s := &SolanaWatcher{}
+
+	outerIndex := 1
+	innerIndexes := []int{0, 1}
+	decimals := uint8(usdcDecimals)
+	expected := []chain.Transaction{
+		{
+			Chain:            chain.SolanaName,
+			ID:               base58.Encode(txID),
+			User:             publicKey2,
+			Address:          publicKey2,
+			Source:           publicKey1,
+			Destination:      publicKey2,
+			Direction:        chain.DirectionIncoming,
+			Amount:           big.NewInt(amount),
+			Fee:              big.NewInt(fee),
+			InstructionIndex: &outerIndex,
+			InnerIndex:       &innerIndexes[0],
+			Inputs:           []chain.Transfer{{Address: publicKey1, Amount: big.NewInt(amount)}},
+			Outputs:          []chain.Transfer{{Address: publicKey2, Amount: big.NewInt(amount)}},
+			NetAmount:        big.NewInt(amount),
+		},
+		{
+			Chain:            chain.SolanaName,
+			ID:               base58.Encode(txID),
+			User:             publicKey2,
+			Address:          publicKey2,
+			Source:           publicKey1,
+			Destination:      publicKey2,
+			Direction:        chain.DirectionIncoming,
+			Amount:           big.NewInt(tokenAmount),
+			Fee:              big.NewInt(fee),
+			Token:            usdcMint,
+			Decimals:         &decimals,
+			InstructionIndex: &outerIndex,
+			InnerIndex:       &innerIndexes[1],
+			Inputs:           []chain.Transfer{{Address: publicKey1, Amount: big.NewInt(tokenAmount)}},
+			Outputs:          []chain.Transfer{{Address: publicKey2, Amount: big.NewInt(tokenAmount)}},
+			NetAmount:        big.NewInt(tokenAmount),
+		},
+	}
+
+	got := s.FilterTxs([]client.BlockTransaction{tx})
+	if diff := cmp.Diff(expected, got, cmp.AllowUnexported(big.Int{})); diff != "" {
+		t.Errorf("transaction mismatch. (-want +got):\n%s", diff)
+	}
+}
+
+func TestSolanaBatchedPayouts(t *testing.T) {
+	transfer := func(lamports uint64) []byte {
+		data := make([]byte, 12)
+		binary.LittleEndian.PutUint32(data[0:4], systemTransfer)
+		binary.LittleEndian.PutUint64(data[4:12], lamports)
+		return data
+	}
+
+	// A payout service pays the watched user twice and someone else once in a
+	// single transaction, then twice more through a payout program.
+	payoutProgram := common.PublicKeyFromBytes(bytes.Repeat([]byte{5}, 32))
+	other := common.PublicKeyFromBytes(bytes.Repeat([]byte{6}, 32))
+	tx := client.BlockTransaction{
+		Transaction: types.Transaction{
+			Message: types.Message{
+				Instructions: []types.CompiledInstruction{
+					{ProgramIDIndex: 3, Accounts: []int{0, 1}, Data: transfer(amount)},
+					{ProgramIDIndex: 3, Accounts: []int{0, 2}, Data: transfer(amount)},
+					{ProgramIDIndex: 3, Accounts: []int{0, 1}, Data: transfer(amount)},
+					{ProgramIDIndex: 4, Data: []byte{0}},
+				},
+			},
+			Signatures: []types.Signature{txID},
+		},
+		Meta: &client.TransactionMeta{
+			Fee: fee,
+			InnerInstructions: []client.InnerInstruction{
+				{
+					Index: 3,
+					Instructions: []types.CompiledInstruction{
+						{ProgramIDIndex: 3, Accounts: []int{0, 1}, Data: transfer(amount)},
+						{ProgramIDIndex: 3, Accounts: []int{0, 1}, Data: transfer(amount)},
+					},
+				},
+			},
+		},
+		AccountKeys: []common.PublicKey{
+			common.PublicKeyFromString(publicKey1),
+			common.PublicKeyFromString(publicKey2),
+			other,
+			common.SystemProgramID,
+			payoutProgram,
+		},
+	}
+
+	os.Setenv("SOLANA_ADDRESSES", publicKey2)
+	s := &SolanaWatcher{}
+
+	got := s.FilterTxs([]client.BlockTransaction{tx})
+
+	signature := base58.Encode(txID)
+	expectedIDs := []string{
+		"solana:" + signature + ":0:" + publicKey2,
+		"solana:" + signature + ":2:" + publicKey2,
+		"solana:" + signature + ":3:0:" + publicKey2,
+		"solana:" + signature + ":3:1:" + publicKey2,
+	}
+	gotIDs := []string{}
+	for _, event := range got {
+		gotIDs = append(gotIDs, chain.EventID(event))
+	}
+	if diff := cmp.Diff(expectedIDs, gotIDs); diff != "" {
+		t.Errorf("event IDs mismatch. (-want +got):\n%s", diff)
+	}
+}
+
+func versionedTransferTx(accountKeys []common.PublicKey, accounts []int) client.BlockTransaction {
+	data := make([]byte, 12)
+	binary.LittleEndian.PutUint32(data[0:4], systemTransfer)
+	binary.LittleEndian.PutUint64(data[4:12], amount)
+
+	lookupTable := common.PublicKeyFromBytes(bytes.Repeat([]byte{4}, 32))
+
+	return client.BlockTransaction{
+		Transaction: types.Transaction{
+			Message: types.Message{
+				Version: types.MessageVersionV0,
+				Accounts: []common.PublicKey{
+					common.PublicKeyFromString(publicKey1),
+					common.SystemProgramID,
+				},
+				AddressLookupTables: []types.CompiledAddressLookupTable{
+					{
+						AccountKey:      lookupTable,
+						WritableIndexes: []uint8{0},
+						ReadonlyIndexes: []uint8{1},
+					},
+				},
+				Instructions: []types.CompiledInstruction{
+					{
+						ProgramIDIndex: 1,
+						Accounts:       accounts,
+						Data:           data,
+					},
+				},
+			},
+			Signatures: []types.Signature{txID},
+		},
+		Meta: &client.TransactionMeta{
+			Fee: fee,
+			LoadedAddresses: rpc.TransactionLoadedAddresses{
+				Writable: []string{publicKey2},
+				Readonly: []string{usdcMint},
+			},
+		},
+		AccountKeys: accountKeys,
+	}
+}
+
+func TestSolanaVersionedTransactions(t *testing.T) {
+	static := []common.PublicKey{
+		common.PublicKeyFromString(publicKey1),
+		common.SystemProgramID,
+	}
+	full := append(static, common.PublicKeyFromString(publicKey2), common.PublicKeyFromString(usdcMint))
+
+	expectedTx := chain.Transaction{
+		Chain:            chain.SolanaName,
+		ID:               base58.Encode(txID),
+		User:             publicKey2,
+		Address:          publicKey2,
+		Source:           publicKey1,
+		Destination:      publicKey2,
+		Direction:        chain.DirectionIncoming,
+		Amount:           big.NewInt(amount),
+		Fee:              big.NewInt(fee),
+		InstructionIndex: new(int),
+		Inputs:           []chain.Transfer{{Address: publicKey1, Amount: big.NewInt(amount)}},
+		Outputs:          []chain.Transfer{{Address: publicKey2, Amount: big.NewInt(amount)}},
+		NetAmount:        big.NewInt(amount),
+	}
+
+	tests := []struct {
+		name     string
+		tx       client.BlockTransaction
+		expected []chain.Transaction
+	}{
+		{
+			name:     "v0 transaction with resolved account keys",
+			tx:       versionedTransferTx(full, []int{0, 2}),
+			expected: []chain.Transaction{expectedTx},
+		},
+		{
+			name:     "v0 transaction with static account keys only",
+			tx:       versionedTransferTx(static, []int{0, 2}),
+			expected: []chain.Transaction{expectedTx},
+		},
+		{
+			name:     "v0 transaction with out of range account index",
+			tx:       versionedTransferTx(static, []int{0, 4}),
+			expected: []chain.Transaction{},
+		},
+	}
+
+	os.Setenv("SOLANA_ADDRESSES", publicKey2)
+	s := &SolanaWatcher{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := s.FilterTxs([]client.BlockTransaction{test.tx})
+			if diff := cmp.Diff(test.expected, got, cmp.AllowUnexported(big.Int{})); diff != "" {
+				t.Errorf("transaction mismatch. (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+type erroringClient struct {
+	mockClient
+	err error
+}
+
+func (m *erroringClient) GetBlockWithConfig(ctx context.Context, slot uint64, cfg client.GetBlockConfig) (*client.Block, error) {
+	return nil, m.err
+}
+
+// mockSlots hands each subscription to the test.
+type mockSlots chan mockSubscription
+
+type mockSubscription struct {
+	slots chan<- SlotNotification
+	err   chan error
+}
+
+func (m mockSlots) SubscribeSlots(ctx context.Context, ch chan<- SlotNotification) (Subscription, error) {
+	sub := mockSubscription{slots: ch, err: make(chan error, 1)}
+	m <- sub
+	return sub, nil
+}
+
+func (s mockSubscription) Err() <-chan error { return s.err }
+
+func (s mockSubscription) Unsubscribe() {}
+
+func TestSolanaSlotSubscription(t *testing.T) {
+	subscriptions := make(mockSlots, 1)
+	slotClient := &mockClient{}
+	s := &SolanaWatcher{Client: slotClient, Slots: subscriptions}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.UpdateMaxSlot(ctx)
+
+	subscribed := func() mockSubscription {
+		select {
+		case sub := <-subscriptions:
+			return sub
+		case <-time.After(chain.SolResubscribeDelay + time.Second):
+			t.Fatalf("expected a subscription to slots")
+			return mockSubscription{}
+		}
+	}
+	expectMaxSlot := func(expected uint64, within time.Duration) {
+		deadline := time.Now().Add(within)
+		for atomic.LoadUint64(&s.MaxSlot) < expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected max slot %d, got %d", expected, atomic.LoadUint64(&s.MaxSlot))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// subscribing polls once to catch up, then the notified roots are the max slots, without polling
+	sub := subscribed()
+	expectMaxSlot(1, time.Second)
+	sub.slots <- SlotNotification{Slot: 10, Parent: 9, Root: 4}
+	expectMaxSlot(4, chain.UpdateSlotTicker/2)
+	sub.slots <- SlotNotification{Slot: 13, Parent: 12, Root: 6}
+	expectMaxSlot(6, chain.UpdateSlotTicker/2)
+	if polls := atomic.LoadUint64(&slotClient.slot); polls != 1 {
+		t.Errorf("expected only the catch-up poll while subscribed, got %d polls", polls)
+	}
+
+	// slots are polled once the socket drops, until subscribed again
+	sub.err <- errors.New("connection reset")
+	deadline := time.Now().Add(3 * chain.UpdateSlotTicker)
+	for atomic.LoadUint64(&slotClient.slot) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the slots to be polled, got %d polls", atomic.LoadUint64(&slotClient.slot))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	subscribed()
+}
+
+func TestSolanaNotifiedSlots(t *testing.T) {
+	n := SlotNotification{Slot: 100, Parent: 99, Root: 68}
+	tests := []struct {
+		name        string
+		finality    chain.Finality
+		expectedTip uint64
+		expectedMax uint64
+	}{
+		{name: "finality disabled", finality: chain.Finality{}, expectedTip: 68, expectedMax: 68},
+		{name: "confirmed", finality: chain.Finality{Tag: "confirmed"}, expectedTip: 98, expectedMax: 98},
+		{name: "finalized", finality: chain.Finality{Tag: "finalized"}, expectedTip: 98, expectedMax: 68},
+		{name: "finalized with depth", finality: chain.Finality{Tag: "finalized", Depth: 8}, expectedTip: 98, expectedMax: 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SolanaWatcher{Finality: tt.finality}
+			tip, max := s.notifiedSlots(n)
+			if tip != tt.expectedTip || max != tt.expectedMax {
+				t.Errorf("expected tip %d and max slot %d, got %d and %d", tt.expectedTip, tt.expectedMax, tip, max)
+			}
+		})
+	}
+}
+
+func TestSlotsClient(t *testing.T) {
+	t.Setenv("BLOCKDAEMON_API_KEY", "key")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer key" {
+			t.Errorf("expected the API key as bearer token, got %q", got)
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		var req struct {
+			ID     int    `json:"id"`
+			Method string `json:"method"`
+		}
+		if err := conn.ReadJSON(&req); err != nil || req.Method != "slotSubscribe" {
+			t.Errorf("expected slotSubscribe, got %+v, %v", req, err)
+			return
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","result":7,"id":1}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"slotNotification",`+
+			`"params":{"result":{"parent":75,"root":44,"slot":76},"subscription":7}}`))
+	}))
+	defer server.Close()
+
+	ch := make(chan SlotNotification)
+	sub, err := CreateSlotsClient("ws"+strings.TrimPrefix(server.URL, "http")).SubscribeSlots(context.Background(), ch)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	select {
+	case got := <-ch:
+		if diff := cmp.Diff(SlotNotification{Slot: 76, Parent: 75, Root: 44}, got); diff != "" {
+			t.Errorf("notification mismatch. (-want +got):\n%s", diff)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a slot notification")
+	}
+
+	// the server closing the connection fails the subscription
+	select {
+	case err := <-sub.Err():
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the subscription to fail")
+	}
+}
+
+// signatureClient finds the transactions of the watched addresses by signature,
+// the full blocks of mockClient must not be fetched.
+type signatureClient struct {
+	*mockClient
+
+	mu sync.Mutex
+	// signatures and tokenAccounts are per address, txs per signature
+	signatures    map[string]rpc.GetSignaturesForAddress
+	tokenAccounts map[string][]common.PublicKey
+	txs           map[string]client.BlockTransaction
+	untils        map[string]string
+	fetched       []string
+	blocks        int
+}
+
+func (m *signatureClient) GetBlockWithConfig(ctx context.Context, slot uint64, cfg client.GetBlockConfig) (*client.Block, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocks++
+	return m.mockClient.GetBlockWithConfig(ctx, slot, cfg)
+}
+
+// GetSignaturesForAddressWithConfig returns the signatures of addr newer than cfg.Until, in one page.
+func (m *signatureClient) GetSignaturesForAddressWithConfig(ctx context.Context, addr string,
+	cfg client.GetSignaturesForAddressConfig) (rpc.GetSignaturesForAddress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.untils[addr] = cfg.Until
+
+	page := rpc.GetSignaturesForAddress{}
+	for _, signature := range m.signatures[addr] {
+		if signature.Signature == cfg.Until {
+			break
+		}
+		page = append(page, signature)
+	}
+	return page, nil
+}
+
+func (m *signatureClient) GetTransactionWithConfig(ctx context.Context, txhash string,
+	cfg client.GetTransactionConfig) (*client.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetched = append(m.fetched, txhash)
+
+	tx := m.txs[txhash]
+	return &client.Transaction{Meta: tx.Meta, Transaction: tx.Transaction, AccountKeys: tx.AccountKeys}, nil
+}
+
+func (m *signatureClient) GetTokenAccountsByOwnerByProgram(ctx context.Context, owner, programId string) ([]client.TokenAccount, error) {
+	if programId != common.TokenProgramID.ToBase58() {
+		return nil, nil
+	}
+
+	accounts := []client.TokenAccount{}
+	for _, account := range m.tokenAccounts[owner] {
+		accounts = append(accounts, client.TokenAccount{PublicKey: account})
+	}
+	return accounts, nil
+}
+
+func TestSolanaAddressStrategy(t *testing.T) {
+	signature := base58.Encode(txID)
+
+	transferData := make([]byte, 9)
+	transferData[0] = tokenTransfer
+	binary.LittleEndian.PutUint64(transferData[1:9], tokenAmount)
+	// the destination token account is owned by publicKey2, which the transaction does not list
+	tokenTx := tokenTransferTx(common.TokenProgramID, transferData, []int{1, 2, 0})
+	tokenAccount := tokenTx.AccountKeys[2]
+
+	block, _ := (&mockClient{from: publicKey1, to: publicKey2}).GetBlockWithConfig(context.Background(), 1, client.GetBlockConfig{})
+	failed := rpc.SignatureWithStatus{Signature: "failed", Slot: 3, Err: map[string]any{"InstructionError": []any{0, "Custom"}}}
+
+	tests := []struct {
+		name       string
+		address    string
+		signatures rpc.GetSignaturesForAddress
+		tx         client.BlockTransaction
+		token      string
+	}{
+		{
+			name:       "native transfer to the wallet",
+			address:    publicKey2,
+			signatures: rpc.GetSignaturesForAddress{failed, {Signature: signature, Slot: 3}},
+			tx:         block.Transactions[0],
+		},
+		{
+			name:       "token transfer to a token account of the wallet",
+			address:    tokenAccount.ToBase58(),
+			signatures: rpc.GetSignaturesForAddress{failed, {Signature: signature, Slot: 3}},
+			tx:         tokenTx,
+			token:      usdcMint,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &signatureClient{
+				mockClient:    &mockClient{},
+				signatures:    map[string]rpc.GetSignaturesForAddress{test.address: test.signatures},
+				tokenAccounts: map[string][]common.PublicKey{publicKey2: {tokenAccount}},
+				txs:           map[string]client.BlockTransaction{signature: test.tx},
+				untils:        map[string]string{},
+			}
+			kafkaChan := make(chan kafka.Message, 1)
+			s := NewSolanaWatcher(client, kafkaChan, newCheckpointer(t), chain.Finality{}, nil)
+
+			os.Setenv("SOLANA_ADDRESSES", publicKey2)
+			acked := ackMessages(kafkaChan)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go s.Watch(ctx)
+
+			select {
+			case msg := <-acked:
+				var got chain.Transaction
+				if err := json.Unmarshal(msg.Value, &got); err != nil {
+					t.Fatalf("failed to decode kafka message: %v", err)
+				}
+				if got.ID != signature || got.Address != publicKey2 || got.Direction != chain.DirectionIncoming ||
+					got.Token != test.token {
+					t.Errorf("expected the incoming transfer %s of %s, got %+v", signature, publicKey2, got)
+				}
+			case <-time.After(4*chain.UpdateSlotTicker + time.Second):
+				t.Fatal("got nothing, expected a transaction")
+			}
+
+			// the next slots are indexed from the newest signature seen, even of a failed transaction
+			deadline := time.After(3 * chain.UpdateSlotTicker)
+			for atomic.LoadUint64(&s.CurrentSlot) < 5 {
+				select {
+				case <-deadline:
+					t.Fatalf("expected slot 4 to be handled, next slot %d", atomic.LoadUint64(&s.CurrentSlot))
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			if client.blocks != 0 {
+				t.Errorf("expected no full block to be fetched, got %d", client.blocks)
+			}
+			if diff := cmp.Diff([]string{signature}, client.fetched); diff != "" {
+				t.Errorf("fetched transactions mismatch. (-want +got):\n%s", diff)
+			}
+			if until := client.untils[test.address]; until != "failed" {
+				t.Errorf("expected the signatures to be fetched until the failed one, got %q", until)
+			}
+		})
+	}
+}
+
+func TestSolanaSignaturesWatchlistChange(t *testing.T) {
+	client := &signatureClient{
+		mockClient: &mockClient{},
+		signatures: map[string]rpc.GetSignaturesForAddress{
+			publicKey2: {{Signature: "added", Slot: 7}},
+		},
+		untils: map[string]string{},
+	}
+	s := &SolanaWatcher{Client: client}
+	index := newSignatureIndex("")
+
+	// slots are indexed ahead before publicKey2 is added
+	os.Setenv("SOLANA_ADDRESSES", publicKey1)
+	if !s.indexSignatures(context.Background(), index, 1, 10) {
+		t.Fatal("failed to index signatures")
+	}
+	os.Setenv("SOLANA_ADDRESSES", publicKey1+","+publicKey2)
+	if !s.indexSignatures(context.Background(), index, 5, 10) {
+		t.Fatal("failed to index signatures")
+	}
+
+	if got, ok := index.get(7); !ok || !slices.Equal(got, []string{"added"}) {
+		t.Errorf("expected slot 7 to be indexed again with the added address, got %v, %t", got, ok)
+	}
+	if got, ok := index.get(4); !ok || len(got) != 0 {
+		t.Errorf("expected slot 4 to stay indexed, got %v, %t", got, ok)
+	}
+}
+
+// pagedSignatureClient pages the signatures of an address, the newest first,
+// and counts the pages fetched.
+type pagedSignatureClient struct {
+	signatureClient
+	pages int
+}
+
+func (m *pagedSignatureClient) GetSignaturesForAddressWithConfig(ctx context.Context, addr string,
+	cfg client.GetSignaturesForAddressConfig) (rpc.GetSignaturesForAddress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages++
+
+	signatures := m.signatures[addr]
+	start := 0
+	if cfg.Before != "" {
+		start = slices.IndexFunc(signatures, func(s rpc.SignatureWithStatus) bool { return s.Signature == cfg.Before }) + 1
+	}
+
+	page := rpc.GetSignaturesForAddress{}
+	for _, signature := range signatures[start:] {
+		if signature.Signature == cfg.Until || len(page) == cfg.Limit {
+			break
+		}
+		page = append(page, signature)
+	}
+	return page, nil
+}
+
+func TestSolanaSignaturesCatchUp(t *testing.T) {
+	const ranges = 5
+
+	// one signature per slot, the newest first
+	signatures := rpc.GetSignaturesForAddress{}
+	for slot := uint64(ranges * chain.SolSignaturesRange); slot > 0; slot-- {
+		signatures = append(signatures, rpc.SignatureWithStatus{Signature: fmt.Sprint("sig", slot), Slot: slot})
+	}
+	c := &pagedSignatureClient{signatureClient: signatureClient{
+		signatures: map[string]rpc.GetSignaturesForAddress{publicKey1: signatures},
+	}}
+	index := newSignatureIndex("")
+
+	for i := range uint64(ranges) {
+		from := 1 + i*chain.SolSignaturesRange
+		to := from + chain.SolSignaturesRange - 1
+		c.pages = 0
+		if err := index.index(context.Background(), c, []string{publicKey1}, from, to); err != nil {
+			t.Fatalf("indexing slots %d to %d: %v", from, to, err)
+		}
+
+		// the later ranges are fetched from the cursors left by the first one, not from the newest signature
+		if i > 0 && c.pages > 2 {
+			t.Errorf("expected slots %d to %d to take at most 2 pages, got %d", from, to, c.pages)
+		}
+		for _, slot := range []uint64{from, to} {
+			if got, ok := index.get(slot); !ok || !slices.Equal(got, []string{fmt.Sprint("sig", slot)}) {
+				t.Errorf("expected slot %d to be indexed, got %v, %t", slot, got, ok)
+			}
+		}
+	}
+}
+
+// concurrentClient counts the transactions fetched at once.
+type concurrentClient struct {
+	signatureClient
+	inFlight, maxInFlight atomic.Int32
+}
+
+func (m *concurrentClient) GetTransactionWithConfig(ctx context.Context, txhash string,
+	cfg client.GetTransactionConfig) (*client.Transaction, error) {
+	n := m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+	for max := m.maxInFlight.Load(); n > max && !m.maxInFlight.CompareAndSwap(max, n); max = m.maxInFlight.Load() {
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if txhash == "missing" {
+		return nil, nil
+	}
+	return &client.Transaction{Meta: &client.TransactionMeta{LogMessages: []string{txhash}}}, nil
+}
+
+func TestSolanaGetSignedTxs(t *testing.T) {
+	signatures := make([]string, 3*chain.SolTransactionWorkers)
+	for i := range signatures {
+		signatures[i] = fmt.Sprint("sig", i)
+	}
+	c := &concurrentClient{}
+	s := &SolanaWatcher{Client: c}
+
+	txs, err := s.GetSignedTxs(context.Background(), signatures, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the transactions keep the order of their signatures
+	for i, tx := range txs {
+		if tx.Meta.LogMessages[0] != signatures[i] {
+			t.Errorf("expected transaction %d to be %s, got %s", i, signatures[i], tx.Meta.LogMessages[0])
+		}
+	}
+	if got := c.maxInFlight.Load(); got != chain.SolTransactionWorkers {
+		t.Errorf("expected %d transactions fetched at once, got %d", chain.SolTransactionWorkers, got)
+	}
+
+	if _, err := s.GetSignedTxs(context.Background(), append(signatures, "missing"), ""); err == nil {
+		t.Error("expected an error for a missing transaction")
+	}
+}
+
+func TestSolanaDeadLetteredSlotSignatures(t *testing.T) {
+	s := &SolanaWatcher{signatures: newSignatureIndex("")}
+	s.signatures.slots[5] = []string{"sig"}
+	s.Progress = chain.NewProgress(chain.SolanaName, newCheckpointer(t), 5)
+
+	r := chain.NewRetrier(chain.SolanaName, s.handleSlot, s.slotDone, nil)
+	r.MaxAttempts = 1
+	r.Retry(5, errors.New("rpc unavailable"))
+
+	if got, ok := s.signatures.get(5); ok {
+		t.Errorf("expected the signatures of the dead-lettered slot to be dropped, got %v", got)
+	}
+}
+
+func TestSolanaStrategy(t *testing.T) {
+	addresses := make([]string, chain.SolAddressStrategyMax+1)
+	for i := range addresses {
+		addresses[i] = testKey(i)
+	}
+
+	tests := []struct {
+		name      string
+		client    SolClient
+		strategy  Strategy
+		addresses []string
+		expected  bool
+	}{
+		{"auto with few addresses", &signatureClient{}, StrategyAuto, addresses[:1], true},
+		{"auto with many addresses", &signatureClient{}, StrategyAuto, addresses, false},
+		{"default is auto", &signatureClient{}, "", addresses[:chain.SolAddressStrategyMax], true},
+		{"block", &signatureClient{}, StrategyBlock, addresses[:1], false},
+		{"address with many addresses", &signatureClient{}, StrategyAddress, addresses, true},
+		{"client without signatures", &mockClient{}, StrategyAddress, addresses[:1], false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("SOLANA_ADDRESSES", strings.Join(test.addresses, ","))
+			s := &SolanaWatcher{Client: test.client, Strategy: test.strategy}
+
+			if got := s.byAddress(); got != test.expected {
+				t.Errorf("expected by address %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSolanaGetTxsErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectedError bool
+	}{
+		{
+			name: "skipped slot",
+			err:  &rpc.JsonRpcError{Code: -32007, Message: "Slot 1 was skipped"},
+		},
+		{
+			name: "slot skipped in long-term storage",
+			err:  &rpc.JsonRpcError{Code: -32009, Message: "Slot 1 was skipped, or missing in long-term storage"},
+		},
+		{
+			name:          "node unhealthy",
+			err:           &rpc.JsonRpcError{Code: -32005, Message: "Node is unhealthy"},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &SolanaWatcher{Client: &erroringClient{err: test.err}}
+
+			txs, err := s.GetTxs(context.Background(), 1, rpc.CommitmentFinalized)
+			if (err != nil) != test.expectedError {
+				t.Fatalf("expected error to be %v, got %v", test.expectedError, err)
+			}
+			if len(txs) != 0 {
+				t.Errorf("expected no transactions, got %d", len(txs))
+			}
+		})
+	}
+}
+
+func TestSolanaAtLeastOnce(t *testing.T) {
+	client := &mockClient{
+		from: publicKey1,
+		to:   publicKey2,
+	}
+	kafkaChan := make(chan kafka.Message, 1)
+	checkpointer := newCheckpointer(t)
+	s := NewSolanaWatcher(client, kafkaChan, checkpointer, chain.Finality{}, nil)
+	s.Retrier.BaseDelay = 10 * time.Millisecond
+
+	os.Setenv("SOLANA_ADDRESSES", publicKey2)
+
+	first := atomic.LoadUint64(&s.CurrentSlot)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Watch(ctx)
+
+	checkpointed := func() bool {
+		last, ok, err := checkpointer.Load(chain.SolanaName)
+		if err != nil {
+			t.Fatalf("failed to load checkpoint: %v", err)
+		}
+		return ok && last >= first
+	}
+
+	// the broker rejects the events of the first slot
+	select {
+	case msg := <-kafkaChan:
+		msg.WriterData.(chain.Ack)(errors.New("broker unavailable"))
+	case <-time.After(chain.UpdateSlotTicker + time.Second):
+		t.Fatal("got nothing, expected a transaction")
+	}
+
+	// the slot is retried, and not checkpointed until its events are acknowledged
+	select {
+	case msg := <-kafkaChan:
+		if checkpointed() {
+			t.Fatalf("slot %d was checkpointed before its events were acknowledged", first)
+		}
+		msg.WriterData.(chain.Ack)(nil)
+	case <-time.After(chain.UpdateSlotTicker + time.Second):
+		t.Fatal("got nothing, expected the slot to be retried")
+	}
+
+	deadline := time.After(3 * time.Second)
+	for !checkpointed() {
+		select {
+		case msg := <-kafkaChan:
+			msg.WriterData.(chain.Ack)(nil)
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("slot %d was never checkpointed", first)
+		}
+	}
+}
+
+func TestSolanaDirections(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses string
+		from      string
+		to        string
+		expected  map[string]chain.Direction
+	}{
+		{
+			name:      "both parties watched",
+			addresses: publicKey1 + "," + publicKey2,
+			from:      publicKey1,
+			to:        publicKey2,
+			expected:  map[string]chain.Direction{publicKey1: chain.DirectionOutgoing, publicKey2: chain.DirectionIncoming},
+		},
+		{
+			name:      "transfer to self",
+			addresses: publicKey2,
+			from:      publicKey2,
+			to:        publicKey2,
+			expected:  map[string]chain.Direction{publicKey2: chain.DirectionSelf},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Setenv("SOLANA_ADDRESSES", test.addresses)
+			s := &SolanaWatcher{}
+
+			block, _ := (&mockClient{from: test.from, to: test.to}).GetBlockWithConfig(context.Background(), 1, client.GetBlockConfig{})
+			got := map[string]chain.Direction{}
+			for _, event := range s.FilterTxs(block.Transactions) {
+				got[event.User] = event.Direction
+			}
+			if diff := cmp.Diff(test.expected, got); diff != "" {
+				t.Errorf("directions mismatch. (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+type mockRegistry map[string]chain.Account
+
+func (m mockRegistry) Lookup(c chain.Chain, address string) (chain.Account, bool) {
+	account, ok := m[address]
+	return account, ok
+}
+
+func (m mockRegistry) Addresses(c chain.Chain) []string {
+	addresses := []string{}
+	for address := range m {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (m mockRegistry) Index(c chain.Chain) *chain.AddressIndex {
+	return chain.NewAddressIndex(false, m.Addresses(c)...)
+}
+
+func TestSolanaRegistry(t *testing.T) {
+	// both addresses belong to the same user, only one of them is in the environment
+	os.Setenv("SOLANA_ADDRESSES", "")
+	s := &SolanaWatcher{Registry: mockRegistry{
+		publicKey1: {Chain: chain.SolanaName, Address: publicKey1, User: "user-1", Labels: []string{"hot"}},
+		publicKey2: {Chain: chain.SolanaName, Address: publicKey2, User: "user-1"},
+	}}
+
+	block, _ := (&mockClient{from: publicKey1, to: publicKey2}).GetBlockWithConfig(context.Background(), 1, client.GetBlockConfig{})
+	got := s.FilterTxs(block.Transactions)
+	if len(got) != 2 {
+		t.Fatalf("expected an event for each address, got %d", len(got))
+	}
+	for _, event := range got {
+		if event.User != "user-1" {
+			t.Errorf("expected %s to belong to user-1, got %q", event.Address, event.User)
+		}
+		if event.Address == publicKey1 && !slices.Equal(event.Labels, []string{"hot"}) {
+			t.Errorf("expected labels [hot], got %v", event.Labels)
+		}
+	}
+	if chain.EventID(got[0]) == chain.EventID(got[1]) {
+		t.Errorf("expected the events of both addresses to have distinct IDs, got %s", chain.EventID(got[0]))
+	}
+}
+
+// testKey returns the i-th of distinct valid public keys.
+func testKey(i int) string {
+	k := make([]byte, 32)
+	binary.BigEndian.PutUint64(k[24:], uint64(i))
+	k[0] = 1
+	return base58.Encode(k)
+}
+
+// BenchmarkSolanaFilterTxs filters a block of 1000 transfers, one of them
+// watched, against 100k watched addresses.
+func BenchmarkSolanaFilterTxs(b *testing.B) {
+	const watched, txs = 100_000, 1000
+
+	addresses := make([]string, watched)
+	for i := range addresses {
+		addresses[i] = testKey(i)
+	}
+	os.Setenv("SOLANA_ADDRESSES", strings.Join(addresses, ","))
+	defer os.Setenv("SOLANA_ADDRESSES", "")
+
+	block := []client.BlockTransaction{}
+	for i := range txs {
+		to := testKey(watched + i)
+		if i == txs/2 {
+			to = addresses[watched/2]
+		}
+		transfer, _ := (&mockClient{from: testKey(2*watched + i), to: to}).GetBlockWithConfig(context.Background(), 1, client.GetBlockConfig{})
+		block = append(block, transfer.Transactions...)
+	}
+
+	s := &SolanaWatcher{}
+	if got := s.FilterTxs(block); len(got) != 1 {
+		b.Fatalf("expected one watched transfer, got %d", len(got))
+	}
+
+	b.ResetTimer()
+	for range b.N {
+		s.FilterTxs(block)
+	}
+}
@@ -0,0 +1,59 @@
+package checkpoint
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	bolt "go.etcd.io/bbolt"
+)
+
+var checkpointsBucket = []byte("checkpoints")
+
+// BoltCheckpointer stores checkpoints in an embedded bbolt database, one key per chain.
+type BoltCheckpointer struct {
+	db *bolt.DB
+}
+
+func NewBoltCheckpointer(path string) (*BoltCheckpointer, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(checkpointsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltCheckpointer{db: db}, nil
+}
+
+func (b *BoltCheckpointer) Load(c chain.Chain) (uint64, bool, error) {
+	var block uint64
+	var ok bool
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(checkpointsBucket).Get([]byte(c))
+		if len(v) == 8 {
+			block, ok = binary.BigEndian.Uint64(v), true
+		}
+		return nil
+	})
+
+	return block, ok, err
+}
+
+func (b *BoltCheckpointer) Save(c chain.Chain, block uint64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(checkpointsBucket).Put([]byte(c), binary.BigEndian.AppendUint64(nil, block))
+	})
+}
+
+func (b *BoltCheckpointer) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,70 @@
+package checkpoint
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+)
+
+func TestCheckpointers(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(path string) (chain.Checkpointer, error)
+	}{
+		{
+			name: "file",
+			open: func(path string) (chain.Checkpointer, error) {
+				return NewFileCheckpointer(path)
+			},
+		},
+		{
+			name: "bolt",
+			open: func(path string) (chain.Checkpointer, error) {
+				return NewBoltCheckpointer(path)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoints")
+
+			c, err := test.open(path)
+			if err != nil {
+				t.Fatalf("failed to open checkpointer: %v", err)
+			}
+
+			if _, ok, err := c.Load(chain.EthereumName); err != nil || ok {
+				t.Fatalf("expected no checkpoint, got ok=%v err=%v", ok, err)
+			}
+
+			if err := c.Save(chain.EthereumName, 100); err != nil {
+				t.Fatalf("failed to save: %v", err)
+			}
+			if err := c.Save(chain.SolanaName, 200); err != nil {
+				t.Fatalf("failed to save: %v", err)
+			}
+			if err := c.Save(chain.EthereumName, 101); err != nil {
+				t.Fatalf("failed to save: %v", err)
+			}
+
+			if closer, ok := c.(interface{ Close() error }); ok {
+				closer.Close()
+			}
+
+			// checkpoints survive a restart
+			c, err = test.open(path)
+			if err != nil {
+				t.Fatalf("failed to reopen checkpointer: %v", err)
+			}
+
+			for c2, expected := range map[chain.Chain]uint64{chain.EthereumName: 101, chain.SolanaName: 200} {
+				block, ok, err := c.Load(c2)
+				if err != nil || !ok || block != expected {
+					t.Errorf("%s: expected checkpoint %d, got %d ok=%v err=%v", c2, expected, block, ok, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+)
+
+// FileCheckpointer stores checkpoints of every chain in a single JSON file.
+type FileCheckpointer struct {
+	path string
+
+	mu          sync.Mutex
+	checkpoints map[chain.Chain]uint64
+}
+
+func NewFileCheckpointer(path string) (*FileCheckpointer, error) {
+	f := &FileCheckpointer{
+		path:        path,
+		checkpoints: map[chain.Chain]uint64{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &f.checkpoints); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *FileCheckpointer) Load(c chain.Chain) (uint64, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	block, ok := f.checkpoints[c]
+	return block, ok, nil
+}
+
+func (f *FileCheckpointer) Save(c chain.Chain, block uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.checkpoints[c] = block
+
+	data, err := json.Marshal(f.checkpoints)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so that a crash never leaves a truncated file.
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
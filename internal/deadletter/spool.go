@@ -0,0 +1,119 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+)
+
+// maxLineSize bounds a spooled dead letter, Kafka messages are at most 1MB by default.
+const maxLineSize = 4 << 20
+
+// Spool stores dead letters in a local file, one JSON object per line.
+type Spool struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewSpool(path string) *Spool {
+	return &Spool{path: path}
+}
+
+// Put appends d to the spool. The file is reopened on each call so that a
+// concurrent Redrive, which moves it aside, never loses a dead letter.
+func (s *Spool) Put(d chain.DeadLetter) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Redrive calls redrive for every spooled dead letter. Dead letters it fails
+// on are put back in the spool with one more attempt. It returns the number
+// of dead letters successfully re-driven.
+//
+// The spool is first moved aside, so new dead letters can be added meanwhile.
+// A file left aside by an interrupted Redrive is picked up by the next one.
+func (s *Spool) Redrive(redrive func(d chain.DeadLetter) error) (int, error) {
+	pending := s.path + ".redrive"
+
+	if _, err := os.Stat(pending); errors.Is(err, os.ErrNotExist) {
+		s.mu.Lock()
+		err := os.Rename(s.path, pending)
+		s.mu.Unlock()
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	letters, err := read(pending)
+	if err != nil {
+		return 0, err
+	}
+
+	redriven := 0
+	for _, d := range letters {
+		if err := redrive(d); err != nil {
+			d.Attempts++
+			d.Reason = err.Error()
+			d.At = time.Now().UTC()
+			if err := s.Put(d); err != nil {
+				return redriven, fmt.Errorf("putting back dead letter: %w", err)
+			}
+			continue
+		}
+		redriven++
+	}
+
+	return redriven, os.Remove(pending)
+}
+
+func read(path string) ([]chain.DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []chain.DeadLetter
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var d chain.DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("decoding dead letter %q: %w", scanner.Text(), err)
+		}
+		letters = append(letters, d)
+	}
+
+	return letters, scanner.Err()
+}
@@ -0,0 +1,60 @@
+package deadletter
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+)
+
+func TestSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+	spool := NewSpool(path)
+
+	if n, err := spool.Redrive(func(chain.DeadLetter) error { return nil }); n != 0 || err != nil {
+		t.Fatalf("expected nothing to re-drive on an empty spool, got %d, %v", n, err)
+	}
+
+	letters := []chain.DeadLetter{
+		{Kind: chain.DeadLetterBlock, Chain: chain.EthereumName, Block: 10, Reason: "rpc unavailable", Attempts: 6},
+		{Kind: chain.DeadLetterMessage, Value: []byte(`{"id":"0x1"}`), Reason: "kafka unavailable", Attempts: 1},
+		{Kind: chain.DeadLetterBlock, Chain: chain.SolanaName, Block: 20, Reason: "rpc unavailable", Attempts: 6},
+	}
+	for _, d := range letters {
+		if err := spool.Put(d); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	// The solana block keeps failing and must stay in the spool.
+	var seen []chain.DeadLetter
+	n, err := spool.Redrive(func(d chain.DeadLetter) error {
+		seen = append(seen, d)
+		if d.Chain == chain.SolanaName {
+			return errors.New("still unavailable")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("redrive: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 dead letters re-driven, got %d", n)
+	}
+	if len(seen) != 3 || string(seen[1].Value) != `{"id":"0x1"}` || seen[2].Block != 20 {
+		t.Errorf("unexpected dead letters re-driven: %+v", seen)
+	}
+
+	var left []chain.DeadLetter
+	n, err = spool.Redrive(func(d chain.DeadLetter) error {
+		left = append(left, d)
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 dead letter left, got %d, %v", n, err)
+	}
+	if left[0].Block != 20 || left[0].Attempts != 7 || left[0].Reason != "still unavailable" {
+		t.Errorf("unexpected dead letter left: %+v", left[0])
+	}
+}
@@ -0,0 +1,421 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+)
+
+const (
+	// offsetsTopic holds the checkpoint of each chain, keyed by chain. It is
+	// compacted so that only the last checkpoint of a chain is kept.
+	offsetsTopic = "transactions-offsets"
+
+	transactionTimeout = time.Minute
+
+	fetchMaxBytes = 1 << 20
+	fetchMaxWait  = 500 * time.Millisecond
+
+	// control record types marking the end of a transaction
+	controlAbort  = 0
+	controlCommit = 1
+)
+
+// Offsets of the fields of a v2 record batch header patched by recordBatch:
+// baseOffset int64, batchLength int32, partitionLeaderEpoch int32, magic int8,
+// crc uint32, attributes int16, lastOffsetDelta int32, firstTimestamp int64,
+// maxTimestamp int64, producerId int64, producerEpoch int16, baseSequence int32.
+const (
+	batchCRCOffset           = 8 + 4 + 4 + 1
+	batchAttributesOffset    = batchCRCOffset + 4
+	batchProducerIDOffset    = batchAttributesOffset + 2 + 4 + 8 + 8
+	batchProducerEpochOffset = batchProducerIDOffset + 8
+	batchBaseSequenceOffset  = batchProducerEpochOffset + 2
+)
+
+// TxnClient is the part of kafka.Client used by the TransactionalWriter.
+type TxnClient interface {
+	Metadata(ctx context.Context, req *kafka.MetadataRequest) (*kafka.MetadataResponse, error)
+	InitProducerID(ctx context.Context, req *kafka.InitProducerIDRequest) (*kafka.InitProducerIDResponse, error)
+	AddPartitionsToTxn(ctx context.Context, req *kafka.AddPartitionsToTxnRequest) (*kafka.AddPartitionsToTxnResponse, error)
+	RawProduce(ctx context.Context, req *kafka.RawProduceRequest) (*kafka.ProduceResponse, error)
+	EndTxn(ctx context.Context, req *kafka.EndTxnRequest) (*kafka.EndTxnResponse, error)
+	Fetch(ctx context.Context, req *kafka.FetchRequest) (*kafka.FetchResponse, error)
+}
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// TransactionalWriter is an idempotent, transactional producer publishing the
+// events of a block together with the checkpoint of its chain, so that a block
+// is either fully published and checkpointed or not at all. It implements
+// chain.Transactor, and chain.Checkpointer with the checkpoints read from the
+// offsets topic when it was created.
+type TransactionalWriter struct {
+	client          TxnClient
+	transactionalID string
+
+	mu            sync.Mutex
+	partitions    map[string][]int
+	balancer      kafka.Balancer
+	producerID    int
+	producerEpoch int
+	// sequences are the next sequence numbers of the producer session by partition.
+	sequences map[topicPartition]int32
+
+	checkpoints map[chain.Chain]uint64
+}
+
+// NewTransactionalWriter starts a producer session for transactionalID, which
+// aborts the transaction a previous instance left open and fences it, then
+// loads the committed checkpoints.
+func NewTransactionalWriter(ctx context.Context, client TxnClient, transactionalID string) (*TransactionalWriter, error) {
+	w := &TransactionalWriter{
+		client:          client,
+		transactionalID: transactionalID,
+		partitions:      map[string][]int{},
+		balancer:        &kafka.Hash{},
+	}
+
+	res, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic, offsetsTopic}})
+	if err != nil {
+		return nil, fmt.Errorf("getting metadata: %w", err)
+	}
+	for _, t := range res.Topics {
+		if t.Error != nil {
+			return nil, fmt.Errorf("getting metadata of topic %s: %w", t.Name, t.Error)
+		}
+		for _, p := range t.Partitions {
+			w.partitions[t.Name] = append(w.partitions[t.Name], p.ID)
+		}
+	}
+	for _, name := range []string{topic, offsetsTopic} {
+		if len(w.partitions[name]) == 0 {
+			return nil, fmt.Errorf("topic %s has no partitions", name)
+		}
+	}
+
+	if err := w.initProducer(ctx); err != nil {
+		return nil, err
+	}
+
+	w.checkpoints, err = w.readCheckpoints(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoints: %w", err)
+	}
+	return w, nil
+}
+
+// initProducer starts a new producer session, bumping the epoch of the transactional ID.
+func (w *TransactionalWriter) initProducer(ctx context.Context) error {
+	res, err := w.client.InitProducerID(ctx, &kafka.InitProducerIDRequest{
+		TransactionalID:      w.transactionalID,
+		TransactionTimeoutMs: int(transactionTimeout.Milliseconds()),
+	})
+	if err == nil {
+		err = res.Error
+	}
+	if err != nil {
+		return fmt.Errorf("initializing producer %s: %w", w.transactionalID, err)
+	}
+
+	w.producerID = res.Producer.ProducerID
+	w.producerEpoch = res.Producer.ProducerEpoch
+	w.sequences = map[topicPartition]int32{}
+	return nil
+}
+
+// Commit publishes msgs and the checkpoint of c, when it is not nil, in a
+// single transaction. The transaction is aborted when any step fails.
+func (w *TransactionalWriter) Commit(ctx context.Context, c chain.Chain, msgs []kafka.Message, checkpoint *uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	batches := map[topicPartition][]kafka.Message{}
+	for _, msg := range msgs {
+		tp := topicPartition{topic, w.balancer.Balance(msg, w.partitions[topic]...)}
+		batches[tp] = append(batches[tp], msg)
+	}
+	if checkpoint != nil {
+		msg := kafka.Message{Key: []byte(c), Value: []byte(strconv.FormatUint(*checkpoint, 10)), Time: time.Now()}
+		tp := topicPartition{offsetsTopic, w.balancer.Balance(msg, w.partitions[offsetsTopic]...)}
+		batches[tp] = append(batches[tp], msg)
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+
+	if err := w.commit(ctx, batches); err != nil {
+		// the state of the transaction is unknown, a new session aborts it
+		if initErr := w.initProducer(context.WithoutCancel(ctx)); initErr != nil {
+			log.Printf("error aborting Kafka transaction: %v", initErr)
+		}
+		return err
+	}
+
+	if checkpoint != nil {
+		w.checkpoints[c] = *checkpoint
+	}
+	log.Printf("✅ Committed %d %s transactions to Kafka", len(msgs), c)
+	return nil
+}
+
+func (w *TransactionalWriter) commit(ctx context.Context, batches map[topicPartition][]kafka.Message) error {
+	topics := map[string][]kafka.AddPartitionToTxn{}
+	for tp := range batches {
+		topics[tp.topic] = append(topics[tp.topic], kafka.AddPartitionToTxn{Partition: tp.partition})
+	}
+	added, err := w.client.AddPartitionsToTxn(ctx, &kafka.AddPartitionsToTxnRequest{
+		TransactionalID: w.transactionalID,
+		ProducerID:      w.producerID,
+		ProducerEpoch:   w.producerEpoch,
+		Topics:          topics,
+	})
+	if err != nil {
+		return fmt.Errorf("adding partitions to transaction: %w", err)
+	}
+	for name, partitions := range added.Topics {
+		for _, p := range partitions {
+			if p.Error != nil {
+				return fmt.Errorf("adding partition %s/%d to transaction: %w", name, p.Partition, p.Error)
+			}
+		}
+	}
+
+	for tp, msgs := range batches {
+		records, err := recordBatch(msgs, w.producerID, w.producerEpoch, w.sequences[tp])
+		if err != nil {
+			return fmt.Errorf("encoding records for %s/%d: %w", tp.topic, tp.partition, err)
+		}
+
+		res, err := w.client.RawProduce(ctx, &kafka.RawProduceRequest{
+			Topic:           tp.topic,
+			Partition:       tp.partition,
+			RequiredAcks:    kafka.RequireAll,
+			TransactionalID: w.transactionalID,
+			RawRecords:      records,
+		})
+		if err == nil {
+			err = res.Error
+		}
+		if err != nil {
+			return fmt.Errorf("producing to %s/%d: %w", tp.topic, tp.partition, err)
+		}
+		w.sequences[tp] += int32(len(msgs))
+	}
+
+	res, err := w.client.EndTxn(ctx, &kafka.EndTxnRequest{
+		TransactionalID: w.transactionalID,
+		ProducerID:      w.producerID,
+		ProducerEpoch:   w.producerEpoch,
+		Committed:       true,
+	})
+	if err == nil {
+		err = res.Error
+	}
+	if err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// Load returns the checkpoint of c committed last.
+func (w *TransactionalWriter) Load(c chain.Chain) (uint64, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	block, ok := w.checkpoints[c]
+	return block, ok, nil
+}
+
+// Save does nothing: checkpoints are committed with the events of their block.
+func (w *TransactionalWriter) Save(c chain.Chain, block uint64) error {
+	return nil
+}
+
+// Close does nothing, transactions are committed synchronously.
+func (w *TransactionalWriter) Close() error {
+	return nil
+}
+
+// recordBatch encodes msgs as a transactional record batch of the producer
+// session, starting at sequence. The batch is prefixed by its size.
+func recordBatch(msgs []kafka.Message, producerID, producerEpoch int, sequence int32) (protocol.RawRecordSet, error) {
+	records := make([]kafka.Record, len(msgs))
+	for i, msg := range msgs {
+		records[i] = kafka.Record{
+			Time:    msg.Time,
+			Key:     protocol.NewBytes(msg.Key),
+			Value:   protocol.NewBytes(msg.Value),
+			Headers: msg.Headers,
+		}
+	}
+
+	rs := protocol.RecordSet{
+		Version:    2,
+		Attributes: protocol.Transactional,
+		Records:    protocol.NewRecordReader(records...),
+	}
+	buf := &bytes.Buffer{}
+	if _, err := rs.WriteTo(buf); err != nil {
+		return protocol.RawRecordSet{}, err
+	}
+
+	// kafka-go encodes batches without producer session, set it and update the
+	// checksum, which covers the batch from its attributes
+	batch := buf.Bytes()[4:]
+	binary.BigEndian.PutUint64(batch[batchProducerIDOffset:], uint64(producerID))
+	binary.BigEndian.PutUint16(batch[batchProducerEpochOffset:], uint16(producerEpoch))
+	binary.BigEndian.PutUint32(batch[batchBaseSequenceOffset:], uint32(sequence))
+	binary.BigEndian.PutUint32(batch[batchCRCOffset:], batchChecksum(batch))
+
+	return protocol.RawRecordSet{Reader: bytes.NewReader(buf.Bytes())}, nil
+}
+
+// batchChecksum returns the CRC-32C of a v2 record batch, which covers it from its attributes.
+func batchChecksum(batch []byte) uint32 {
+	return crc32.Checksum(batch[batchAttributesOffset:], crc32.MakeTable(crc32.Castagnoli))
+}
+
+// readCheckpoints reads the committed checkpoints of the offsets topic, the
+// last one of each chain wins.
+func (w *TransactionalWriter) readCheckpoints(ctx context.Context) (map[chain.Chain]uint64, error) {
+	checkpoints := map[chain.Chain]uint64{}
+	for _, partition := range w.partitions[offsetsTopic] {
+		if err := w.readPartition(ctx, partition, checkpoints); err != nil {
+			return nil, fmt.Errorf("reading %s/%d: %w", offsetsTopic, partition, err)
+		}
+	}
+	return checkpoints, nil
+}
+
+// readPartition reads a partition of the offsets topic up to its last stable
+// offset. Transactional records are only applied once their commit marker is read.
+func (w *TransactionalWriter) readPartition(ctx context.Context, partition int, checkpoints map[chain.Chain]uint64) error {
+	pending := map[int64][]*protocol.Record{}
+	apply := func(r *protocol.Record) error {
+		key, err := protocol.ReadAll(r.Key)
+		if err != nil {
+			return err
+		}
+		value, err := protocol.ReadAll(r.Value)
+		if err != nil {
+			return err
+		}
+		block, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid checkpoint %q of %s: %w", value, key, err)
+		}
+		checkpoints[chain.Chain(key)] = block
+		return nil
+	}
+
+	offset := kafka.FirstOffset
+	for {
+		res, err := w.client.Fetch(ctx, &kafka.FetchRequest{
+			Topic:          offsetsTopic,
+			Partition:      partition,
+			Offset:         offset,
+			MinBytes:       1,
+			MaxBytes:       fetchMaxBytes,
+			MaxWait:        fetchMaxWait,
+			IsolationLevel: kafka.ReadCommitted,
+		})
+		if err == nil {
+			err = res.Error
+		}
+		if err != nil {
+			return err
+		}
+		if offset < 0 {
+			offset = res.LogStartOffset
+		}
+		if offset >= res.LastStableOffset {
+			return nil
+		}
+
+		batches := []protocol.RecordReader{res.Records}
+		if stream, ok := res.Records.(*protocol.RecordStream); ok {
+			batches = stream.Records
+		}
+
+		start := offset
+		for _, batch := range batches {
+			if control, ok := batch.(*protocol.ControlBatch); ok {
+				if control.BaseOffset < offset {
+					continue
+				}
+				marker, err := control.ReadControlRecord()
+				if err != nil {
+					return err
+				}
+				if marker.Type == controlCommit {
+					for _, r := range pending[control.ProducerID] {
+						if err := apply(r); err != nil {
+							return err
+						}
+					}
+				}
+				delete(pending, control.ProducerID)
+				offset = control.BaseOffset + 1
+				continue
+			}
+
+			rb, transactional := batch.(*protocol.RecordBatch)
+			transactional = transactional && rb.Attributes.Transactional()
+			for {
+				r, err := batch.ReadRecord()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if r.Offset < offset {
+					continue
+				}
+				offset = r.Offset + 1
+
+				if transactional {
+					if r, err = bufferRecord(r); err != nil {
+						return err
+					}
+					pending[rb.ProducerID] = append(pending[rb.ProducerID], r)
+				} else if err := apply(r); err != nil {
+					return err
+				}
+			}
+		}
+		if offset == start {
+			// nothing readable below the last stable offset, e.g. only compacted away batches
+			return nil
+		}
+	}
+}
+
+// bufferRecord copies the key and value of r, which are only valid until the next record is read.
+func bufferRecord(r *protocol.Record) (*protocol.Record, error) {
+	key, err := protocol.ReadAll(r.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := protocol.ReadAll(r.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Record{Offset: r.Offset, Key: protocol.NewBytes(key), Value: protocol.NewBytes(value)}, nil
+}
@@ -0,0 +1,196 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTxnClient struct {
+	epoch    int
+	calls    []string
+	produced map[string][]*kafkago.RawProduceRequest
+	failTo   string
+	offsets  []protocol.RecordReader
+}
+
+func (m *mockTxnClient) Metadata(ctx context.Context, req *kafkago.MetadataRequest) (*kafkago.MetadataResponse, error) {
+	res := &kafkago.MetadataResponse{}
+	for _, name := range req.Topics {
+		res.Topics = append(res.Topics, kafkago.Topic{Name: name, Partitions: []kafkago.Partition{{Topic: name, ID: 0}}})
+	}
+	return res, nil
+}
+
+func (m *mockTxnClient) InitProducerID(ctx context.Context, req *kafkago.InitProducerIDRequest) (*kafkago.InitProducerIDResponse, error) {
+	m.calls = append(m.calls, "init")
+	m.epoch++
+	return &kafkago.InitProducerIDResponse{Producer: &kafkago.ProducerSession{ProducerID: 7, ProducerEpoch: m.epoch}}, nil
+}
+
+func (m *mockTxnClient) AddPartitionsToTxn(ctx context.Context,
+	req *kafkago.AddPartitionsToTxnRequest) (*kafkago.AddPartitionsToTxnResponse, error) {
+	m.calls = append(m.calls, "add")
+	return &kafkago.AddPartitionsToTxnResponse{}, nil
+}
+
+func (m *mockTxnClient) RawProduce(ctx context.Context, req *kafkago.RawProduceRequest) (*kafkago.ProduceResponse, error) {
+	m.calls = append(m.calls, "produce "+req.Topic)
+	if req.Topic == m.failTo {
+		return &kafkago.ProduceResponse{Error: kafkago.NotEnoughReplicas}, nil
+	}
+	if m.produced == nil {
+		m.produced = map[string][]*kafkago.RawProduceRequest{}
+	}
+	m.produced[req.Topic] = append(m.produced[req.Topic], req)
+	return &kafkago.ProduceResponse{}, nil
+}
+
+func (m *mockTxnClient) EndTxn(ctx context.Context, req *kafkago.EndTxnRequest) (*kafkago.EndTxnResponse, error) {
+	m.calls = append(m.calls, "commit")
+	return &kafkago.EndTxnResponse{}, nil
+}
+
+func (m *mockTxnClient) Fetch(ctx context.Context, req *kafkago.FetchRequest) (*kafkago.FetchResponse, error) {
+	if req.Offset > 0 {
+		return &kafkago.FetchResponse{LastStableOffset: 4, Records: kafkago.NewRecordReader()}, nil
+	}
+	return &kafkago.FetchResponse{
+		LastStableOffset: 4,
+		Records:          &protocol.RecordStream{Records: m.offsets},
+	}, nil
+}
+
+// decodeBatch decodes the record batch of a produce request.
+func decodeBatch(t *testing.T, req *kafkago.RawProduceRequest) (*protocol.RecordBatch, []string) {
+	rs := protocol.RecordSet{}
+	_, err := rs.ReadFrom(req.RawRecords.Reader)
+	assert.NoError(t, err)
+
+	batch := rs.Records.(*protocol.RecordStream).Records[0].(*protocol.RecordBatch)
+	var values []string
+	for {
+		r, err := batch.ReadRecord()
+		if err != nil {
+			break
+		}
+		value, _ := protocol.ReadAll(r.Value)
+		values = append(values, string(value))
+	}
+	return batch, values
+}
+
+func checkpointRecord(offset int64, c chain.Chain, block string) kafkago.Record {
+	return kafkago.Record{Offset: offset, Key: protocol.NewBytes([]byte(c)), Value: protocol.NewBytes([]byte(block))}
+}
+
+func TestTransactionalWriterLoad(t *testing.T) {
+	client := &mockTxnClient{offsets: []protocol.RecordReader{
+		&protocol.RecordBatch{
+			Attributes: protocol.Transactional, BaseOffset: 0, ProducerID: 3,
+			Records: protocol.NewRecordReader(checkpointRecord(0, chain.SolanaName, "10")),
+		},
+		protocol.NewControlBatch(protocol.ControlRecord{Offset: 1, Type: controlCommit}),
+		&protocol.RecordBatch{
+			Attributes: protocol.Transactional, BaseOffset: 2, ProducerID: 3,
+			Records: protocol.NewRecordReader(checkpointRecord(2, chain.SolanaName, "11")),
+		},
+		protocol.NewControlBatch(protocol.ControlRecord{Offset: 3, Type: controlAbort}),
+	}}
+	// control batches built by kafka-go carry no offset nor producer
+	client.offsets[1].(*protocol.ControlBatch).BaseOffset, client.offsets[1].(*protocol.ControlBatch).ProducerID = 1, 3
+	client.offsets[3].(*protocol.ControlBatch).BaseOffset, client.offsets[3].(*protocol.ControlBatch).ProducerID = 3, 3
+
+	w, err := NewTransactionalWriter(context.Background(), client, "test")
+	assert.NoError(t, err)
+
+	block, ok, err := w.Load(chain.SolanaName)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10), block, "the aborted checkpoint must be ignored")
+
+	_, ok, _ = w.Load(chain.EthereumName)
+	assert.False(t, ok)
+}
+
+func TestTransactionalWriterCommit(t *testing.T) {
+	client := &mockTxnClient{}
+	w, err := NewTransactionalWriter(context.Background(), client, "test")
+	assert.NoError(t, err)
+
+	block := uint64(42)
+	msgs := []kafkago.Message{{Value: []byte("tx1")}, {Value: []byte("tx2")}}
+	assert.NoError(t, w.Commit(context.Background(), chain.SolanaName, msgs, &block))
+	assert.NoError(t, w.Commit(context.Background(), chain.SolanaName, msgs[:1], nil))
+
+	events := client.produced[topic]
+	assert.Len(t, events, 2)
+	batch, values := decodeBatch(t, events[0])
+	assert.True(t, batch.Attributes.Transactional())
+	assert.Equal(t, int64(7), batch.ProducerID)
+	assert.Equal(t, int16(1), batch.ProducerEpoch)
+	assert.Equal(t, int32(0), batch.BaseSequence)
+	assert.Equal(t, []string{"tx1", "tx2"}, values)
+
+	batch, _ = decodeBatch(t, events[1])
+	assert.Equal(t, int32(2), batch.BaseSequence, "sequences continue across transactions")
+
+	assert.Len(t, client.produced[offsetsTopic], 1, "only the first commit carries a checkpoint")
+	_, values = decodeBatch(t, client.produced[offsetsTopic][0])
+	assert.Equal(t, []string{"42"}, values)
+
+	got, ok, _ := w.Load(chain.SolanaName)
+	assert.True(t, ok)
+	assert.Equal(t, block, got)
+
+	// a failed transaction is aborted by starting a new producer session
+	client.failTo = offsetsTopic
+	client.calls = nil
+	block++
+	assert.Error(t, w.Commit(context.Background(), chain.SolanaName, msgs, &block))
+	assert.NotContains(t, client.calls, "commit")
+	assert.Equal(t, "init", client.calls[len(client.calls)-1])
+
+	got, _, _ = w.Load(chain.SolanaName)
+	assert.Equal(t, uint64(42), got, "the checkpoint of an aborted transaction is not loaded")
+
+	client.failTo = ""
+	assert.NoError(t, w.Commit(context.Background(), chain.SolanaName, msgs, &block))
+	batch, _ = decodeBatch(t, client.produced[topic][len(client.produced[topic])-1])
+	assert.Equal(t, int16(2), batch.ProducerEpoch)
+	assert.Equal(t, int32(0), batch.BaseSequence, "sequences restart with the session")
+}
+
+func TestRecordBatch(t *testing.T) {
+	msgs := []kafkago.Message{
+		{Key: []byte("solana:user-1"), Value: []byte("tx1"), Headers: []kafkago.Header{{Key: "event_id", Value: []byte("e1")}}},
+		{Key: []byte("solana:user-2"), Value: []byte("tx2")},
+	}
+	rs, err := recordBatch(msgs, 7, 3, 42)
+	assert.NoError(t, err)
+	raw, err := io.ReadAll(rs.Reader)
+	assert.NoError(t, err)
+
+	// the CRC-32C covers the batch from its attributes, after the size prefix,
+	// base offset, batch length, leader epoch, magic byte and the CRC itself
+	batch := raw[4:]
+	assert.Equal(t, byte(2), batch[16], "expected a v2 batch")
+	assert.Equal(t, crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)), binary.BigEndian.Uint32(batch[17:]),
+		"checksum mismatch")
+
+	// the patched fields decode where the v2 layout puts them, with the records untouched
+	decoded, values := decodeBatch(t, &kafkago.RawProduceRequest{RawRecords: protocol.RawRecordSet{Reader: bytes.NewReader(raw)}})
+	assert.True(t, decoded.Attributes.Transactional())
+	assert.Equal(t, int64(7), decoded.ProducerID)
+	assert.Equal(t, int16(3), decoded.ProducerEpoch)
+	assert.Equal(t, int32(42), decoded.BaseSequence)
+	assert.Equal(t, []string{"tx1", "tx2"}, values)
+}
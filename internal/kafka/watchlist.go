@@ -0,0 +1,315 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+)
+
+// watchlistRetryDelay is the pause before reading the watchlist topic again after an error.
+const watchlistRetryDelay = time.Second
+
+// WatchlistClient is the part of kafka.Client used by the Watchlist.
+type WatchlistClient interface {
+	Metadata(ctx context.Context, req *kafka.MetadataRequest) (*kafka.MetadataResponse, error)
+	Fetch(ctx context.Context, req *kafka.FetchRequest) (*kafka.FetchResponse, error)
+}
+
+// Watchlist is a chain.Registry driven by a compacted topic keyed by
+// chain:address, whose values are the IDs of the users owning the addresses,
+// and tombstones the removed ones. Invalid addresses are reported and skipped. Every replica reads the whole topic, so
+// that they all converge on the same watchlist. It is exclusive: the addresses
+// of the environment are not watched.
+type Watchlist struct {
+	client     WatchlistClient
+	topic      string
+	partitions []int
+	// offsets are the next offsets to read by partition. Like pending, keys and
+	// stale, they are only used by the reading goroutine.
+	offsets map[int]int64
+	// pending are the records of the open transactions by partition and producer,
+	// applied once their commit marker is read.
+	pending map[int]map[int64][]*protocol.Record
+	// keys are the chain:address keys read by partition.
+	keys map[int]map[string]bool
+	// stale are the keys of a partition read again from its start, not read
+	// again yet. Those left at its end were compacted or deleted and are removed.
+	stale map[int]map[string]bool
+
+	mu       sync.RWMutex
+	accounts map[string]chain.Account
+	indexes  map[chain.Chain]*chain.AddressIndex
+}
+
+// NewWatchlist reads topic up to its end, so that the watchers start with the
+// whole watchlist. Run then follows its changes.
+func NewWatchlist(ctx context.Context, client WatchlistClient, topic string) (*Watchlist, error) {
+	w := &Watchlist{
+		client:   client,
+		topic:    topic,
+		offsets:  map[int]int64{},
+		pending:  map[int]map[int64][]*protocol.Record{},
+		keys:     map[int]map[string]bool{},
+		stale:    map[int]map[string]bool{},
+		accounts: map[string]chain.Account{},
+		indexes:  map[chain.Chain]*chain.AddressIndex{},
+	}
+
+	res, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, fmt.Errorf("getting metadata: %w", err)
+	}
+	for _, t := range res.Topics {
+		if t.Error != nil {
+			return nil, fmt.Errorf("getting metadata of topic %s: %w", t.Name, t.Error)
+		}
+		for _, p := range t.Partitions {
+			w.partitions = append(w.partitions, p.ID)
+			w.offsets[p.ID] = kafka.FirstOffset
+		}
+	}
+	if len(w.partitions) == 0 {
+		return nil, fmt.Errorf("topic %s has no partitions", topic)
+	}
+
+	for _, partition := range w.partitions {
+		for end := false; !end; {
+			if end, err = w.fetch(ctx, partition); err != nil {
+				return nil, fmt.Errorf("reading %s/%d: %w", topic, partition, err)
+			}
+		}
+	}
+	return w, nil
+}
+
+// Run follows the changes of the watchlist until ctx is done.
+func (w *Watchlist) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		for _, partition := range w.partitions {
+			_, err := w.fetch(ctx, partition)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+
+			log.Printf("error reading watchlist %s/%d: %v", w.topic, partition, err)
+			if errors.Is(err, kafka.OffsetOutOfRange) {
+				// the records were compacted or deleted, read the partition again
+				w.reset(partition)
+			}
+			chain.Sleep(ctx, watchlistRetryDelay)
+		}
+	}
+}
+
+func (w *Watchlist) Lookup(c chain.Chain, address string) (chain.Account, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	account, ok := w.accounts[string(c)+":"+address]
+	return account, ok
+}
+
+func (w *Watchlist) Addresses(c chain.Chain) []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.indexes[c].Addresses()
+}
+
+func (w *Watchlist) Index(c chain.Chain) *chain.AddressIndex {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.indexes[c]
+}
+
+// Exclusive reports that the watchlist replaces the addresses of the environment.
+func (w *Watchlist) Exclusive() bool {
+	return true
+}
+
+// fetch applies the next records of partition, and reports whether it reached
+// the end of the partition.
+func (w *Watchlist) fetch(ctx context.Context, partition int) (bool, error) {
+	res, err := w.client.Fetch(ctx, &kafka.FetchRequest{
+		Topic:          w.topic,
+		Partition:      partition,
+		Offset:         w.offsets[partition],
+		MinBytes:       1,
+		MaxBytes:       fetchMaxBytes,
+		MaxWait:        fetchMaxWait,
+		IsolationLevel: kafka.ReadCommitted,
+	})
+	if err == nil {
+		err = res.Error
+	}
+	if err != nil {
+		return false, err
+	}
+
+	offset := w.offsets[partition]
+	if offset < 0 {
+		offset = res.LogStartOffset
+	}
+	start := offset
+
+	batches := []protocol.RecordReader{res.Records}
+	if stream, ok := res.Records.(*protocol.RecordStream); ok {
+		batches = stream.Records
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, batch := range batches {
+		if control, ok := batch.(*protocol.ControlBatch); ok {
+			if control.BaseOffset < offset {
+				continue
+			}
+			marker, err := control.ReadControlRecord()
+			if err != nil {
+				return false, err
+			}
+			// records of aborted transactions are returned below the last stable offset too
+			if marker.Type == controlCommit {
+				for _, r := range w.pending[partition][control.ProducerID] {
+					w.apply(partition, r)
+				}
+			}
+			delete(w.pending[partition], control.ProducerID)
+			offset = control.BaseOffset + 1
+			continue
+		}
+
+		rb, transactional := batch.(*protocol.RecordBatch)
+		transactional = transactional && rb.Attributes.Transactional()
+		for {
+			r, err := batch.ReadRecord()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return false, err
+			}
+			if r.Offset < offset {
+				continue
+			}
+			offset = r.Offset + 1
+
+			if !transactional {
+				w.apply(partition, r)
+				continue
+			}
+			if r, err = bufferRecord(r); err != nil {
+				return false, err
+			}
+			if w.pending[partition] == nil {
+				w.pending[partition] = map[int64][]*protocol.Record{}
+			}
+			w.pending[partition][rb.ProducerID] = append(w.pending[partition][rb.ProducerID], r)
+		}
+	}
+	w.offsets[partition] = offset
+
+	// records are read committed, up to the last stable offset: those of open
+	// transactions are read once committed. Nothing readable below it, e.g.
+	// only compacted away batches, is the end of the partition too.
+	end := offset >= res.LastStableOffset || offset == start
+	if end {
+		for k := range w.stale[partition] {
+			w.remove(partition, k)
+		}
+		delete(w.stale, partition)
+	}
+	return end, nil
+}
+
+// reset reads partition again from its start. Its addresses stay watched
+// meanwhile, those not read again are removed once it is read up to its end.
+func (w *Watchlist) reset(partition int) {
+	stale := map[string]bool{}
+	for k := range w.keys[partition] {
+		stale[k] = true
+	}
+	w.stale[partition] = stale
+	delete(w.pending, partition)
+	w.offsets[partition] = kafka.FirstOffset
+}
+
+// apply applies a record of partition, logging and skipping it when invalid.
+func (w *Watchlist) apply(partition int, r *protocol.Record) {
+	k, err := w.applyRecord(r)
+	if err != nil {
+		log.Printf("skipping watchlist record %s/%d@%d: %v", w.topic, partition, r.Offset, err)
+		return
+	}
+
+	delete(w.stale[partition], k)
+	if _, ok := w.accounts[k]; !ok {
+		delete(w.keys[partition], k)
+		return
+	}
+	if w.keys[partition] == nil {
+		w.keys[partition] = map[string]bool{}
+	}
+	w.keys[partition][k] = true
+}
+
+// remove removes the account of the chain:address key k read in partition.
+func (w *Watchlist) remove(partition int, k string) {
+	if account, ok := w.accounts[k]; ok {
+		delete(w.accounts, k)
+		w.indexes[account.Chain].Remove(account.Address)
+	}
+	delete(w.keys[partition], k)
+}
+
+// applyRecord adds the account of a record, or removes it for a tombstone,
+// and returns its chain:address key.
+func (w *Watchlist) applyRecord(r *protocol.Record) (string, error) {
+	key, err := protocol.ReadAll(r.Key)
+	if err != nil {
+		return "", err
+	}
+	c, address, ok := strings.Cut(string(key), ":")
+	if !ok || c == "" || address == "" {
+		return "", fmt.Errorf("invalid key %q, expected chain:address", key)
+	}
+	address, err = chain.NormalizeAddress(chain.Chain(c), address)
+	if err != nil {
+		return "", err
+	}
+	k := c + ":" + address
+
+	var user []byte
+	if r.Value != nil {
+		if user, err = protocol.ReadAll(r.Value); err != nil {
+			return "", err
+		}
+	}
+
+	index := w.indexes[chain.Chain(c)]
+	if index == nil {
+		index = chain.NewAddressIndex(chain.AddressBloomFilter)
+		w.indexes[chain.Chain(c)] = index
+	}
+
+	if len(user) == 0 {
+		delete(w.accounts, k)
+		index.Remove(address)
+		return k, nil
+	}
+
+	w.accounts[k] = chain.Account{Chain: chain.Chain(c), Address: address, User: string(user)}
+	index.Add(address)
+	return k, nil
+}
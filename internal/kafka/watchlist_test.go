@@ -0,0 +1,230 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockWatchlistClient struct {
+	mu      sync.Mutex
+	records []kafkago.Record
+	// pending is the number of last records in an open transaction
+	pending int
+	fetches int
+}
+
+func (m *mockWatchlistClient) Metadata(ctx context.Context, req *kafkago.MetadataRequest) (*kafkago.MetadataResponse, error) {
+	return (&mockTxnClient{}).Metadata(ctx, req)
+}
+
+func (m *mockWatchlistClient) Fetch(ctx context.Context, req *kafkago.FetchRequest) (*kafkago.FetchResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fetches++
+	stable := int64(len(m.records) - m.pending)
+
+	var records []kafkago.Record
+	for _, r := range m.records {
+		if r.Offset >= req.Offset && r.Offset < stable {
+			records = append(records, r)
+		}
+	}
+	return &kafkago.FetchResponse{
+		HighWatermark:    int64(len(m.records)),
+		LastStableOffset: stable,
+		Records:          protocol.NewRecordReader(records...),
+	}, nil
+}
+
+func (m *mockWatchlistClient) add(key, user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := kafkago.Record{Offset: int64(len(m.records)), Key: protocol.NewBytes([]byte(key))}
+	if user != "" {
+		r.Value = protocol.NewBytes([]byte(user))
+	}
+	m.records = append(m.records, r)
+}
+
+func TestWatchlist(t *testing.T) {
+	const (
+		solana1  = "ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49"
+		solana2  = "CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF"
+		solana3  = "bUz1BcqoGdWC32C5EfA5UVoCqTibxBSTtztjwwcQBQR"
+		bitcoin1 = "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+	)
+
+	client := &mockWatchlistClient{}
+	client.add("solana:"+solana1, "user-1")
+	client.add("solana:"+solana2, "user-1")
+	client.add("bitcoin:"+strings.ToUpper(bitcoin1), "user-2")
+	// invalid records are skipped
+	client.add("no-chain", "user-3")
+	client.add("solana:So4", "user-3")
+	// tombstone
+	client.add("solana:"+solana2, "")
+	// not committed yet
+	client.add("solana:"+solana3, "user-4")
+	client.pending = 1
+
+	w, err := NewWatchlist(context.Background(), client, "watchlist")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, client.fetches, "expected the catch-up to stop at the last stable offset")
+
+	assert.Equal(t, []string{solana1}, w.Addresses(chain.SolanaName))
+	// addresses are normalized
+	account, ok := w.Lookup(chain.BitcoinName, bitcoin1)
+	assert.True(t, ok)
+	assert.Equal(t, chain.Account{Chain: chain.BitcoinName, Address: bitcoin1, User: "user-2"}, account)
+
+	// the watchlist replaces the addresses of the environment
+	t.Setenv("SOLANA_ADDRESSES", solana2)
+	assert.Equal(t, []string{solana1}, chain.Watchlist(chain.SolanaName, "SOLANA_ADDRESSES", w))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	client.mu.Lock()
+	client.pending = 0
+	client.mu.Unlock()
+	client.add("solana:"+solana1, "")
+	assert.Eventually(t, func() bool {
+		_, present := w.Lookup(chain.SolanaName, solana1)
+		return !present && len(w.Addresses(chain.SolanaName)) == 1 && w.Addresses(chain.SolanaName)[0] == solana3
+	}, time.Second, 10*time.Millisecond)
+}
+
+// mockStreamClient returns the fetch response of each offset, the error of the
+// offsets in outOfRange.
+type mockStreamClient struct {
+	mu         sync.Mutex
+	responses  map[int64]func() *kafkago.FetchResponse
+	outOfRange map[int64]bool
+}
+
+func (m *mockStreamClient) Metadata(ctx context.Context, req *kafkago.MetadataRequest) (*kafkago.MetadataResponse, error) {
+	return (&mockTxnClient{}).Metadata(ctx, req)
+}
+
+func (m *mockStreamClient) Fetch(ctx context.Context, req *kafkago.FetchRequest) (*kafkago.FetchResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.outOfRange[req.Offset] {
+		return nil, kafkago.OffsetOutOfRange
+	}
+	if response, ok := m.responses[req.Offset]; ok {
+		return response(), nil
+	}
+	return nil, fmt.Errorf("unexpected fetch at offset %d", req.Offset)
+}
+
+func (m *mockStreamClient) respond(offset, logStart, stable int64, batches ...func() protocol.RecordReader) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.responses[offset] = func() *kafkago.FetchResponse {
+		records := make([]protocol.RecordReader, len(batches))
+		for i, batch := range batches {
+			records[i] = batch()
+		}
+		return &kafkago.FetchResponse{
+			LogStartOffset:   logStart,
+			LastStableOffset: stable,
+			Records:          &protocol.RecordStream{Records: records},
+		}
+	}
+}
+
+func watchlistRecord(offset int64, key, user string) kafkago.Record {
+	return kafkago.Record{Offset: offset, Key: protocol.NewBytes([]byte(key)), Value: protocol.NewBytes([]byte(user))}
+}
+
+func txnBatch(producerID int64, records ...kafkago.Record) func() protocol.RecordReader {
+	return func() protocol.RecordReader {
+		batch := &protocol.RecordBatch{Records: protocol.NewRecordReader(records...), ProducerID: producerID}
+		if producerID != 0 {
+			batch.Attributes = protocol.Transactional
+		}
+		return batch
+	}
+}
+
+func markerBatch(offset, producerID int64, markerType int16) func() protocol.RecordReader {
+	return func() protocol.RecordReader {
+		batch := protocol.NewControlBatch(protocol.ControlRecord{Offset: offset, Type: markerType})
+		// control batches built by kafka-go carry no offset nor producer
+		batch.BaseOffset, batch.ProducerID = offset, producerID
+		return batch
+	}
+}
+
+func TestWatchlistAbortedTransaction(t *testing.T) {
+	const (
+		solana1 = "ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49"
+		solana2 = "CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF"
+	)
+
+	client := &mockStreamClient{responses: map[int64]func() *kafkago.FetchResponse{}}
+	client.respond(kafkago.FirstOffset, 0, 4,
+		txnBatch(3, watchlistRecord(0, "solana:"+solana1, "user-1")),
+		txnBatch(4, watchlistRecord(1, "solana:"+solana2, "user-2")),
+		markerBatch(2, 3, controlAbort))
+	// the commit marker comes with the next fetch
+	client.respond(3, 0, 4, markerBatch(3, 4, controlCommit))
+
+	w, err := NewWatchlist(context.Background(), client, "watchlist")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{solana2}, w.Addresses(chain.SolanaName), "the aborted record must be ignored")
+	_, ok := w.Lookup(chain.SolanaName, solana1)
+	assert.False(t, ok)
+}
+
+func TestWatchlistOffsetOutOfRange(t *testing.T) {
+	const (
+		solana1 = "ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49"
+		solana2 = "CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF"
+		solana3 = "bUz1BcqoGdWC32C5EfA5UVoCqTibxBSTtztjwwcQBQR"
+	)
+
+	client := &mockStreamClient{responses: map[int64]func() *kafkago.FetchResponse{}}
+	client.respond(kafkago.FirstOffset, 0, 2, txnBatch(0,
+		watchlistRecord(0, "solana:"+solana1, "user-1"),
+		watchlistRecord(1, "solana:"+solana2, "user-2")))
+
+	w, err := NewWatchlist(context.Background(), client, "watchlist")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{solana1, solana2}, w.Addresses(chain.SolanaName))
+
+	// solana1 was removed, then its tombstone compacted away before being read
+	client.mu.Lock()
+	client.outOfRange = map[int64]bool{2: true}
+	client.mu.Unlock()
+	client.respond(kafkago.FirstOffset, 3, 5, txnBatch(0,
+		watchlistRecord(3, "solana:"+solana2, "user-2"),
+		watchlistRecord(4, "solana:"+solana3, "user-3")))
+	client.respond(5, 3, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	assert.Eventually(t, func() bool {
+		_, present := w.Lookup(chain.SolanaName, solana1)
+		addresses := w.Addresses(chain.SolanaName)
+		return !present && len(addresses) == 2 && addresses[0] == solana2 && addresses[1] == solana3
+	}, 3*time.Second, 10*time.Millisecond)
+}
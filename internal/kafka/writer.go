@@ -2,9 +2,11 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
 	"github.com/segmentio/kafka-go"
 )
 
@@ -27,6 +29,10 @@ func InitKafkaWriter() *kafka.Writer {
 	return kafka.NewWriter(kafka.WriterConfig{
 		Brokers: []string{broker},
 		Topic:   topic,
+		// events with the same key go to the same partition, in order
+		Balancer: &kafka.Hash{},
+		// messages are acknowledged once written to every in-sync replica
+		RequiredAcks: int(kafka.RequireAll),
 	})
 }
 
@@ -44,7 +50,50 @@ func CreateKafkaTopic() error {
 	})
 }
 
-func StartKafka(msgChan <-chan kafka.Message, writer Writer) {
+// CreateOffsetsTopic creates the compacted topic of the checkpoints committed
+// with the events in exactly-once mode.
+func CreateOffsetsTopic() error {
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.CreateTopics(kafka.TopicConfig{
+		Topic:             offsetsTopic,
+		NumPartitions:     numPartitions,
+		ReplicationFactor: replicationFactor,
+		ConfigEntries:     []kafka.ConfigEntry{{ConfigName: "cleanup.policy", ConfigValue: "compact"}},
+	})
+}
+
+// CreateWatchlistTopic creates the compacted topic of the watched addresses
+// when it does not exist yet, see Watchlist.
+func CreateWatchlistTopic(name string) error {
+	conn, err := kafka.Dial("tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.CreateTopics(kafka.TopicConfig{
+		Topic:             name,
+		NumPartitions:     numPartitions,
+		ReplicationFactor: replicationFactor,
+		ConfigEntries:     []kafka.ConfigEntry{{ConfigName: "cleanup.policy", ConfigValue: "compact"}},
+	})
+}
+
+// NewClient returns the client of the TransactionalWriter and the Watchlist.
+func NewClient() *kafka.Client {
+	return &kafka.Client{Addr: kafka.TCP(broker)}
+}
+
+// StartKafka writes the messages of msgChan to Kafka in batches. Messages
+// carrying a chain.Ack are acknowledged once written. Messages without one
+// that cannot be written are sent to deadLetters. Once ctx is done, the
+// messages already in msgChan are flushed before returning.
+func StartKafka(ctx context.Context, msgChan <-chan kafka.Message, writer Writer, deadLetters chain.DeadLetterQueue) {
 	ticker := time.NewTicker(flushInterval)
 	defer ticker.Stop()
 
@@ -56,23 +105,66 @@ func StartKafka(msgChan <-chan kafka.Message, writer Writer) {
 			batch = append(batch, msg)
 
 			if len(batch) >= batchSize {
-				flushBatch(writer, &batch)
+				flushBatch(ctx, writer, deadLetters, &batch)
 			}
 
 		case <-ticker.C:
 			if len(batch) > 0 {
-				flushBatch(writer, &batch)
+				flushBatch(ctx, writer, deadLetters, &batch)
 			}
+
+		case <-ctx.Done():
+			// the final flush must not be cancelled, the caller bounds the shutdown
+			ctx := context.WithoutCancel(ctx)
+			for len(msgChan) > 0 {
+				batch = append(batch, <-msgChan)
+				if len(batch) >= batchSize {
+					flushBatch(ctx, writer, deadLetters, &batch)
+				}
+			}
+			if len(batch) > 0 {
+				flushBatch(ctx, writer, deadLetters, &batch)
+			}
+			return
 		}
 	}
 }
 
-func flushBatch(writer Writer, batch *[]kafka.Message) {
-	err := writer.WriteMessages(context.Background(), (*batch)...)
+func flushBatch(ctx context.Context, writer Writer, deadLetters chain.DeadLetterQueue, batch *[]kafka.Message) {
+	err := writer.WriteMessages(ctx, (*batch)...)
 	if err != nil {
 		log.Printf("Kafka write error: %v", err)
 	} else {
 		log.Printf("✅ Wrote %d transactions to Kafka", len(*batch))
 	}
+
+	for i, msg := range *batch {
+		msgErr := messageError(err, i)
+
+		if ack, ok := msg.WriterData.(chain.Ack); ok {
+			// the sender of an acknowledged message handles its failure
+			ack(msgErr)
+			continue
+		}
+		if msgErr != nil {
+			chain.PutDeadLetter(deadLetters, chain.DeadLetter{
+				Kind:     chain.DeadLetterMessage,
+				Key:      msg.Key,
+				Value:    msg.Value,
+				Headers:  msg.Headers,
+				Reason:   msgErr.Error(),
+				Attempts: 1,
+			})
+		}
+	}
 	*batch = (*batch)[:0]
 }
+
+// messageError returns the error of the i-th message of a batch written with err.
+func messageError(err error, i int) error {
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) && i < len(writeErrs) {
+		return writeErrs[i]
+	}
+	return err
+}
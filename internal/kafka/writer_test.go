@@ -3,9 +3,14 @@ package kafka
 
 import (
 	"context"
+	"errors"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/deadletter"
 	"github.com/segmentio/kafka-go"
 	kafkago "github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
@@ -29,7 +34,7 @@ func TestStartKafka(t *testing.T) {
 
 	c := make(chan kafkago.Message, 10)
 
-	go StartKafka(c, writer)
+	go StartKafka(context.Background(), c, writer, nil)
 
 	c <- kafka.Message{Key: []byte("key"), Value: []byte("value")}
 
@@ -40,3 +45,108 @@ func TestStartKafka(t *testing.T) {
 
 	writer.AssertExpectations(t)
 }
+
+type failingWriter struct{}
+
+func (failingWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	return errors.New("kafka unavailable")
+}
+
+type memoryDeadLetters struct {
+	mu      sync.Mutex
+	letters []chain.DeadLetter
+}
+
+func (m *memoryDeadLetters) Put(d chain.DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, d)
+	return nil
+}
+
+func TestStartKafkaDeadLetters(t *testing.T) {
+	deadLetters := &memoryDeadLetters{}
+	c := make(chan kafkago.Message, 10)
+
+	go StartKafka(context.Background(), c, failingWriter{}, deadLetters)
+
+	acked := make(chan error, 1)
+	c <- kafka.Message{Key: []byte("key"), Value: []byte("value")}
+	// a message carrying an ack is reported to its sender instead
+	c <- kafka.Message{Value: []byte("acked"), WriterData: chain.Ack(func(err error) { acked <- err })}
+
+	time.Sleep(flushInterval + time.Second)
+
+	select {
+	case err := <-acked:
+		assert.EqualError(t, err, "kafka unavailable")
+	default:
+		t.Error("expected the message to be acknowledged with the write error")
+	}
+
+	deadLetters.mu.Lock()
+	defer deadLetters.mu.Unlock()
+
+	assert.Len(t, deadLetters.letters, 1)
+	assert.Equal(t, chain.DeadLetterMessage, deadLetters.letters[0].Kind)
+	assert.Equal(t, "value", string(deadLetters.letters[0].Value))
+	assert.Equal(t, "kafka unavailable", deadLetters.letters[0].Reason)
+}
+
+func TestStartKafkaFlushOnShutdown(t *testing.T) {
+	writer := new(mockWriter)
+	writer.On("WriteMessages", mock.Anything, mock.Anything).Return(nil)
+
+	c := make(chan kafkago.Message, 10)
+	c <- kafka.Message{Value: []byte("first")}
+	c <- kafka.Message{Value: []byte("second")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		StartKafka(ctx, c, writer, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("StartKafka did not return after the context was cancelled")
+	}
+
+	assert.Len(t, writer.messages, 2, "expected buffered messages to be flushed")
+	writer.AssertExpectations(t)
+}
+
+func TestStartKafkaRedriveHeaders(t *testing.T) {
+	spool := deadletter.NewSpool(filepath.Join(t.TempDir(), "deadletters.jsonl"))
+
+	msg, err := chain.NewMessage(chain.Transaction{Chain: chain.SolanaName, ID: "sig", User: "user-1",
+		Status: chain.StatusSeen}, chain.KeyByUser)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan kafkago.Message, 1)
+	c <- msg
+	cancel()
+	StartKafka(ctx, c, failingWriter{}, spool)
+
+	// the message is written again as it was first sent, headers included
+	writer := new(mockWriter)
+	writer.On("WriteMessages", mock.Anything, mock.Anything).Return(nil)
+	n, err := spool.Redrive(func(d chain.DeadLetter) error {
+		return writer.WriteMessages(context.Background(), d.Message())
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Len(t, writer.messages, 1)
+	assert.Equal(t, msg.Key, writer.messages[0].Key)
+	assert.Equal(t, msg.Value, writer.messages[0].Value)
+	assert.Equal(t, []kafkago.Header{
+		{Key: chain.HeaderEventID, Value: []byte("solana:sig:user-1")},
+		{Key: chain.HeaderStatus, Value: []byte("seen")},
+	}, writer.messages[0].Headers)
+}
@@ -0,0 +1,241 @@
+package registry
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrNotFound is returned when removing an address that is not registered.
+	ErrNotFound = errors.New("address not registered")
+
+	// ErrConflict is returned when adding an address already owned by another user.
+	ErrConflict = errors.New("address owned by another user")
+)
+
+var accountsBucket = []byte("accounts")
+
+// BoltRegistry is a chain.Registry stored in an embedded bbolt database, one
+// key per address, that can be edited while the watchers run. Reads are served
+// from memory.
+type BoltRegistry struct {
+	db *bolt.DB
+
+	mu       sync.RWMutex
+	accounts map[key]chain.Account
+	indexes  map[chain.Chain]*chain.AddressIndex
+}
+
+// NewBoltRegistry opens the registry at path. Addresses stored before they were
+// normalized are rewritten in their normalized form, invalid ones and those
+// normalized to an address of another user are logged and skipped.
+func NewBoltRegistry(path string) (*BoltRegistry, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &BoltRegistry{
+		db:       db,
+		accounts: map[key]chain.Account{},
+		indexes:  map[chain.Chain]*chain.AddressIndex{},
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(accountsBucket)
+		if err != nil {
+			return err
+		}
+
+		// the bucket cannot be changed while it is iterated
+		stale := [][]byte{}
+		rewritten := map[key]bool{}
+		err = b.ForEach(func(k, v []byte) error {
+			var account chain.Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return fmt.Errorf("decoding account %s: %w", k, err)
+			}
+
+			address, err := chain.NormalizeAddress(account.Chain, account.Address)
+			if err != nil {
+				log.Printf("skipping registered account %s of user %s: %v", k, account.User, err)
+				return nil
+			}
+
+			normalized := key{account.Chain, address}
+			if owner, ok := r.accounts[normalized]; ok && owner.User != account.User {
+				log.Printf("skipping registered account %s of user %s: %s address %s %v %s",
+					k, account.User, account.Chain, address, ErrConflict, owner.User)
+				return nil
+			}
+			if string(k) != string(normalized.bytes()) {
+				stale = append(stale, slices.Clone(k))
+			}
+			if address != account.Address || string(k) != string(normalized.bytes()) {
+				rewritten[normalized] = true
+			}
+			account.Address = address
+			r.accounts[normalized] = account
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		for k := range rewritten {
+			value, err := json.Marshal(r.accounts[k])
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k.bytes(), value); err != nil {
+				return err
+			}
+		}
+		if len(rewritten) != 0 {
+			log.Printf("Normalized %d registered addresses", len(rewritten))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for k := range r.accounts {
+		r.indexOf(k.chain).Add(k.address)
+	}
+
+	return r, nil
+}
+
+func (r *BoltRegistry) Lookup(c chain.Chain, address string) (chain.Account, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	account, ok := r.accounts[key{c, address}]
+	return account, ok
+}
+
+func (r *BoltRegistry) Addresses(c chain.Chain) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.indexes[c].Addresses()
+}
+
+func (r *BoltRegistry) Index(c chain.Chain) *chain.AddressIndex {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.indexes[c]
+}
+
+// List returns every registered account, sorted by user, chain and address.
+func (r *BoltRegistry) List() []chain.Account {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	accounts := make([]chain.Account, 0, len(r.accounts))
+	for _, account := range r.accounts {
+		accounts = append(accounts, account)
+	}
+	slices.SortFunc(accounts, func(a, b chain.Account) int {
+		if a.User != b.User {
+			return cmp.Compare(a.User, b.User)
+		}
+		if a.Chain != b.Chain {
+			return cmp.Compare(string(a.Chain), string(b.Chain))
+		}
+		return cmp.Compare(a.Address, b.Address)
+	})
+	return accounts
+}
+
+// Add registers account with its address normalized, or updates its labels if
+// it is already registered to the same user. Invalid addresses are rejected with
+// chain.ErrInvalidAddress.
+func (r *BoltRegistry) Add(account chain.Account) error {
+	address, err := chain.NormalizeAddress(account.Chain, account.Address)
+	if err != nil {
+		return err
+	}
+	account.Address = address
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key{account.Chain, account.Address}
+	if owner, ok := r.accounts[k]; ok && owner.User != account.User {
+		return fmt.Errorf("%s address %s: %w %s", account.Chain, account.Address, ErrConflict, owner.User)
+	}
+
+	value, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	err = r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).Put(k.bytes(), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	r.accounts[k] = account
+	r.indexOf(account.Chain).Add(account.Address)
+	return nil
+}
+
+// Remove unregisters address on c, in any of its forms.
+func (r *BoltRegistry) Remove(c chain.Chain, address string) error {
+	if normalized, err := chain.NormalizeAddress(c, address); err == nil {
+		address = normalized
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := key{c, address}
+	if _, ok := r.accounts[k]; !ok {
+		return fmt.Errorf("%s address %s: %w", c, address, ErrNotFound)
+	}
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).Delete(k.bytes())
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(r.accounts, k)
+	r.indexes[c].Remove(address)
+	return nil
+}
+
+func (r *BoltRegistry) Close() error {
+	return r.db.Close()
+}
+
+// indexOf returns the index of c, created on its first address.
+func (r *BoltRegistry) indexOf(c chain.Chain) *chain.AddressIndex {
+	if r.indexes[c] == nil {
+		r.indexes[c] = chain.NewAddressIndex(chain.AddressBloomFilter)
+	}
+	return r.indexes[c]
+}
+
+func (k key) bytes() []byte {
+	return []byte(string(k.chain) + ":" + k.address)
+}
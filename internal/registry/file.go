@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+)
+
+// User is an entry of the registry file: a user and the addresses it owns.
+type User struct {
+	ID        string    `json:"id"`
+	Addresses []Address `json:"addresses"`
+}
+
+// Address is an address owned by a user, with optional labels.
+type Address struct {
+	Chain   chain.Chain `json:"chain"`
+	Address string      `json:"address"`
+	Labels  []string    `json:"labels,omitempty"`
+}
+
+type key struct {
+	chain   chain.Chain
+	address string
+}
+
+// FileRegistry is a chain.Registry loaded from a JSON file listing users and their addresses.
+type FileRegistry struct {
+	accounts  map[key]chain.Account
+	addresses map[chain.Chain][]string
+	indexes   map[chain.Chain]*chain.AddressIndex
+}
+
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+
+	return NewRegistry(users)
+}
+
+// NewRegistry returns a registry of users, with their addresses normalized. An
+// address may only belong to one user, invalid addresses are rejected.
+func NewRegistry(users []User) (*FileRegistry, error) {
+	r := &FileRegistry{
+		accounts:  map[key]chain.Account{},
+		addresses: map[chain.Chain][]string{},
+		indexes:   map[chain.Chain]*chain.AddressIndex{},
+	}
+
+	for _, user := range users {
+		if user.ID == "" {
+			return nil, errors.New("user without id")
+		}
+		for _, addr := range user.Addresses {
+			if addr.Chain == "" || addr.Address == "" {
+				return nil, fmt.Errorf("address of user %s without chain or address", user.ID)
+			}
+			address, err := chain.NormalizeAddress(addr.Chain, addr.Address)
+			if err != nil {
+				return nil, fmt.Errorf("address of user %s: %w", user.ID, err)
+			}
+
+			k := key{addr.Chain, address}
+			if owner, ok := r.accounts[k]; ok {
+				return nil, fmt.Errorf("%s address %s belongs to both %s and %s", addr.Chain, address, owner.User, user.ID)
+			}
+			r.accounts[k] = chain.Account{
+				Chain:   addr.Chain,
+				Address: address,
+				User:    user.ID,
+				Labels:  addr.Labels,
+			}
+			r.addresses[addr.Chain] = append(r.addresses[addr.Chain], address)
+		}
+	}
+
+	for c, addresses := range r.addresses {
+		r.indexes[c] = chain.NewAddressIndex(chain.AddressBloomFilter, addresses...)
+	}
+
+	return r, nil
+}
+
+func (r *FileRegistry) Lookup(c chain.Chain, address string) (chain.Account, bool) {
+	account, ok := r.accounts[key{c, address}]
+	return account, ok
+}
+
+func (r *FileRegistry) Addresses(c chain.Chain) []string {
+	return r.addresses[c]
+}
+
+func (r *FileRegistry) Index(c chain.Chain) *chain.AddressIndex {
+	return r.indexes[c]
+}
@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MathieuCesbron/backend-interview-crypto/internal/chain"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/go-cmp/cmp"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	solana1   = "ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49"
+	solana2   = "CPG7gjcjcdZGHE5EJ6LoAL4xqZtNFeWEXXmtkYjAoVaF"
+	solana3   = "bUz1BcqoGdWC32C5EfA5UVoCqTibxBSTtztjwwcQBQR"
+	ethereum1 = "0x4838b106fce9647bdf1e7877bf73ce8b0bad5f97"
+	ethereum2 = "0xdac17f958d2ee523a2206206994597c13d831ec7"
+)
+
+const registryFile = `[
+  {
+    "id": "user-1",
+    "addresses": [
+      {"chain": "solana", "address": "ADaUMid9yfUytqMBgopwjb2DTLSokTSzL1zt6iGPaS49", "labels": ["deposit"]},
+      {"chain": "ethereum", "address": "0x4838b106fce9647bdf1e7877bf73ce8b0bad5f97"},
+      {"chain": "ethereum", "address": "0xdac17f958d2ee523a2206206994597c13d831ec7"}
+    ]
+  },
+  {"id": "user-2", "addresses": [{"chain": "bitcoin", "address": "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"}]}
+]`
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte(registryFile), 0o644); err != nil {
+		t.Fatalf("failed to write registry: %v", err)
+	}
+
+	r, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to load registry: %v", err)
+	}
+
+	account, ok := r.Lookup(chain.SolanaName, solana1)
+	expected := chain.Account{Chain: chain.SolanaName, Address: solana1, User: "user-1", Labels: []string{"deposit"}}
+	if !ok {
+		t.Fatalf("expected solana1 to be registered")
+	}
+	if diff := cmp.Diff(expected, account); diff != "" {
+		t.Errorf("account mismatch. (-want +got):\n%s", diff)
+	}
+
+	// the same address on another chain is not registered
+	if _, ok := r.Lookup(chain.EthereumName, solana1); ok {
+		t.Errorf("expected solana1 not to be registered on ethereum")
+	}
+
+	if diff := cmp.Diff([]string{ethereum1, ethereum2}, r.Addresses(chain.EthereumName)); diff != "" {
+		t.Errorf("addresses mismatch. (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewRegistryErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []User
+	}{
+		{
+			name:  "user without id",
+			users: []User{{Addresses: []Address{{Chain: chain.SolanaName, Address: solana1}}}},
+		},
+		{
+			name:  "address without chain",
+			users: []User{{ID: "user-1", Addresses: []Address{{Address: solana1}}}},
+		},
+		{
+			name:  "invalid address",
+			users: []User{{ID: "user-1", Addresses: []Address{{Chain: chain.EthereumName, Address: "0xabc"}}}},
+		},
+		{
+			name: "address owned twice",
+			users: []User{
+				{ID: "user-1", Addresses: []Address{{Chain: chain.SolanaName, Address: solana1}}},
+				{ID: "user-2", Addresses: []Address{{Chain: chain.SolanaName, Address: solana1}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewRegistry(test.users); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestWatchlist(t *testing.T) {
+	r, err := NewRegistry([]User{{ID: "user-1", Addresses: []Address{
+		{Chain: chain.SolanaName, Address: solana1},
+		{Chain: chain.SolanaName, Address: solana2},
+	}}})
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+
+	t.Setenv("SOLANA_ADDRESSES", solana2+","+solana3)
+	if diff := cmp.Diff([]string{solana2, solana3, solana1}, chain.Watchlist(chain.SolanaName, "SOLANA_ADDRESSES", r)); diff != "" {
+		t.Errorf("watchlist mismatch. (-want +got):\n%s", diff)
+	}
+
+	if got := chain.Owner(r, chain.SolanaName, solana3); got.User != solana3 {
+		t.Errorf("expected an unregistered address to be its own user, got %q", got.User)
+	}
+	if got := chain.Owner(r, chain.SolanaName, solana1); got.User != "user-1" {
+		t.Errorf("expected solana1 to belong to user-1, got %q", got.User)
+	}
+}
+
+func TestBoltRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+
+	r, err := NewBoltRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+
+	so1 := chain.Account{Chain: chain.SolanaName, Address: solana1, User: "user-1"}
+	so2 := chain.Account{Chain: chain.SolanaName, Address: solana2, User: "user-2", Labels: []string{"deposit"}}
+	for _, account := range []chain.Account{so2, so1} {
+		if err := r.Add(account); err != nil {
+			t.Fatalf("failed to add %s: %v", account.Address, err)
+		}
+	}
+
+	if err := r.Add(chain.Account{Chain: chain.SolanaName, Address: solana1, User: "user-2"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a conflict adding an address of another user, got %v", err)
+	}
+	if err := r.Remove(chain.EthereumName, solana1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected not found removing an unregistered address, got %v", err)
+	}
+
+	// the same user updates the labels
+	so1.Labels = []string{"hot"}
+	if err := r.Add(so1); err != nil {
+		t.Fatalf("failed to update solana1: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{solana1, solana2}, r.Addresses(chain.SolanaName)); diff != "" {
+		t.Errorf("addresses mismatch. (-want +got):\n%s", diff)
+	}
+
+	if err := r.Remove(chain.SolanaName, solana2); err != nil {
+		t.Fatalf("failed to remove solana2: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close registry: %v", err)
+	}
+
+	// changes are persisted
+	r, err = NewBoltRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to reopen registry: %v", err)
+	}
+	defer r.Close()
+
+	if diff := cmp.Diff([]chain.Account{so1}, r.List()); diff != "" {
+		t.Errorf("accounts mismatch. (-want +got):\n%s", diff)
+	}
+	if account, ok := r.Lookup(chain.SolanaName, solana1); !ok || account.User != "user-1" {
+		t.Errorf("expected solana1 to belong to user-1, got %+v", account)
+	}
+	if _, ok := r.Lookup(chain.SolanaName, solana2); ok {
+		t.Errorf("expected solana2 to be removed")
+	}
+}
+
+func TestBoltRegistryNormalizesOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+
+	// accounts stored before their addresses were normalized
+	checksummed := common.HexToAddress(ethereum1).Hex()
+	upper := "0x" + strings.ToUpper(ethereum2[2:])
+	stored := map[string]chain.Account{
+		"ethereum:" + checksummed: {Chain: chain.EthereumName, Address: checksummed, User: "user-1"},
+		"ethereum:" + upper:       {Chain: chain.EthereumName, Address: upper, User: "user-2"},
+		// normalized to the address of user-2, loaded first
+		"ethereum:" + ethereum2: {Chain: chain.EthereumName, Address: ethereum2, User: "user-1"},
+		"solana:invalid":        {Chain: chain.SolanaName, Address: "invalid", User: "user-1"},
+	}
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(accountsBucket)
+		if err != nil {
+			return err
+		}
+		for k, account := range stored {
+			value, _ := json.Marshal(account)
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("failed to store accounts: %v", err)
+	}
+
+	r, err := NewBoltRegistry(path)
+	if err != nil {
+		t.Fatalf("failed to open registry: %v", err)
+	}
+	expected := []chain.Account{
+		{Chain: chain.EthereumName, Address: ethereum1, User: "user-1"},
+		{Chain: chain.EthereumName, Address: ethereum2, User: "user-2"},
+	}
+	if diff := cmp.Diff(expected, r.List()); diff != "" {
+		t.Errorf("accounts mismatch. (-want +got):\n%s", diff)
+	}
+	if _, ok := r.Lookup(chain.EthereumName, ethereum1); !ok {
+		t.Errorf("expected ethereum1 to be found in its normalized form")
+	}
+	r.Close()
+
+	// the normalized keys are rewritten, the skipped accounts are kept as they are
+	keys := []string{}
+	db, err = bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if diff := cmp.Diff([]string{"ethereum:" + ethereum1, "ethereum:" + ethereum2, "solana:invalid"}, keys); diff != "" {
+		t.Errorf("keys mismatch. (-want +got):\n%s", diff)
+	}
+}